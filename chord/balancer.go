@@ -0,0 +1,83 @@
+package chord
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+	"github.com/ltu-tmmoa/chord-sky/log"
+)
+
+// Picks an ID for a node about to join the ring of `node0`, which splits the
+// most loaded key range near given ID in half.
+//
+// The key ranges considered are those owned by the successor of given ID and
+// by the nodes of its successor list, each of which is asked for the amount
+// of keys it owns. The picked ID is the median of the keys owned by the most
+// loaded node, making the joining node take over half of them. If the most
+// loaded node owns less than two keys, the ID in the middle of its range is
+// picked instead.
+func balancedID(node0 Node, id *data.ID) (*data.ID, error) {
+	succ, err := node0.FindSuccessor(id)
+	if err != nil {
+		return nil, err
+	}
+	succs, err := succ.SuccessorList()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		loaded     Node
+		loadedPred Node
+		loadedKeys []*data.ID
+		candidates []Node
+	)
+	for _, candidate := range append([]Node{succ}, succs...) {
+		if candidate == nil || containsNodeWithID(candidates, candidate.ID()) {
+			continue
+		}
+		candidates = append(candidates, candidate)
+		pred, err := candidate.Predecessor()
+		if err != nil {
+			return nil, err
+		}
+		fromKey := calcfingerStart(pred.ID(), 0)
+		keys, err := candidate.Storage().GetKeyRange(fromKey, calcfingerStart(candidate.ID(), 0))
+		if err != nil {
+			return nil, err
+		}
+		// Storages need not list keys in ring order.
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Diff(fromKey).Cmp(keys[j].Diff(fromKey)) < 0
+		})
+		if loaded == nil || len(keys) > len(loadedKeys) {
+			loaded, loadedPred, loadedKeys = candidate, pred, keys
+		}
+	}
+	if len(loadedKeys) >= 2 {
+		log.Logger.Println("Splitting", len(loadedKeys), "keys owned by", loaded, "...")
+		return loadedKeys[(len(loadedKeys)-1)/2], nil
+	}
+	mid := midID(loadedPred.ID(), loaded.ID())
+	if mid == nil {
+		return id, nil
+	}
+	log.Logger.Println("Splitting key range owned by", loaded, "...")
+	return mid, nil
+}
+
+// Resolves the ID in the middle of (from, to), or `nil` if the interval holds
+// no IDs. If `from` equals `to`, the interval is considered to span the whole
+// ring.
+func midID(from, to *data.ID) *data.ID {
+	m := from.Bits()
+	span := new(big.Int).Set(to.Diff(from).BigInt())
+	if span.Sign() == 0 {
+		span.Lsh(big.NewInt(1), uint(m))
+	}
+	half := span.Rsh(span, 1)
+	if half.Sign() == 0 {
+		return nil
+	}
+	return data.NewID(half.Add(half, from.BigInt()), m)
+}
@@ -0,0 +1,109 @@
+package chord
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
+
+func TestBalancedID(t *testing.T) {
+	nodes := prepareNodes(0, 4)
+
+	nodes[0].join(nil)
+	nodes[1].join(nodes[0])
+	for _, node := range nodes {
+		node.fixSuccessorList()
+		node.fixAllFingers()
+	}
+
+	// Node 4 owns keys 1, 2 and 3, while node 0 owns key 5.
+	for _, key := range []int64{1, 2, 3} {
+		nodes[1].storage.Set(newID64(key, M3), []byte{})
+	}
+	nodes[0].storage.Set(newID64(5, M3), []byte{})
+
+	id, err := balancedID(nodes[0], newID64(6, M3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Eq(newID64(2, M3)) {
+		t.Errorf("Balanced ID expected to be 2, was %v", id)
+	}
+}
+
+func TestBalancedIDRingOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storages := map[string]func(id int64) data.Storage{
+		"memory": func(id int64) data.Storage {
+			return data.NewMemoryStorage(M3)
+		},
+		"file": func(id int64) data.Storage {
+			storage, err := data.OpenFileStorage(filepath.Join(dir, storageLogName(int(id))), M3, data.SyncNever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return storage
+		},
+	}
+	for name, open := range storages {
+		nodes := make([]*localNode, 2)
+		for i, s := range []int64{0, 4} {
+			config := NewConfig()
+			config.IDSpace.Bits = M3
+			nodes[i] = newLocalNodeStorage(fakeAddr(byte(s)), newID64(s, M3), open(s), config)
+		}
+		nodes[0].join(nil)
+		nodes[1].join(nodes[0])
+		for _, node := range nodes {
+			node.fixSuccessorList()
+			node.fixAllFingers()
+		}
+
+		// Node 0 owns keys 5, 6, 7 and 0, whose range wraps around the ring.
+		for _, key := range []int64{0, 7, 5, 6} {
+			nodes[0].storage.Set(newID64(key, M3), []byte{})
+		}
+		nodes[1].storage.Set(newID64(1, M3), []byte{})
+
+		id, err := balancedID(nodes[1], newID64(7, M3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !id.Eq(newID64(6, M3)) {
+			t.Errorf("Balanced ID using %s storage expected to be 6, was %v", name, id)
+		}
+		for _, node := range nodes {
+			if closer, ok := node.storage.(interface{ Close() error }); ok {
+				closer.Close()
+			}
+		}
+	}
+}
+
+func TestMidID(t *testing.T) {
+	expectMidID := func(from, to, expected int64) {
+		mid := midID(newID64(from, M3), newID64(to, M3))
+		if expected < 0 {
+			if mid != nil {
+				t.Errorf("midID(%d, %d) expected to be nil, was %v", from, to, mid)
+			}
+			return
+		}
+		if mid == nil || !mid.Eq(newID64(expected, M3)) {
+			t.Errorf("midID(%d, %d) expected to be %d, was %v", from, to, expected, mid)
+		}
+	}
+	expectMidID(0, 4, 2)
+	expectMidID(4, 0, 6)
+	expectMidID(6, 2, 0)
+	expectMidID(3, 3, 7)
+	expectMidID(3, 4, -1)
+}
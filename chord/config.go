@@ -0,0 +1,111 @@
+package chord
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
+
+// Config holds settings of a local Chord node.
+type Config struct {
+	// Replicas is the amount of nodes holding a copy of each key, including
+	// the node owning the key.
+	Replicas int
+
+	// ReadQuorum is the default amount of replicas that must respond to a
+	// read for it to succeed.
+	ReadQuorum int
+
+	// WriteQuorum is the default amount of replicas that must acknowledge a
+	// write for it to succeed.
+	WriteQuorum int
+
+	// Versioned causes stored values to be versioned using vector clocks,
+	// keeping concurrently written versions as siblings.
+	Versioned bool
+
+	// DataDir is the directory in which stored keys are persisted, or an
+	// empty string if keys are only to be held in memory.
+	DataDir string
+
+	// Sync determines when keys persisted in DataDir are flushed to disk.
+	Sync data.SyncPolicy
+
+	// TombstoneGrace is the duration for which removed keys are remembered,
+	// during which they cannot be restored by replicas that missed their
+	// removal.
+	TombstoneGrace time.Duration
+
+	// VirtualNodes is the amount of nodes hosted by each process, each having
+	// its own ID, finger table and storage.
+	VirtualNodes int
+
+	// IDSpace determines the IDs of the ring, which must be the same for all
+	// of its nodes.
+	IDSpace IDSpace
+
+	// IDs holds the IDs of the first virtual nodes, in order. Virtual nodes
+	// without IDs have IDs derived from their addresses.
+	IDs []*data.ID
+
+	// Balance causes virtual nodes without configured IDs to pick IDs
+	// splitting the most loaded key range near them when joining a ring.
+	Balance bool
+
+	// Transport is used to reach the remote nodes of the ring.
+	Transport Transport
+
+	// Lookup determines how the local nodes find the successors of IDs,
+	// unless a lookup mode is given explicitly.
+	Lookup LookupMode
+
+	// FailureDetector determines when remote nodes failing to respond are
+	// disconnected.
+	FailureDetector FailureDetectorConfig
+
+	// Clock provides the current time, such as when determining how long
+	// remote nodes have been silent. If nil, time.Now is used.
+	Clock func() time.Time
+
+	// Go runs given function concurrently with its caller, such as when
+	// calling several replicas at once. If nil, each function is run in a
+	// goroutine of its own.
+	Go func(fn func())
+
+	// Rand is the source of randomness of the nodes, such as when picking
+	// fingers to fix. If nil, the global source of math/rand is used.
+	Rand *rand.Rand
+}
+
+// NewConfig creates a new node configuration holding default settings.
+func NewConfig() *Config {
+	return &Config{
+		Replicas:       3,
+		ReadQuorum:     1,
+		WriteQuorum:    1,
+		Sync:           data.SyncAlways,
+		TombstoneGrace: 1 * time.Hour,
+		VirtualNodes:   1,
+		IDSpace:        IDSpace{Bits: 160, Hash: HashSHA1},
+		Transport:      NewHTTPTransport(),
+		Lookup:         LookupIterative,
+		FailureDetector: FailureDetectorConfig{
+			Threshold:       8,
+			AcceptablePause: 30 * time.Second,
+			MinStdDev:       500 * time.Millisecond,
+			FirstInterval:   10 * time.Second,
+			MaxSamples:      100,
+		},
+	}
+}
+
+// Runs given function concurrently with its caller, using the configured Go
+// function if set.
+func (config *Config) spawn(fn func()) {
+	if config.Go != nil {
+		config.Go(fn)
+		return
+	}
+	go fn()
+}
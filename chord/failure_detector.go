@@ -0,0 +1,182 @@
+package chord
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FailureDetectorConfig determines when remote nodes are suspected to have
+// failed, causing them to be disconnected.
+//
+// Suspicion is expressed as a phi value, as described in "The φ Accrual
+// Failure Detector" by Hayashibara et al. A phi of 1 means that a node is
+// about 10% likely to be wrongly suspected, a phi of 2 about 1%, and so on.
+type FailureDetectorConfig struct {
+	// Threshold is the phi at which nodes failing to respond are
+	// disconnected. A threshold of zero causes nodes to be disconnected as
+	// soon as they fail to respond.
+	Threshold float64
+
+	// AcceptablePause is the duration for which nodes may be silent without
+	// being suspected, which should span a few refresh intervals.
+	AcceptablePause time.Duration
+
+	// MinStdDev is the smallest standard deviation of response intervals
+	// assumed, preventing nodes responding at regular intervals from being
+	// suspected as soon as one of their responses is late.
+	MinStdDev time.Duration
+
+	// FirstInterval is the response interval assumed for nodes yet to
+	// respond.
+	FirstInterval time.Duration
+
+	// MaxSamples is the amount of response intervals remembered per node.
+	MaxSamples int
+}
+
+// Tracks when remote nodes respond, estimating how likely each is to have
+// failed.
+//
+// Failure detectors are safe for concurrent use.
+type failureDetector struct {
+	config FailureDetectorConfig
+
+	mutex sync.Mutex
+	nodes map[string]*responseHistory
+}
+
+// Response intervals of some node, along with their sum and sum of squares.
+type responseHistory struct {
+	last      time.Time
+	failing   bool
+	intervals []float64
+	sum       float64
+	sumSq     float64
+}
+
+func newFailureDetector(config FailureDetectorConfig) *failureDetector {
+	return &failureDetector{
+		config: config,
+		nodes:  map[string]*responseHistory{},
+	}
+}
+
+// Starts tracking referenced node at given time, unless already tracked.
+func (detector *failureDetector) track(ref string, now time.Time) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	if _, ok := detector.nodes[ref]; ok {
+		return
+	}
+	history := &responseHistory{last: now}
+	history.add(detector.config.FirstInterval.Seconds(), 1)
+	detector.nodes[ref] = history
+}
+
+// Records that referenced node responded at given time.
+func (detector *failureDetector) responded(ref string, now time.Time) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	history, ok := detector.nodes[ref]
+	if !ok {
+		return
+	}
+	history.failing = false
+	if now.After(history.last) {
+		history.add(now.Sub(history.last).Seconds(), detector.config.MaxSamples)
+		history.last = now
+	}
+}
+
+// Records that referenced node failed to respond at given time, returning its
+// resulting phi, or zero if not tracked.
+//
+// Nodes are only heard from when called, which is why suspicion accrues from
+// the first of consecutive failures. Any longer silence before it is taken to
+// be a single response interval.
+func (detector *failureDetector) failed(ref string, now time.Time) float64 {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	history, ok := detector.nodes[ref]
+	if !ok {
+		return 0
+	}
+	if !history.failing {
+		history.failing = true
+		interval := time.Duration(history.sum / float64(len(history.intervals)) * float64(time.Second))
+		if since := now.Add(-interval); since.After(history.last) {
+			history.last = since
+		}
+	}
+	return history.phi(now, detector.config)
+}
+
+// Stops tracking referenced node.
+func (detector *failureDetector) forget(ref string) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	delete(detector.nodes, ref)
+}
+
+// Suspicion level of some tracked node.
+type suspicion struct {
+	ref string
+	phi float64
+}
+
+// Resolves the phi of all tracked nodes at given time, ordered by reference.
+func (detector *failureDetector) suspicions(now time.Time) []suspicion {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	suspicions := make([]suspicion, 0, len(detector.nodes))
+	for ref, history := range detector.nodes {
+		suspicions = append(suspicions, suspicion{ref, history.phi(now, detector.config)})
+	}
+	sort.Slice(suspicions, func(i, j int) bool {
+		return suspicions[i].ref < suspicions[j].ref
+	})
+	return suspicions
+}
+
+// Adds interval of given seconds, dropping the oldest interval if more than
+// `max` would otherwise be held.
+func (history *responseHistory) add(interval float64, max int) {
+	if max > 0 && len(history.intervals) >= max {
+		oldest := history.intervals[0]
+		history.intervals = history.intervals[1:]
+		history.sum -= oldest
+		history.sumSq -= oldest * oldest
+	}
+	history.intervals = append(history.intervals, interval)
+	history.sum += interval
+	history.sumSq += interval * interval
+}
+
+// Calculates phi at given time, assuming response intervals to be normally
+// distributed.
+func (history *responseHistory) phi(now time.Time, config FailureDetectorConfig) float64 {
+	n := float64(len(history.intervals))
+	mean := history.sum / n
+	stdDev := math.Sqrt(math.Max(history.sumSq/n-mean*mean, 0))
+	stdDev = math.Max(stdDev, config.MinStdDev.Seconds())
+	mean += config.AcceptablePause.Seconds()
+
+	elapsed := now.Sub(history.last).Seconds()
+	if stdDev == 0 {
+		if elapsed > mean {
+			return math.Inf(1)
+		}
+		return 0
+	}
+
+	// The probability of the next response arriving even later.
+	p := 0.5 * math.Erfc((elapsed-mean)/(stdDev*math.Sqrt2))
+	return math.Max(-math.Log10(p), 0)
+}
@@ -0,0 +1,64 @@
+package chord
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFailureDetectorPhi(t *testing.T) {
+	detector := newFailureDetector(FailureDetectorConfig{
+		Threshold:       8,
+		AcceptablePause: 1 * time.Second,
+		MinStdDev:       100 * time.Millisecond,
+		FirstInterval:   1 * time.Second,
+		MaxSamples:      10,
+	})
+	start := time.Unix(0, 0)
+	detector.track("a", start)
+
+	// Responding every second.
+	now := start
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Second)
+		detector.responded("a", now)
+	}
+	if phi := detector.failed("a", now.Add(1*time.Second)); phi > 1 {
+		t.Errorf("phi after 1s of silence expected to be at most 1, was %.2f", phi)
+	}
+	phi2 := detector.failed("a", now.Add(2200*time.Millisecond))
+	phi3 := detector.failed("a", now.Add(2500*time.Millisecond))
+	if phi2 < 1 || phi3 <= phi2 {
+		t.Errorf("phi expected to grow with silence, was %.2f after 2.2s and %.2f after 2.5s", phi2, phi3)
+	}
+	if phi := detector.failed("a", now.Add(5*time.Second)); phi < 8 {
+		t.Errorf("phi after 5s of silence expected to be at least 8, was %.2f", phi)
+	}
+
+	// Silence before the first failure counts as a single interval.
+	now = now.Add(time.Minute)
+	detector.responded("a", now)
+	if phi := detector.failed("a", now.Add(time.Hour)); phi > 1 {
+		t.Errorf("phi after first failure expected to be at most 1, was %.2f", phi)
+	}
+
+	if phi := detector.failed("b", now); phi != 0 {
+		t.Errorf("phi of untracked node expected to be 0, was %.2f", phi)
+	}
+	detector.forget("a")
+	if suspicions := detector.suspicions(now); len(suspicions) != 0 {
+		t.Errorf("No nodes expected to be tracked after being forgotten, got %v", suspicions)
+	}
+}
+
+func TestFailureDetectorZeroThreshold(t *testing.T) {
+	detector := newFailureDetector(FailureDetectorConfig{})
+	now := time.Unix(0, 0)
+	detector.track("a", now)
+	if phi := detector.failed("a", now); phi < 0 || math.IsNaN(phi) {
+		t.Errorf("phi expected to be at least 0, was %.2f", phi)
+	}
+	if phi := detector.failed("a", now.Add(time.Nanosecond)); !math.IsInf(phi, 1) {
+		t.Errorf("phi after any silence expected to be infinite without deviation, was %.2f", phi)
+	}
+}
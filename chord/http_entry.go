@@ -0,0 +1,233 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
+
+const (
+	httpHeaderClock   = "X-Chord-Clock"
+	httpHeaderExpires = "X-Chord-Expires"
+	httpHeaderDeleted = "X-Chord-Deleted"
+	httpHeaderTTL     = "X-Chord-TTL"
+)
+
+// Encodes entry into headers and a body.
+//
+// An entry without siblings has its value used as body as is. Entries with
+// siblings are encoded as `multipart/mixed` bodies with one part per version,
+// while the clock header of the whole entry holds its causal context.
+func httpEncodeEntry(header http.Header, entry *data.Entry) ([]byte, error) {
+	header.Set("ETag", entry.ETag())
+	httpWriteHeaderTime(header, httpHeaderExpires, entry.Expires)
+	versions := entry.Versions()
+	if len(versions) == 1 {
+		httpWriteVersionHeader(header, versions[0])
+		return entry.Value, nil
+	}
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	for _, version := range versions {
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Type", "application/octet-stream")
+		httpWriteVersionHeader(http.Header(partHeader), version)
+		part, err := writer.CreatePart(partHeader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(version.Value); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	httpWriteHeaderKeyName(header, entry.Name)
+	if context := entry.Context(); len(context) > 0 {
+		header.Set(httpHeaderClock, context.String())
+	}
+	return buf.Bytes(), nil
+}
+
+func httpWriteVersionHeader(header http.Header, version *data.Entry) {
+	httpWriteHeaderKeyName(header, version.Name)
+	if version.Clock != nil {
+		header.Set(httpHeaderClock, version.Clock.String())
+	}
+	httpWriteHeaderTime(header, httpHeaderDeleted, version.Deleted)
+}
+
+// Decodes entry from headers and body produced by httpEncodeEntry.
+func httpDecodeEntry(header http.Header, body io.Reader) (*data.Entry, error) {
+	etagVersion, err := httpReadHeaderETagVersion(header)
+	if err != nil {
+		return nil, err
+	}
+	expires, err := httpReadHeaderTime(header, httpHeaderExpires)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		entry, err := httpDecodeVersion(header, body)
+		if err != nil {
+			return nil, err
+		}
+		entry.Version = etagVersion
+		entry.Expires = expires
+		return entry, nil
+	}
+	var entry *data.Entry
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		version, err := httpDecodeVersion(http.Header(part.Header), part)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			entry = version
+		} else {
+			entry.Siblings = append(entry.Siblings, version)
+		}
+	}
+	if entry == nil {
+		entry = &data.Entry{}
+	}
+	entry.Version = etagVersion
+	entry.Expires = expires
+	return entry, nil
+}
+
+// Decodes entry written by some client, rather than by another node, from
+// headers and body.
+//
+// Values written by clients are opaque, which is why the body is used as value
+// as is, whatever its content type. Versions, expiry times and removal times
+// are managed by the nodes, which is why any headers holding them are ignored.
+// Clients are only able to refer to versions using preconditions.
+func httpDecodeClientEntry(header http.Header, body io.Reader) (*data.Entry, error) {
+	entry, err := httpDecodeVersion(header, body)
+	if err != nil {
+		return nil, err
+	}
+	entry.Deleted = time.Time{}
+	return entry, nil
+}
+
+// Reads entry version from ETag header, if any.
+func httpReadHeaderETagVersion(header http.Header) (uint64, error) {
+	etag := header.Get("ETag")
+	if len(etag) == 0 {
+		return 0, nil
+	}
+	version, err := strconv.ParseUint(strings.Trim(etag, "\""), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ETag `%s` is not valid.", etag)
+	}
+	return version, nil
+}
+
+// Writes time to identified header, unless zero.
+func httpWriteHeaderTime(header http.Header, key string, t time.Time) {
+	if !t.IsZero() {
+		header.Set(key, t.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// Reads time from identified header, if present.
+func httpReadHeaderTime(header http.Header, key string) (time.Time, error) {
+	str := header.Get(key)
+	if len(str) == 0 {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Header %s time `%s` is not valid.", key, str)
+	}
+	return t, nil
+}
+
+// Reads time to live from query parameter `ttl` or header, if present.
+//
+// The TTL is given either as a whole amount of seconds, or as a duration such
+// as `1m30s`, and must be positive. A TTL of zero is returned if none is given.
+func httpReadTTL(req *http.Request) (time.Duration, error) {
+	str := req.URL.Query().Get("ttl")
+	if len(str) == 0 {
+		str = req.Header.Get(httpHeaderTTL)
+	}
+	if len(str) == 0 {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(str)
+	if err != nil {
+		var seconds int64
+		seconds, err = strconv.ParseInt(str, 10, 64)
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("TTL `%s` is not valid; must be a positive amount of seconds or a duration.", str)
+	}
+	return ttl, nil
+}
+
+func httpDecodeVersion(header http.Header, body io.Reader) (*data.Entry, error) {
+	value, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	name, err := httpReadHeaderKeyName(header)
+	if err != nil {
+		return nil, err
+	}
+	var clock data.VectorClock
+	if str := header.Get(httpHeaderClock); len(str) > 0 {
+		if clock, err = data.ParseVectorClock(str); err != nil {
+			return nil, err
+		}
+	}
+	deleted, err := httpReadHeaderTime(header, httpHeaderDeleted)
+	if err != nil {
+		return nil, err
+	}
+	return &data.Entry{
+		Name:    name,
+		Value:   value,
+		Clock:   clock,
+		Deleted: deleted,
+	}, nil
+}
+
+// Writes entry to `w`, using status 300 if it has siblings.
+func httpWriteEntry(w http.ResponseWriter, entry *data.Entry) {
+	body, err := httpEncodeEntry(w.Header(), entry)
+	if err != nil {
+		httpWrite(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(entry.Siblings) > 0 {
+		w.WriteHeader(http.StatusMultipleChoices)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(body)
+}
@@ -0,0 +1,144 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
+
+// HTTPKVClient gets and sets values by arbitrary UTF-8 key names via the HTTP
+// key/value service of some node, which redirects it to the nodes owning the
+// keys.
+type HTTPKVClient struct {
+	// Client sends the requests of the key/value client. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	addr *net.TCPAddr
+}
+
+// NewHTTPKVClient creates a new key/value client, reaching the HTTPKVService
+// exposed below `/kv` at given address.
+func NewHTTPKVClient(addr *net.TCPAddr) *HTTPKVClient {
+	return &HTTPKVClient{addr: addr}
+}
+
+// Get gets the value associated with given key name.
+//
+// data.ErrNotFound is returned if no value is associated with the name.
+func (client *HTTPKVClient) Get(name string) ([]byte, error) {
+	return client.GetContext(context.Background(), name)
+}
+
+// GetContext is like Get, but fails if `ctx` is done before the value is got.
+func (client *HTTPKVClient) GetContext(ctx context.Context, name string) ([]byte, error) {
+	entry, err := client.GetEntryContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry gets the entry associated with given key name, including any
+// siblings and its version.
+//
+// data.ErrNotFound is returned if no entry is associated with the name.
+func (client *HTTPKVClient) GetEntry(name string) (*data.Entry, error) {
+	return client.GetEntryContext(context.Background(), name)
+}
+
+// GetEntryContext is like GetEntry, but fails if `ctx` is done before the
+// entry is got.
+func (client *HTTPKVClient) GetEntryContext(ctx context.Context, name string) (*data.Entry, error) {
+	res, body, err := client.do(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusMultipleChoices {
+		return nil, httpKVError(res, body)
+	}
+	return httpDecodeEntry(res.Header, bytes.NewReader(body))
+}
+
+// Set associates given value with given key name, potentially replacing an
+// existing value.
+func (client *HTTPKVClient) Set(name string, value []byte) error {
+	return client.SetContext(context.Background(), name, value)
+}
+
+// SetContext is like Set, but fails if `ctx` is done before the value is set.
+func (client *HTTPKVClient) SetContext(ctx context.Context, name string, value []byte) error {
+	res, body, err := client.do(ctx, http.MethodPut, name, value)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return httpKVError(res, body)
+	}
+	return nil
+}
+
+// Remove removes the value associated with given key name, if any.
+func (client *HTTPKVClient) Remove(name string) error {
+	return client.RemoveContext(context.Background(), name)
+}
+
+// RemoveContext is like Remove, but fails if `ctx` is done before the value
+// is removed.
+func (client *HTTPKVClient) RemoveContext(ctx context.Context, name string) error {
+	res, body, err := client.do(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotFound {
+		return httpKVError(res, body)
+	}
+	return nil
+}
+
+// Sends request concerning given key name, which is provided as a query
+// parameter to be used as is, reading the response body in full.
+func (client *HTTPKVClient) do(ctx context.Context, method, name string, body []byte) (*http.Response, []byte, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     client.addr.String(),
+		Path:     "/kv/",
+		RawQuery: url.Values{"name": {name}}.Encode(),
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpClient := client.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, resBody, nil
+}
+
+// Turns unexpected response into error, mapping statuses to the errors of the
+// data.Storage interface where possible.
+func httpKVError(res *http.Response, body []byte) error {
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return data.ErrNotFound
+	case http.StatusPreconditionFailed:
+		return data.ErrPreconditionFailed
+	}
+	return fmt.Errorf("HTTP key/value %s %s -> %s %s", res.Request.Method, res.Request.URL, res.Status, body)
+}
@@ -0,0 +1,209 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ltu-tmmoa/chord-sky/data"
+	"github.com/ltu-tmmoa/chord-sky/log"
+)
+
+// HTTPKVService exposes storage as an HTTP service, using arbitrary UTF-8 key
+// names rather than ring IDs.
+//
+// Each name is hashed into a ring ID using IDSpace.NameToID, and is then stored
+// along with its value at the node owning that ID.
+type HTTPKVService struct {
+	pool   *nodePool
+	router *mux.Router
+}
+
+// NewHTTPKVService creates a new HTTP key/value service, routing and storing
+// keys using the Chord node managed by given HTTP service.
+func NewHTTPKVService(chordService *HTTPService) *HTTPKVService {
+	service := HTTPKVService{
+		pool:   chordService.pool,
+		router: mux.NewRouter(),
+	}
+
+	pool := service.pool
+	space := pool.config.IDSpace
+	router := service.router
+
+	// Names are used as given, without cleaning any `.` or `..` segments or
+	// repeated slashes out of request paths.
+	router.SkipClean(true)
+
+	get := func(w http.ResponseWriter, req *http.Request) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		name, err := httpReadKeyName(req)
+		if err != nil {
+			httpWrite(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id := space.NameToID(name)
+		ctx, cancel := httpRequestContext(req)
+		defer cancel()
+		storage := service.resolveStorage(ctx, w, req, name, id)
+		if storage == nil {
+			return
+		}
+		entry, err := storage.GetEntryContext(ctx, id)
+		if err != nil {
+			httpWriteStorageError(w, err)
+			return
+		}
+		httpWriteEntry(w, entry)
+	}
+
+	put := func(w http.ResponseWriter, req *http.Request) {
+		entry, err := httpDecodeClientEntry(req.Header, req.Body)
+		req.Body.Close()
+		if err != nil {
+			httpWrite(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ttl, err := httpReadTTL(req)
+		if err != nil {
+			httpWrite(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		name, err := httpReadKeyName(req)
+		if err != nil {
+			httpWrite(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		entry.Name = name
+		id := space.NameToID(name)
+		ctx, cancel := httpRequestContext(req)
+		defer cancel()
+		storage := service.resolveStorage(ctx, w, req, name, id)
+		if storage == nil {
+			return
+		}
+		if ttl > 0 {
+			entry.Expires = time.Now().Add(ttl)
+		}
+		if err = storage.CompareAndSetEntryContext(ctx, id, httpReadPrecondition(req.Header), entry); err != nil {
+			httpWriteStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	remove := func(w http.ResponseWriter, req *http.Request) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		name, err := httpReadKeyName(req)
+		if err != nil {
+			httpWrite(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id := space.NameToID(name)
+		ctx, cancel := httpRequestContext(req)
+		defer cancel()
+		storage := service.resolveStorage(ctx, w, req, name, id)
+		if storage == nil {
+			return
+		}
+		if err := storage.CompareAndRemoveContext(ctx, id, httpReadPrecondition(req.Header)); err != nil {
+			httpWriteStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	// Names are given either as query parameter `name` or as request path.
+	router.HandleFunc("/", get).Queries("name", "{name}").Methods(http.MethodGet)
+	router.HandleFunc("/", put).Queries("name", "{name}").Methods(http.MethodPut)
+	router.HandleFunc("/", remove).Queries("name", "{name}").Methods(http.MethodDelete)
+	router.HandleFunc("/{name:.+}", get).Methods(http.MethodGet)
+	router.HandleFunc("/{name:.+}", put).Methods(http.MethodPut)
+	router.HandleFunc("/{name:.+}", remove).Methods(http.MethodDelete)
+
+	router.
+		HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			buf := &bytes.Buffer{}
+			listed := map[string]bool{}
+			for _, lnode := range pool.lnodes {
+				storage := lnode.Storage()
+				keys, err := storage.GetAllKeysContext(ctx)
+				if err != nil {
+					httpWrite(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				for _, key := range keys {
+					entry, err := storage.GetEntryContext(ctx, key)
+					if err == data.ErrNotFound {
+						continue
+					}
+					if err != nil {
+						httpWrite(w, http.StatusInternalServerError, err.Error())
+						return
+					}
+					if len(entry.Name) > 0 && !entry.Tombstone() && !listed[entry.Name] {
+						listed[entry.Name] = true
+						fmt.Fprintf(buf, "%s\n", entry.Name)
+					}
+				}
+			}
+			httpWrite(w, http.StatusOK, buf.String())
+		}).
+		Methods(http.MethodGet)
+
+	return &service
+}
+
+// Reads key name from query parameter `name`, if present, and otherwise from
+// the request path, which is unescaped but not cleaned.
+func httpReadKeyName(req *http.Request) (string, error) {
+	if name := req.URL.Query().Get("name"); len(name) > 0 {
+		return name, nil
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/"))
+	if err != nil || len(name) == 0 {
+		return "", errors.New("Key name is missing or not valid.")
+	}
+	return name, nil
+}
+
+// Resolves storage of the Chord node owning given key name and ID, redirecting
+// to the node owning it if not local.
+//
+// Redirects always carry the name as query parameter, as clients following
+// them would otherwise remove any `.` and `..` segments from its path.
+func (service *HTTPKVService) resolveStorage(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, id *data.ID) data.Storage {
+	query := req.URL.Query()
+	query.Set("name", name)
+	redirect := *req
+	redirect.URL = &url.URL{Path: "/", RawQuery: query.Encode()}
+	return httpResolveStorage(ctx, w, &redirect, service.pool, "/kv", id)
+}
+
+func (service *HTTPKVService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			http.Error(w, fmt.Sprint(r), http.StatusInternalServerError)
+			log.Logger.Println("Recovered:", r)
+			log.Logger.Println(string(debug.Stack()))
+		}
+	}()
+	log.Logger.Println(req.Method, req.URL)
+	service.router.ServeHTTP(w, req)
+}
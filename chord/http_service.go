@@ -2,14 +2,17 @@ package chord
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ltu-tmmoa/chord-sky/data"
@@ -30,21 +33,50 @@ type HTTPService struct {
 
 // NewHTTPService creates a new HTTP node, exposable as a service on the
 // identified local TCP interface.
-func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
+//
+// An error is returned if the storage of the node cannot be opened.
+func NewHTTPService(laddr *net.TCPAddr, config *Config) (*HTTPService, error) {
+	pool, err := newNodePool(laddr, config)
+	if err != nil {
+		return nil, err
+	}
 	service := HTTPService{
-		pool:   newNodePool(laddr),
+		pool:   pool,
 		router: mux.NewRouter(),
 	}
 
-	pool := service.pool
-	router := service.router
-	lnode := pool.lnode
+	// Each virtual node is exposed below its index, while the first virtual
+	// node is also exposed without one.
+	for _, lnode := range pool.lnodes {
+		routeNode(service.router.PathPrefix(fmt.Sprintf("/%d", lnode.VNode())).Subrouter(), pool, lnode)
+	}
+	routeNode(service.router, pool, pool.lnodes[0])
+
+	return &service, nil
+}
+
+// Registers the routes of given local node with given router.
+func routeNode(router *mux.Router, pool *nodePool, lnode *localNode) {
+	// Once left, the node answers all requests with status 410, making its
+	// peers treat it as failed.
+	router.
+		MatcherFunc(func(req *http.Request, match *mux.RouteMatch) bool {
+			return lnode.hasLeft()
+		}).
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			httpWrite(w, http.StatusGone, errNodeLeft.Error())
+		})
 
 	router.
 		HandleFunc("/info", func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
 			var pred string
 			{
-				predNode, predErr := lnode.Predecessor()
+				predNode, predErr := lnode.PredecessorContext(ctx)
 				if predErr != nil {
 					pred = predErr.Error()
 				} else {
@@ -53,11 +85,13 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 			}
 			buf := &bytes.Buffer{}
 			fmt.Fprintf(buf, "ID:          %s\r\n", lnode.ID())
+			fmt.Fprintf(buf, "Address:     %s\r\n", formatNodeAddr(lnode.TCPAddr(), lnode.VNode()))
 			fmt.Fprintf(buf, "Successor:   %s\r\n", lnode.successor())
 			fmt.Fprintf(buf, "Predecessor: %s\r\n", pred)
 
 			fmt.Fprint(buf, "\r\nSuccessor List:\r\n")
-			for i, succ := range lnode.succlist {
+			succlist, _ := lnode.SuccessorListContext(ctx)
+			for i, succ := range succlist {
 				fmt.Fprintf(buf, "%3d:         %s\r\n", i, succ)
 			}
 			fmt.Fprint(buf, "\r\nFinger Table:\r\n")
@@ -65,6 +99,10 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 			for i := 1; i <= m; i++ {
 				fmt.Fprintf(buf, "%3d:         %s\r\n", i, lnode.fingerNode(i))
 			}
+			fmt.Fprint(buf, "\r\nSuspicion Levels (phi):\r\n")
+			for _, s := range pool.detector.suspicions(pool.now()) {
+				fmt.Fprintf(buf, "%7.2f:     %s\r\n", s.phi, s.ref)
+			}
 			w.WriteHeader(http.StatusOK)
 			w.Write(buf.Bytes())
 		}).
@@ -99,24 +137,37 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 			}
 			i, _ := strconv.Atoi(mux.Vars(req)["i"])
 			node := lnode.fingerNode(i)
-			httpWrite(w, http.StatusOK, node.TCPAddr())
+			httpWrite(w, http.StatusOK, nodeRef(node))
 		}).
 		Methods(http.MethodGet)
 
 	router.
 		HandleFunc("/fingers/{i:[0-9]+}", func(w http.ResponseWriter, req *http.Request) {
 			i, _ := strconv.Atoi(mux.Vars(req)["i"])
-			addr, err := httpReadBodyAsAddr(req)
+			node, err := httpReadBodyAsNode(req, pool)
 			if err != nil {
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			node := pool.getOrCreateNode(addr)
-			lnode.SetFingerNode(i, node)
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			if err = lnode.SetFingerNodeContext(ctx, i, node); err != nil {
+				httpWrite(w, http.StatusFailedDependency, err.Error())
+				return
+			}
 			w.WriteHeader(http.StatusNoContent)
 		}).
 		Methods(http.MethodPut)
 
+	router.
+		HandleFunc("/idspace", func(w http.ResponseWriter, req *http.Request) {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			httpWrite(w, http.StatusOK, lnode.config.IDSpace)
+		}).
+		Methods(http.MethodGet)
+
 	router.
 		HandleFunc("/heartbeat", func(w http.ResponseWriter, req *http.Request) {
 			if req.Body != nil {
@@ -132,7 +183,7 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 				req.Body.Close()
 			}
 			succ := lnode.successor()
-			httpWrite(w, http.StatusOK, succ.TCPAddr())
+			httpWrite(w, http.StatusOK, nodeRef(succ))
 		}).
 		Methods(http.MethodGet)
 
@@ -141,12 +192,14 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 			if req.Body != nil {
 				req.Body.Close()
 			}
-			pred, err := lnode.Predecessor()
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			pred, err := lnode.PredecessorContext(ctx)
 			if err != nil {
 				httpWrite(w, http.StatusFailedDependency, err.Error())
 				return
 			}
-			httpWrite(w, http.StatusOK, pred.TCPAddr())
+			httpWrite(w, http.StatusOK, nodeRef(pred))
 		}).
 		Methods(http.MethodGet)
 
@@ -158,33 +211,45 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 			var id *data.ID
 			{
 				var err error
-				id, err = httpReadQueryID(req)
+				id, err = httpReadQueryID(req, lnode.config.IDSpace)
 				if err != nil {
 					httpWrite(w, http.StatusBadRequest, err.Error())
 					return
 				}
 			}
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
 			if id == nil {
-				succs, _ := lnode.SuccessorList()
+				succs, _ := lnode.SuccessorListContext(ctx)
 				buf := &bytes.Buffer{}
 				for _, succ := range succs {
-					fmt.Fprintf(buf, "%s\r\n", succ.TCPAddr())
+					fmt.Fprintf(buf, "%s\r\n", nodeRef(succ))
 				}
 				httpWrite(w, http.StatusOK, string(buf.Bytes()))
 				return
 			}
-			node, err := lnode.FindSuccessor(id)
+			mode, err := httpReadLookupMode(req, lnode.config.Lookup)
+			if err != nil {
+				httpWrite(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			hops, err := httpReadLookupHops(req)
+			if err != nil {
+				httpWrite(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			node, err := lnode.LookupSuccessor(withLookupHops(ctx, hops), id, mode)
 			if err != nil {
 				httpWrite(w, http.StatusFailedDependency, err.Error())
 				return
 			}
-			httpWrite(w, http.StatusOK, node.TCPAddr())
+			httpWrite(w, http.StatusOK, nodeRef(node))
 		}).
 		Methods(http.MethodGet)
 
 	router.
 		HandleFunc("/predecessors", func(w http.ResponseWriter, req *http.Request) {
-			id, err := httpReadQueryID(req)
+			id, err := httpReadQueryID(req, lnode.config.IDSpace)
 			if err != nil {
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
@@ -193,24 +258,27 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 				httpWrite(w, http.StatusBadRequest, "Query parameter `id` required.")
 				return
 			}
-			node, err := lnode.FindPredecessor(id)
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			node, err := lnode.FindPredecessorContext(ctx, id)
 			if err != nil {
 				httpWrite(w, http.StatusFailedDependency, err.Error())
 				return
 			}
-			httpWrite(w, http.StatusOK, node.TCPAddr())
+			httpWrite(w, http.StatusOK, nodeRef(node))
 		}).
 		Methods(http.MethodGet)
 
 	router.
 		HandleFunc("/successor", func(w http.ResponseWriter, req *http.Request) {
-			addr, err := httpReadBodyAsAddr(req)
+			succ, err := httpReadBodyAsNode(req, pool)
 			if err != nil {
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			succ := pool.getOrCreateNode(addr)
-			if err = lnode.SetSuccessor(succ); err != nil {
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			if err = lnode.SetSuccessorContext(ctx, succ); err != nil {
 				httpWrite(w, http.StatusFailedDependency, err.Error())
 				return
 			}
@@ -220,18 +288,93 @@ func NewHTTPService(laddr *net.TCPAddr) *HTTPService {
 
 	router.
 		HandleFunc("/predecessor", func(w http.ResponseWriter, req *http.Request) {
-			addr, err := httpReadBodyAsAddr(req)
+			pred, err := httpReadBodyAsNode(req, pool)
 			if err != nil {
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			pred := pool.getOrCreateNode(addr)
-			lnode.SetPredecessor(pred)
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			if err = lnode.SetPredecessorContext(ctx, pred); err != nil {
+				httpWrite(w, http.StatusFailedDependency, err.Error())
+				return
+			}
 			w.WriteHeader(http.StatusNoContent)
 		}).
 		Methods(http.MethodPut)
 
-	return &service
+	router.
+		HandleFunc("/leave", func(w http.ResponseWriter, req *http.Request) {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			if err := lnode.leave(); err != nil {
+				httpWrite(w, http.StatusFailedDependency, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}).
+		Methods(http.MethodPost)
+
+	router.
+		HandleFunc("/compact", func(w http.ResponseWriter, req *http.Request) {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			if err := lnode.compactStorage(); err != nil {
+				httpWriteAdminError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}).
+		Methods(http.MethodPost)
+
+	router.
+		HandleFunc("/snapshot", func(w http.ResponseWriter, req *http.Request) {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			buf := &bytes.Buffer{}
+			if err := lnode.writeStorageSnapshot(buf); err != nil {
+				httpWriteAdminError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf.Bytes())
+		}).
+		Methods(http.MethodGet)
+
+	router.
+		HandleFunc("/snapshot", func(w http.ResponseWriter, req *http.Request) {
+			if req.Body == nil {
+				httpWrite(w, http.StatusBadRequest, errBodyMissing.Error())
+				return
+			}
+			defer req.Body.Close()
+			if err := lnode.readStorageSnapshot(req.Body); err != nil {
+				httpWriteAdminError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}).
+		Methods(http.MethodPut)
+
+	// Exposes the storage of the local node as is, without routing keys to
+	// their owners, as required when moving keys between nodes.
+	routeStorage(router.PathPrefix("/storage").Subrouter(), lnode.config.IDSpace, lnode.Storage(), func(ctx context.Context, w http.ResponseWriter, req *http.Request, id *data.ID) data.Storage {
+		return lnode.Storage()
+	}, true)
+}
+
+// Writes error of some administrative operation to `w`, using status 501 to
+// signal that the operation is not supported by the storage of the node.
+func httpWriteAdminError(w http.ResponseWriter, err error) {
+	if err == data.ErrNotSupported {
+		httpWrite(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	httpWrite(w, http.StatusInternalServerError, err.Error())
 }
 
 func httpWrite(w http.ResponseWriter, status int, body interface{}) {
@@ -255,15 +398,12 @@ func httpReadBody(req *http.Request) (string, error) {
 	return string(arr), nil
 }
 
-func httpReadBodyAsAddr(req *http.Request) (*net.TCPAddr, error) {
+func httpReadBodyAsNode(req *http.Request, pool *nodePool) (Node, error) {
 	body, err := httpReadBody(req)
 	if err != nil {
 		return nil, err
 	}
-	if len(body) == 0 {
-		return nil, errors.New("Cannot resolve empty body into TCP address.")
-	}
-	return net.ResolveTCPAddr("tcp", body)
+	return pool.parseNode(body)
 }
 
 func httpReadBodyAsAddrs(req *http.Request) ([]*net.TCPAddr, error) {
@@ -288,12 +428,48 @@ func httpReadBodyAsAddrs(req *http.Request) ([]*net.TCPAddr, error) {
 	return addrs, nil
 }
 
-func httpReadQueryID(req *http.Request) (*data.ID, error) {
+// Derives context of given request, which is done once its client goes away
+// or any deadline sent along with the request by a remote node passes.
+func httpRequestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	if timeout, err := time.ParseDuration(req.Header.Get(httpTimeoutHeader)); err == nil {
+		return context.WithTimeout(req.Context(), timeout)
+	}
+	return context.WithCancel(req.Context())
+}
+
+// Reads lookup mode from query parameter `lookup`, if present.
+func httpReadLookupMode(req *http.Request, def LookupMode) (LookupMode, error) {
+	str := req.URL.Query().Get("lookup")
+	if len(str) == 0 {
+		return def, nil
+	}
+	mode := def
+	if err := mode.Set(str); err != nil {
+		return 0, err
+	}
+	return mode, nil
+}
+
+// Reads the number of hops a recursive lookup has made from query parameter
+// `hops`, or 0 if not present.
+func httpReadLookupHops(req *http.Request) (int, error) {
+	str := req.URL.Query().Get("hops")
+	if len(str) == 0 {
+		return 0, nil
+	}
+	hops, err := strconv.Atoi(str)
+	if err != nil || hops < 0 {
+		return 0, errors.New("Query parameter `hops` is not valid.")
+	}
+	return hops, nil
+}
+
+func httpReadQueryID(req *http.Request, space IDSpace) (*data.ID, error) {
 	strID := req.URL.Query().Get("id")
 	if len(strID) == 0 {
 		return nil, nil
 	}
-	id, ok := parseID(strID)
+	id, ok := space.parseID(strID)
 	if !ok {
 		return nil, errors.New("Query parameter `id` is not valid.")
 	}
@@ -303,12 +479,30 @@ func httpReadQueryID(req *http.Request) (*data.ID, error) {
 // Join makes this Chord HTTP service attempt to join a Chord ring available
 // via a peer node at specified TCP address. Providing an `addr` being `nil`
 // causes the service to form its own ring.
-func (service *HTTPService) Join(addr *net.TCPAddr) {
+//
+// An error is returned if the ring cannot be joined, as when its ID space is
+// not the one configured for this service.
+func (service *HTTPService) Join(addr *net.TCPAddr) error {
 	var peer Node
 	if addr != nil {
-		peer = service.pool.getOrCreateNode(addr)
+		// The peer is only used to locate this service in its ring, which is
+		// why its ID is derived from its address, even if assigned otherwise.
+		peer = service.pool.transport.Dial(service.pool.config.IDSpace.vnodeToID(addr, 0), addr, 0, service.pool)
 	}
-	service.pool.lnode.join(peer)
+	return service.pool.join(peer)
+}
+
+// Leave makes the virtual nodes of this Chord HTTP service leave their ring,
+// each handing its keys over to its successor, after which the service forms
+// its own ring.
+func (service *HTTPService) Leave() error {
+	return service.pool.leave()
+}
+
+// Close closes the storages of the HTTP service, making sure all its keys are
+// persisted. The service may not be used after being closed.
+func (service *HTTPService) Close() error {
+	return service.pool.close()
 }
 
 // Refresh causes the HTTP service to refresh its data.
@@ -319,6 +513,58 @@ func (service *HTTPService) Refresh() error {
 	return service.pool.refresh()
 }
 
+// RemoveExpired causes the HTTP service to remove any expired entries from its
+// storage.
+//
+// Expired entries are never served, but this method should be called at
+// sensible intervals in order to free the memory they occupy.
+func (service *HTTPService) RemoveExpired() {
+	for _, lnode := range service.pool.lnodes {
+		lnode.removeExpired()
+	}
+}
+
+// Compact causes the HTTP service to compact its storage, reclaiming space
+// occupied by replaced, removed and expired keys.
+//
+// data.ErrNotSupported is returned if the storage of the service cannot be
+// compacted, as when keys are only held in memory.
+func (service *HTTPService) Compact() error {
+	for _, lnode := range service.pool.lnodes {
+		if err := lnode.compactStorage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSnapshot writes a point-in-time snapshot of the storage of identified
+// virtual node of the HTTP service to `w`.
+func (service *HTTPService) WriteSnapshot(vnode int, w io.Writer) error {
+	lnode, err := service.vnode(vnode)
+	if err != nil {
+		return err
+	}
+	return lnode.writeStorageSnapshot(w)
+}
+
+// ReadSnapshot replaces all keys of the storage of identified virtual node of
+// the HTTP service with those of a snapshot written by WriteSnapshot.
+func (service *HTTPService) ReadSnapshot(vnode int, r io.Reader) error {
+	lnode, err := service.vnode(vnode)
+	if err != nil {
+		return err
+	}
+	return lnode.readStorageSnapshot(r)
+}
+
+func (service *HTTPService) vnode(vnode int) (*localNode, error) {
+	if vnode < 0 || vnode >= len(service.pool.lnodes) {
+		return nil, fmt.Errorf("Virtual node %d does not exist.", vnode)
+	}
+	return service.pool.lnodes[vnode], nil
+}
+
 func (service *HTTPService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer func() {
 		if r := recover(); r != nil {
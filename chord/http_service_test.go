@@ -0,0 +1,757 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
+
+// Starts HTTP service listening on the loopback interface, exposing it the same
+// way as the application does.
+func startHTTPService(t *testing.T, config *Config) (*HTTPService, *net.TCPAddr) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := listener.Addr().(*net.TCPAddr)
+	service, err := NewHTTPService(laddr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter().SkipClean(true)
+	router.PathPrefix("/node/").Handler(http.StripPrefix("/node", service))
+	router.PathPrefix("/storage/").Handler(http.StripPrefix("/storage", NewHTTPStorageService(service)))
+	router.PathPrefix("/kv/").Handler(http.StripPrefix("/kv", NewHTTPKVService(service)))
+	server := &http.Server{Handler: router}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+		service.Close()
+	})
+	return service, laddr
+}
+
+// Makes HTTP request, failing unless responded to with a 2xx status code.
+func httpDo(client *http.Client, method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("HTTP %s %s -> %d %s", method, url, res.StatusCode, resBody)
+	}
+	return resBody, nil
+}
+
+// Serves concurrent reads and writes of keys and node information, while the
+// services are refreshed, which is meant to be run with `go test -race`.
+func TestHTTPServiceConcurrency(t *testing.T) {
+	silenceLog(t)
+
+	var services []*HTTPService
+	var addrs []*net.TCPAddr
+	for i := 0; i < 3; i++ {
+		config := NewConfig()
+		config.VirtualNodes = 2
+		service, addr := startHTTPService(t, config)
+		var peer *net.TCPAddr
+		if i > 0 {
+			peer = addrs[0]
+		}
+		if err := service.Join(peer); err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, service)
+		addrs = append(addrs, addr)
+	}
+	for _, service := range services {
+		service.Refresh()
+	}
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for _, service := range services {
+		wg.Add(1)
+		go func(service *HTTPService) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				service.Refresh()
+				service.RemoveExpired()
+			}
+		}(service)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	written := make([]int, 8)
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				addr := addrs[(c+i)%len(addrs)]
+				url := fmt.Sprintf("http://%s/kv/key-%d-%d", addr, c, i%10)
+				value := []byte(fmt.Sprint(i))
+				if _, err := httpDo(client, http.MethodPut, url, value); err != nil {
+					t.Error(err)
+					return
+				}
+				if i < 10 {
+					written[c] = i + 1
+				}
+				if _, err := httpDo(client, http.MethodGet, url, nil); err != nil {
+					t.Error(err)
+					return
+				}
+				for _, path := range []string{"info", "1/successors", "predecessor"} {
+					url := fmt.Sprintf("http://%s/node/%s", addr, path)
+					if _, err := httpDo(client, http.MethodGet, url, nil); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(c)
+	}
+	time.Sleep(2 * time.Second)
+	close(stop)
+	wg.Wait()
+
+	for c := 0; c < 8; c++ {
+		for i := 0; i < written[c]; i++ {
+			for _, addr := range addrs {
+				url := fmt.Sprintf("http://%s/kv/key-%d-%d", addr, c, i)
+				if _, err := httpDo(client, http.MethodGet, url, nil); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}
+}
+
+// Looks up an ID via a node whose successor never responds, making sure that
+// the call to the successor is abandoned once the client gives up.
+func TestHTTPServiceCancel(t *testing.T) {
+	silenceLog(t)
+
+	abandoned := make(chan time.Time, 1)
+	succServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		abandoned <- time.Now()
+	}))
+	t.Cleanup(succServer.Close)
+
+	service, addr := startHTTPService(t, NewConfig())
+	lnode := service.pool.lnodes[0]
+	bits := lnode.ID().Bits()
+	succ := service.pool.ResolveNode(calcfingerStart(lnode.ID(), 0), succServer.Listener.Addr().(*net.TCPAddr), 0)
+	lnode.SetSuccessor(succ)
+
+	// The successor of the node precedes the ID, forcing it to be called.
+	id := calcfingerStart(lnode.ID(), bits-1)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/node/successors?id=%s", addr, id), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if res, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		res.Body.Close()
+		t.Fatalf("Lookup expected to time out, was responded to with %s", res.Status)
+	}
+	select {
+	case at := <-abandoned:
+		if elapsed := at.Sub(start); elapsed > time.Second {
+			t.Errorf("Call to successor expected to be abandoned with its client, took %v", elapsed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Call to successor expected to be abandoned with its client")
+	}
+}
+
+func TestHTTPServiceLookup(t *testing.T) {
+	silenceLog(t)
+
+	var services []*HTTPService
+	var addrs []*net.TCPAddr
+	for i := 0; i < 3; i++ {
+		service, addr := startHTTPService(t, NewConfig())
+		var peer *net.TCPAddr
+		if i > 0 {
+			peer = addrs[0]
+		}
+		if err := service.Join(peer); err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, service)
+		addrs = append(addrs, addr)
+	}
+	for i := 0; i < 3; i++ {
+		for _, service := range services {
+			service.Refresh()
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, service := range services {
+		lnode := service.pool.lnodes[0]
+		for i := 1; i <= lnode.ID().Bits(); i += 16 {
+			id := lnode.FingerStart(i)
+			expected, err := lnode.LookupSuccessor(context.Background(), id, LookupIterative)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, addr := range addrs {
+				url := fmt.Sprintf("http://%s/node/successors?id=%s&lookup=recursive", addr, id)
+				body, err := httpDo(client, http.MethodGet, url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body) != nodeRef(expected) {
+					t.Errorf("GET %s expected to yield %s, got %s", url, nodeRef(expected), body)
+				}
+			}
+		}
+	}
+
+	id := services[0].pool.lnodes[0].ID()
+	for _, query := range []string{
+		"lookup=sideways",
+		"lookup=recursive&hops=-1",
+		fmt.Sprintf("lookup=recursive&hops=%d", 2*id.Bits()),
+	} {
+		url := fmt.Sprintf("http://%s/node/successors?id=%s&%s", addrs[0], id, query)
+		if _, err := httpDo(client, http.MethodGet, url, nil); err == nil {
+			t.Errorf("GET %s expected to fail", url)
+		}
+	}
+}
+
+// Writes keys with forged versions and removal times via the public routes,
+// which are expected to be ignored.
+func TestHTTPServiceClientEntry(t *testing.T) {
+	silenceLog(t)
+
+	service, addr := startHTTPService(t, NewConfig())
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+	key := service.pool.config.IDSpace.NameToID("forged")
+	for _, url := range []string{
+		fmt.Sprintf("http://%s/storage/%s", addr, key),
+		fmt.Sprintf("http://%s/kv/forged", addr),
+	} {
+		req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader([]byte("1")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("ETag", "\"100\"")
+		req.Header.Set(httpHeaderDeleted, time.Now().UTC().Format(time.RFC3339Nano))
+		req.Header.Set(httpHeaderExpires, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		res, err = http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("GET %s expected to yield 200, got %s", url, res.Status)
+		} else if etag := res.Header.Get("ETag"); etag == "\"100\"" || etag == "\"101\"" {
+			t.Errorf("GET %s expected to ignore forged version, got ETag %s", url, etag)
+		}
+	}
+}
+
+func TestHTTPServiceClientMultipart(t *testing.T) {
+	silenceLog(t)
+
+	service, addr := startHTTPService(t, NewConfig())
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client values are stored as is, even if they look like siblings.
+	key := service.pool.config.IDSpace.NameToID("multipart")
+	url := fmt.Sprintf("http://%s/storage/%s", addr, key)
+	value := "--x\r\n\r\n1\r\n--x\r\n\r\n2\r\n--x--\r\n"
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary=x")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || string(body) != value {
+		t.Errorf("GET %s expected to yield 200 %q, got %s %q", url, value, res.Status, body)
+	}
+}
+
+// Writes entries via HTTP, which are expected to be versioned the same way as
+// when written to local storage.
+func TestHTTPServiceRemoteVersion(t *testing.T) {
+	silenceLog(t)
+
+	service, addr := startHTTPService(t, NewConfig())
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+	lnode := service.pool.lnodes[0]
+	pool, err := newNodePool(fakeAddr(1), NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := newRemoteNode(NewHTTPTransport(), lnode.ID(), addr, lnode.VNode(), pool).Storage()
+	local := data.NewMemoryStorage(160)
+	key := newID64(4, 160)
+
+	for _, storage := range []data.Storage{local, remote} {
+		if err := storage.CompareAndSetEntry(key, nil, &data.Entry{Value: []byte("1")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.CompareAndSetEntry(key, nil, &data.Entry{Value: []byte("2")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, _ := local.GetEntry(key)
+	if entry, err := lnode.storage.GetEntry(key); err != nil || entry.Version != expected.Version {
+		t.Errorf("Remote storage expected to hold version %d, held %v (%v)", expected.Version, entry, err)
+	}
+
+	// Entries set rather than compared and set are stored as is.
+	if err := remote.SetEntry(key, &data.Entry{Value: []byte("7"), Version: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := lnode.storage.GetEntry(key); err != nil || entry.Version != 7 {
+		t.Errorf("Remote storage expected to hold version 7, held %v (%v)", entry, err)
+	}
+}
+
+func TestHTTPServiceNotFound(t *testing.T) {
+	silenceLog(t)
+
+	service, addr := startHTTPService(t, NewConfig())
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+	space := service.pool.config.IDSpace
+	empty, missing := space.NameToID("empty"), space.NameToID("missing")
+	get := func(key string) (int, string) {
+		res, err := http.Get(fmt.Sprintf("http://%s/storage/%s", addr, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	// Empty values are told apart from missing ones.
+	if _, err := httpDo(http.DefaultClient, http.MethodPut, fmt.Sprintf("http://%s/storage/%s", addr, empty), nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(empty.String()); status != http.StatusOK || body != "" {
+		t.Errorf("GET of empty value expected to yield 200 with empty body, got %d %q", status, body)
+	}
+	if status, _ := get(missing.String()); status != http.StatusNotFound {
+		t.Errorf("GET of missing key expected to yield 404, got %d", status)
+	}
+	if _, err := httpDo(http.DefaultClient, http.MethodDelete, fmt.Sprintf("http://%s/storage/%s", addr, empty), nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get(empty.String()); status != http.StatusNotFound {
+		t.Errorf("GET of removed key expected to yield 404, got %d", status)
+	}
+	if status, _ := get("not-an-id"); status != http.StatusBadRequest {
+		t.Errorf("GET of invalid key expected to yield 400, got %d", status)
+	}
+
+	// Remote storage reports the same keys missing, but not other failures.
+	lnode := service.pool.lnodes[0]
+	pool, err := newNodePool(fakeAddr(1), NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := newRemoteNode(NewHTTPTransport(), lnode.ID(), addr, lnode.VNode(), pool).Storage()
+	if value, err := remote.Get(missing); err != data.ErrNotFound {
+		t.Errorf("Remote storage expected to report missing key not found, got %q %v", value, err)
+	}
+	if err := remote.Set(empty, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := remote.Get(empty); err != nil || len(value) != 0 {
+		t.Errorf("Remote storage expected to hold empty value, held %q %v", value, err)
+	}
+	transport := NewHTTPTransport()
+	transport.Retries = 0
+	failing := dialHTTPTest(t, transport, func(w http.ResponseWriter, req *http.Request) {
+		httpWrite(w, http.StatusInternalServerError, "failure")
+	})
+	if _, err := failing.Storage().Get(missing); err == nil || err == data.ErrNotFound {
+		t.Errorf("Remote storage expected to fail with other error than not found, got %v", err)
+	}
+}
+
+func TestHTTPServiceKeysRemoved(t *testing.T) {
+	silenceLog(t)
+
+	service, addr := startHTTPService(t, NewConfig())
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+	space := service.pool.config.IDSpace
+	kept, removed := space.NameToID("kept"), space.NameToID("removed")
+	for _, key := range []*data.ID{kept, removed} {
+		url := fmt.Sprintf("http://%s/storage/%s", addr, key)
+		if _, err := httpDo(http.DefaultClient, http.MethodPut, url, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	url := fmt.Sprintf("http://%s/storage/%s", addr, removed)
+	if _, err := httpDo(http.DefaultClient, http.MethodDelete, url, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed keys are hidden from clients, but still handed off between nodes.
+	vnode := service.pool.lnodes[0].VNode()
+	for url, expected := range map[string][]*data.ID{
+		fmt.Sprintf("http://%s/storage/keys", addr):                {kept},
+		fmt.Sprintf("http://%s/node/%d/storage/keys", addr, vnode): {kept, removed},
+	} {
+		body, err := httpDo(http.DefaultClient, http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := strings.Fields(string(body))
+		if len(listed) != len(expected) {
+			t.Errorf("GET %s expected to list %v, got %v", url, expected, listed)
+			continue
+		}
+		for _, key := range expected {
+			found := false
+			for _, str := range listed {
+				found = found || str == key.String()
+			}
+			if !found {
+				t.Errorf("GET %s expected to list %v, got %v", url, expected, listed)
+			}
+		}
+	}
+}
+
+// Makes a node leave via HTTP, after which it is treated as failed by peers.
+func TestHTTPServiceLeave(t *testing.T) {
+	silenceLog(t)
+
+	var services []*HTTPService
+	var addrs []*net.TCPAddr
+	for i := 0; i < 2; i++ {
+		service, addr := startHTTPService(t, NewConfig())
+		var peer *net.TCPAddr
+		if i > 0 {
+			peer = addrs[0]
+		}
+		if err := service.Join(peer); err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, service)
+		addrs = append(addrs, addr)
+	}
+	for _, service := range services {
+		service.Refresh()
+	}
+	if _, err := httpDo(http.DefaultClient, http.MethodPost, fmt.Sprintf("http://%s/node/leave", addrs[1]), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node refuses requests of peers and clients alike.
+	lnode := services[1].pool.lnodes[0]
+	rnode := newRemoteNode(NewHTTPTransport(), lnode.ID(), addrs[1], lnode.VNode(), services[0].pool)
+	peers := &failureCountingPeers{Peers: rnode.peers}
+	rnode.peers = peers
+	if _, err := rnode.Successor(); err != errNodeLeft {
+		t.Errorf("Successor expected to fail with %v, got %v", errNodeLeft, err)
+	}
+	if _, err := rnode.Storage().Get(newID64(1, 160)); err != errNodeLeft {
+		t.Errorf("Get expected to fail with %v, got %v", errNodeLeft, err)
+	}
+	if n := atomic.LoadInt32(&peers.failures); n != 2 {
+		t.Errorf("Node expected to be reported as failed twice, was reported %d times", n)
+	}
+	res, err := http.Get(fmt.Sprintf("http://%s/storage/%s", addrs[1], newID64(1, 160)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET of storage expected to yield 503, got %s", res.Status)
+	}
+
+	// The remaining node forms a ring of its own.
+	services[0].Refresh()
+	if succ := services[0].pool.lnodes[0].successor(); !succ.ID().Eq(services[0].pool.lnodes[0].ID()) {
+		t.Errorf("Successor expected to be itself, was %v", succ)
+	}
+}
+
+// Writes a key via a node not owning it, which redirects to the owner.
+func TestHTTPServiceRedirect(t *testing.T) {
+	silenceLog(t)
+
+	var services []*HTTPService
+	var addrs []*net.TCPAddr
+	for i := 0; i < 2; i++ {
+		service, addr := startHTTPService(t, NewConfig())
+		var peer *net.TCPAddr
+		if i > 0 {
+			peer = addrs[0]
+		}
+		if err := service.Join(peer); err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, service)
+		addrs = append(addrs, addr)
+	}
+	for _, service := range services {
+		service.Refresh()
+	}
+
+	// Picks a key owned by the second node.
+	var key *data.ID
+	for i := 0; key == nil; i++ {
+		id := services[0].pool.config.IDSpace.NameToID(fmt.Sprint("key-", i))
+		owner, err := services[0].pool.lnodes[0].FindSuccessor(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner.ID().Eq(services[1].pool.lnodes[0].ID()) {
+			key = id
+		}
+	}
+	url := fmt.Sprintf("http://%s/storage/%s", addrs[0], key)
+	location := fmt.Sprintf("http://%s/storage/%s", addrs[1], key)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader([]byte("1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTemporaryRedirect || res.Header.Get("Location") != location {
+		t.Errorf("PUT %s expected to redirect to %s, got %s to %s", url, location, res.Status, res.Header.Get("Location"))
+	}
+
+	// Clients following the redirect write to and read from the owner.
+	if _, err := httpDo(http.DefaultClient, http.MethodPut, url, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := httpDo(http.DefaultClient, http.MethodGet, url, nil); err != nil || string(body) != "2" {
+		t.Errorf("GET %s expected to yield 2, got %s (%v)", url, body, err)
+	}
+	value, err := services[1].pool.lnodes[0].storage.Get(key)
+	if err != nil || string(value) != "2" {
+		t.Errorf("Owner expected to hold 2, held %s (%v)", value, err)
+	}
+}
+
+// Writes keys via the public and internal storage routes, which expose the
+// same storage of the local node.
+func TestHTTPServiceSharedStorage(t *testing.T) {
+	silenceLog(t)
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.DataDir = dir
+	service, addr := startHTTPService(t, config)
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+	lnode := service.pool.lnodes[0]
+	public := fmt.Sprintf("http://%s/storage", addr)
+	internal := fmt.Sprintf("http://%s/node/%d/storage", addr, lnode.VNode())
+	for i, urls := range [][2]string{{public, internal}, {internal, public}} {
+		key := config.IDSpace.NameToID(fmt.Sprint("key-", i))
+		value := []byte(fmt.Sprint(i))
+		if _, err := httpDo(http.DefaultClient, http.MethodPut, urls[0]+"/"+key.String(), value); err != nil {
+			t.Fatal(err)
+		}
+		url := urls[1] + "/" + key.String()
+		if body, err := httpDo(http.DefaultClient, http.MethodGet, url, nil); err != nil || !bytes.Equal(body, value) {
+			t.Errorf("GET %s expected to yield %s, got %s (%v)", url, value, body, err)
+		}
+	}
+
+	// The storage is closed once, however many times the service is.
+	for i := 0; i < 2; i++ {
+		if err := service.Close(); err != nil {
+			t.Errorf("Close #%d expected to succeed, got %v", i+1, err)
+		}
+	}
+}
+
+// Writes keys whose names hold slashes and dots, which are used as given
+// whether sent as request paths or as query parameters.
+func TestHTTPServiceKVNames(t *testing.T) {
+	silenceLog(t)
+
+	var addrs []*net.TCPAddr
+	for i := 0; i < 2; i++ {
+		service, addr := startHTTPService(t, NewConfig())
+		var peer *net.TCPAddr
+		if i > 0 {
+			peer = addrs[0]
+		}
+		if err := service.Join(peer); err != nil {
+			t.Fatal(err)
+		}
+		service.Refresh()
+		addrs = append(addrs, addr)
+	}
+
+	names := []string{"a/c", "a/b/../c", "a//c", "a/./c", "a/c/", "../a", "?a#c%"}
+	for i, name := range names {
+		u := url.URL{Scheme: "http", Host: addrs[i%2].String(), Path: "/kv/" + name}
+		if _, err := httpDo(http.DefaultClient, http.MethodPut, u.String(), []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, addr := range addrs {
+		client := NewHTTPKVClient(addr)
+		for _, name := range names {
+			if value, err := client.Get(name); err != nil || string(value) != name {
+				t.Errorf("Get(%q) expected to yield %q, got %q (%v)", name, name, value, err)
+			}
+		}
+	}
+	body, err := httpDo(http.DefaultClient, http.MethodGet, fmt.Sprintf("http://%s/kv/", addrs[0]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed := strings.Count(string(body), "\n"); listed != len(names) {
+		t.Errorf("Listing expected to hold %d names, held %d: %s", len(names), listed, body)
+	}
+
+	client := NewHTTPKVClient(addrs[1])
+	if err := client.Set("a/b/../c", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.Get("a/c"); err != nil || string(value) != "a/c" {
+		t.Errorf("Get(\"a/c\") expected to be unaffected, got %q (%v)", value, err)
+	}
+	if err := client.Remove("a/b/../c"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.Get("a/b/../c"); err != data.ErrNotFound {
+		t.Errorf("Get(\"a/b/../c\") expected to fail with %v once removed, got %q (%v)", data.ErrNotFound, value, err)
+	}
+	url := fmt.Sprintf("http://%s/kv/?name=", addrs[0])
+	if _, err := httpDo(http.DefaultClient, http.MethodGet, url, nil); err == nil {
+		t.Errorf("GET %s expected to fail", url)
+	}
+}
+
+// Reads and writes keys requiring a replica that never responds, making sure
+// that the requests fail with 503 once their deadlines pass.
+func TestHTTPServiceQuorumTimeout(t *testing.T) {
+	silenceLog(t)
+
+	service, addr := startHTTPService(t, NewConfig())
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+	replica := dialHTTPTest(t, NewHTTPTransport(), func(w http.ResponseWriter, req *http.Request) {
+		// Requests are only cancelled once their bodies have been read.
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+	})
+	service.pool.lnodes[0].setSuccessorList([]Node{replica})
+
+	key := service.pool.config.IDSpace.NameToID("key")
+	url := fmt.Sprintf("http://%s/storage/%s", addr, key)
+	for _, req := range []struct {
+		method, query string
+	}{
+		{http.MethodPut, "w=2"},
+		{http.MethodGet, "r=2"},
+	} {
+		httpReq, err := http.NewRequest(req.method, url+"?"+req.query, bytes.NewReader([]byte("1")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq.Header.Set(httpTimeoutHeader, "100ms")
+		start := time.Now()
+		res, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s %s?%s expected to yield 503, got %s", req.method, url, req.query, res.Status)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s %s?%s expected to give up after about 100ms, took %v", req.method, url, req.query, elapsed)
+		}
+	}
+}
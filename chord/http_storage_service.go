@@ -2,35 +2,41 @@ package chord
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/ltu-tmmoa/chord-sky/data"
 	"github.com/ltu-tmmoa/chord-sky/log"
 	"html/template"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"runtime/debug"
-	  "os"
+	"strconv"
+	"time"
 )
 
 // HTTPStorageService manages local storage, exposing it as an HTTP service by
 // implementing the data.storage interface.
+//
+// Requests concerning keys not owned by the local Chord node are redirected to
+// the node owning them.
 type HTTPStorageService struct {
-	storage *data.MemoryStorage
-	router  *mux.Router
+	pool   *nodePool
+	router *mux.Router
 }
 
 // HTTPStorageService creates a new HTTP storage, exposable as a service on the
-// identified local TCP interface.
-func NewHTTPStorageService() *HTTPStorageService {
+// identified local TCP interface. Keys are routed using the Chord node managed
+// by given HTTP service, whose storage is used to hold any local keys.
+func NewHTTPStorageService(chordService *HTTPService) *HTTPStorageService {
 	service := HTTPStorageService{
-		storage: data.NewMemoryStorage(),
-		router:  mux.NewRouter(),
+		pool:   chordService.pool,
+		router: mux.NewRouter(),
 	}
 
-	storage := service.storage
 	router := service.router
 
 	router.
@@ -44,24 +50,63 @@ func NewHTTPStorageService() *HTTPStorageService {
 			strID := req.Form["key"][0]
 			strValue := req.Form["value"][0]
 
-			fmt.Printf("Key: %s, Value: %s", strID, strValue)
-			id, ok := parseID(strID)
+			id, ok := service.pool.config.IDSpace.parseID(strID)
 			if !ok {
 				err := errors.New("file `id` is not valid.")
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
-			} else {
-				  goPath := os.Getenv("GOPATH")
-				  absPath, _ := filepath.Abs(goPath+"/src/github.com/ltu-tmmoa/chord-sky/template/index.html")
-				t, _ := template.ParseFiles(absPath)
-				t.Execute(w, nil)
+			}
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			storage := service.resolveStorage(ctx, w, req, id)
+			if storage == nil {
+				return
 			}
 			arr := []byte(strValue)
-			storage.Set(id, arr)
+			if err := storage.SetContext(ctx, id, arr); err != nil {
+				httpWriteStorageError(w, err)
+				return
+			}
+
+			goPath := os.Getenv("GOPATH")
+			absPath, _ := filepath.Abs(goPath + "/src/github.com/ltu-tmmoa/chord-sky/template/index.html")
+			t, _ := template.ParseFiles(absPath)
+			t.Execute(w, nil)
 
 		}).
 		Methods(http.MethodPost)
 
+	routeStorage(router, service.pool.config.IDSpace, service.pool, service.resolveStorage, false)
+
+	return &service
+}
+
+// Resolves storage of some key, or writes a response to `w` and returns `nil`
+// if the request cannot be served using local storage. Any nodes called while
+// resolving the storage are given until `ctx` is done to respond.
+type storageResolver func(ctx context.Context, w http.ResponseWriter, req *http.Request, id *data.ID) data.Storage
+
+// Lists the keys held by some storage or set of storages.
+type keyLister interface {
+	// GetKeyRangeContext gets all keys that lexically located within
+	// [fromKey, toKey), unless `ctx` is done first.
+	GetKeyRangeContext(ctx context.Context, fromKey, toKey *data.ID) ([]*data.ID, error)
+
+	// GetAllKeysContext gets all keys held, unless `ctx` is done first.
+	GetAllKeysContext(ctx context.Context) ([]*data.ID, error)
+}
+
+// Registers key listing and key/value routes with given router.
+//
+// Keys of given ID space are listed using `storage`, while individual keys are
+// accessed via the storage provided by `resolve`.
+//
+// Routes are either internal, being used by other nodes to exchange entries
+// as they are held, or public, being used by clients. Public routes ignore
+// any versions, expiry times and removal times given with written entries, as
+// those are managed by the nodes, and treat written values as opaque. Internal
+// routes select how written entries are stored by the write mode header.
+func routeStorage(router *mux.Router, space IDSpace, storage keyLister, resolve storageResolver, internal bool) {
 	router.
 		HandleFunc("/keys", func(w http.ResponseWriter, req *http.Request) {
 
@@ -70,40 +115,37 @@ func NewHTTPStorageService() *HTTPStorageService {
 			}
 			strfromKey := req.URL.Query().Get("from")
 			strtoKey := req.URL.Query().Get("to")
+
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+
+			var keys []*data.ID
+			var err error
+
 			// If provided a key in the query
 			if len(strfromKey) > 0 || len(strtoKey) > 0 {
-				fromKey, ok1 := parseID(strfromKey)
-				toKey, ok2 := parseID(strtoKey)
+				fromKey, ok1 := space.parseID(strfromKey)
+				toKey, ok2 := space.parseID(strtoKey)
 				if !ok1 || !ok2 {
 					strErr := fmt.Sprintf("The `from` is %v and `to` is %v", ok1, ok2)
 					err := errors.New(strErr)
 					httpWrite(w, http.StatusBadRequest, err.Error())
 					return
 				}
-				keys, err := storage.GetKeyRange(fromKey, toKey)
-				if err != nil {
-					httpWrite(w, http.StatusInternalServerError, err.Error())
-					return
-				}
-				var buffer bytes.Buffer
-				for _, v := range keys {
-					buffer.WriteString(v.String())
-					buffer.WriteString("\n")
-				}
-				httpStorageWrite(w, http.StatusOK, buffer.String())
+				keys, err = storage.GetKeyRangeContext(ctx, fromKey, toKey)
 			} else { // else send all the local keys
-				keys, err := storage.GetAllKeys()
-				if err != nil {
-					httpWrite(w, http.StatusInternalServerError, err.Error())
-					return
-				}
-				var buffer bytes.Buffer
-				for _, v := range keys {
-					buffer.WriteString(v.String())
-					buffer.WriteString("\n")
-				}
-				httpStorageWrite(w, http.StatusOK, buffer.String())
+				keys, err = storage.GetAllKeysContext(ctx)
 			}
+			if err != nil {
+				httpWrite(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			var buffer bytes.Buffer
+			for _, v := range keys {
+				buffer.WriteString(v.String())
+				buffer.WriteString("\n")
+			}
+			httpStorageWrite(w, http.StatusOK, buffer.String())
 
 		}).
 		Methods(http.MethodGet)
@@ -115,14 +157,24 @@ func NewHTTPStorageService() *HTTPStorageService {
 				req.Body.Close()
 			}
 			strID, _ := mux.Vars(req)["id"]
-			id, ok := parseID(strID)
+			id, ok := space.parseID(strID)
 			if !ok {
 				err := errors.New("file `id` is not valid.")
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			value, _ := storage.Get(id)
-			httpStorageWrite(w, http.StatusOK, string(value))
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			storage := resolve(ctx, w, req, id)
+			if storage == nil {
+				return
+			}
+			entry, err := storage.GetEntryContext(ctx, id)
+			if err != nil {
+				httpWriteStorageError(w, err)
+				return
+			}
+			httpWriteEntry(w, entry)
 
 		}).
 		Methods(http.MethodGet)
@@ -133,19 +185,52 @@ func NewHTTPStorageService() *HTTPStorageService {
 				defer req.Body.Close()
 			}
 			strID, _ := mux.Vars(req)["id"]
-			id, ok := parseID(strID)
+			id, ok := space.parseID(strID)
 			if !ok {
 				err := errors.New("file `id` is not valid.")
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			arr, err := ioutil.ReadAll(req.Body)
+			var entry *data.Entry
+			var err error
+			if internal {
+				entry, err = httpDecodeEntry(req.Header, req.Body)
+			} else {
+				entry, err = httpDecodeClientEntry(req.Header, req.Body)
+			}
 			if err != nil {
-				err := errors.New("file `id` is not valid.")
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			storage.Set(id, arr)
+			ttl, err := httpReadTTL(req)
+			if err != nil {
+				httpWrite(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			storage := resolve(ctx, w, req, id)
+			if storage == nil {
+				return
+			}
+			if ttl > 0 {
+				entry.Expires = time.Now().Add(ttl)
+			}
+			mode := ""
+			if internal {
+				mode = req.Header.Get(httpHeaderWriteMode)
+			}
+			if pre := httpReadPrecondition(req.Header); pre != nil || mode == httpWriteModeCompare {
+				err = storage.CompareAndSetEntryContext(ctx, id, pre, entry)
+			} else if mode == httpWriteModeReplicate {
+				err = replicateEntry(ctx, storage, id, entry)
+			} else {
+				err = storage.SetEntryContext(ctx, id, entry)
+			}
+			if err != nil {
+				httpWriteStorageError(w, err)
+				return
+			}
 			httpStorageWrite(w, http.StatusOK, "")
 
 		}).
@@ -157,19 +242,168 @@ func NewHTTPStorageService() *HTTPStorageService {
 				defer req.Body.Close()
 			}
 			strID, _ := mux.Vars(req)["id"]
-			id, ok := parseID(strID)
+			id, ok := space.parseID(strID)
 			if !ok {
 				err := errors.New("file `id` is not valid.")
 				httpWrite(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			storage.Remove(id)
+			ctx, cancel := httpRequestContext(req)
+			defer cancel()
+			storage := resolve(ctx, w, req, id)
+			if storage == nil {
+				return
+			}
+			if err := storage.CompareAndRemoveContext(ctx, id, httpReadPrecondition(req.Header)); err != nil {
+				httpWriteStorageError(w, err)
+				return
+			}
 			httpStorageWrite(w, http.StatusOK, nil)
 
 		}).
 		Methods(http.MethodDelete)
+}
 
-	return &service
+// Resolves storage of the Chord node owning given ID.
+//
+// If the owner is some other node than the local one, a redirect to that node
+// is written to `w` and `nil` is returned.
+func (service *HTTPStorageService) resolveStorage(ctx context.Context, w http.ResponseWriter, req *http.Request, id *data.ID) data.Storage {
+	return httpResolveStorage(ctx, w, req, service.pool, "/storage", id)
+}
+
+// Resolves storage of the Chord node owning given ID, redirecting to the same
+// request path below `prefix` at the owning node if not a local virtual node.
+//
+// Read and write quorums may be provided as query parameters `r` and `w`, or
+// as headers, and otherwise default to those configured for the local nodes.
+//
+// The owner of the ID is looked up using `ctx`.
+func httpResolveStorage(ctx context.Context, w http.ResponseWriter, req *http.Request, pool *nodePool, prefix string, id *data.ID) data.Storage {
+	config := pool.lnodes[0].config
+	readQuorum, err := httpReadQuorum(req, "r", httpHeaderReadQuorum, config.ReadQuorum, config.Replicas)
+	if err != nil {
+		httpWrite(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	writeQuorum, err := httpReadQuorum(req, "w", httpHeaderWriteQuorum, config.WriteQuorum, config.Replicas)
+	if err != nil {
+		httpWrite(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	owner, err := pool.lnodes[0].FindSuccessorContext(ctx, id)
+	if err != nil {
+		httpWrite(w, http.StatusFailedDependency, err.Error())
+		return nil
+	}
+	lnode, ok := pool.localNode(owner)
+	if !ok {
+		url := url.URL{
+			Scheme:   "http",
+			Host:     owner.TCPAddr().String(),
+			Path:     prefix + req.URL.Path,
+			RawQuery: req.URL.RawQuery,
+		}
+		http.Redirect(w, req, url.String(), http.StatusTemporaryRedirect)
+		return nil
+	}
+	if lnode.hasLeft() {
+		httpWrite(w, http.StatusServiceUnavailable, errNodeLeft.Error())
+		return nil
+	}
+	return lnode.primaryStorage(readQuorum, writeQuorum)
+}
+
+// Reads quorum from query parameter or header, if present. The quorum must be
+// within [1, max].
+func httpReadQuorum(req *http.Request, param, header string, def, max int) (int, error) {
+	str := req.URL.Query().Get(param)
+	if len(str) == 0 {
+		str = req.Header.Get(header)
+	}
+	if len(str) == 0 {
+		return def, nil
+	}
+	quorum, err := strconv.Atoi(str)
+	if err != nil || quorum < 1 || quorum > max {
+		return 0, fmt.Errorf("Quorum `%s` is not valid; must be within [1, %d].", str, max)
+	}
+	return quorum, nil
+}
+
+// Reads `If-Match` and `If-None-Match` headers into a precondition, or
+// returns `nil` if neither is present.
+func httpReadPrecondition(header http.Header) *data.Precondition {
+	pre := &data.Precondition{
+		IfMatch:     header.Get("If-Match"),
+		IfNoneMatch: header.Get("If-None-Match"),
+	}
+	if len(pre.IfMatch) == 0 && len(pre.IfNoneMatch) == 0 {
+		return nil
+	}
+	return pre
+}
+
+func httpWritePrecondition(header http.Header, pre *data.Precondition) {
+	if pre == nil {
+		return
+	}
+	if len(pre.IfMatch) > 0 {
+		header.Set("If-Match", pre.IfMatch)
+	}
+	if len(pre.IfNoneMatch) > 0 {
+		header.Set("If-None-Match", pre.IfNoneMatch)
+	}
+}
+
+// Writes storage operation error to `w`, using status 404 to signal missing
+// keys, 503 to signal that not enough replicas could be reached before the
+// deadline of the request and 412 to signal failed preconditions.
+func httpWriteStorageError(w http.ResponseWriter, err error) {
+	if err == data.ErrNotFound {
+		httpWrite(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if _, ok := err.(*quorumError); ok || err == context.DeadlineExceeded || err == context.Canceled {
+		httpWrite(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err == data.ErrPreconditionFailed {
+		httpWrite(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	httpWrite(w, http.StatusInternalServerError, err.Error())
+}
+
+const (
+	httpHeaderKeyName     = "X-Chord-Key-Name"
+	httpHeaderReadQuorum  = "X-Chord-Read-Quorum"
+	httpHeaderWriteQuorum = "X-Chord-Write-Quorum"
+	httpHeaderWriteMode   = "X-Chord-Write-Mode"
+)
+
+// Write modes of internal storage routes, selecting what storage operation an
+// entry is written by.
+const (
+	// Stores entries as by CompareAndSetEntry, even if no precondition is
+	// given, which makes the stored entries be given new versions.
+	httpWriteModeCompare = "compare"
+
+	// Stores entries only if superseding those already held. See
+	// data.ReplicaStorage.
+	httpWriteModeReplicate = "replicate"
+)
+
+// Key names may contain arbitrary UTF-8 and are, therefore, escaped when put
+// into headers.
+func httpWriteHeaderKeyName(header http.Header, name string) {
+	if len(name) > 0 {
+		header.Set(httpHeaderKeyName, url.QueryEscape(name))
+	}
+}
+
+func httpReadHeaderKeyName(header http.Header) (string, error) {
+	return url.QueryUnescape(header.Get(httpHeaderKeyName))
 }
 
 func httpStorageWrite(w http.ResponseWriter, status int, body interface{}) {
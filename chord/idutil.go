@@ -2,23 +2,120 @@ package chord
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
 	"math/big"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/ltu-tmmoa/chord-sky/data"
 )
 
+// IDHash identifies the hash function used to derive ring IDs from key names
+// and node addresses.
+type IDHash int
+
 const (
-	idBits = sha1.Size * 8
+	// HashSHA1 derives IDs using SHA-1, as described in the Chord paper.
+	HashSHA1 IDHash = iota
+
+	// HashSHA256 derives IDs using SHA-256.
+	HashSHA256
 )
 
-func parseID(s string) (*data.ID, bool) {
-	return data.ParseID(s, idBits)
+var idHashNames = []string{"sha1", "sha256"}
+
+func (h IDHash) String() string {
+	if h < 0 || int(h) >= len(idHashNames) {
+		return fmt.Sprintf("IDHash(%d)", int(h))
+	}
+	return idHashNames[h]
+}
+
+// Set assigns hash from its name, which is either `sha1` or `sha256`, making
+// it usable as a command line flag.
+func (h *IDHash) Set(name string) error {
+	for i, n := range idHashNames {
+		if n == name {
+			*h = IDHash(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("ID hash `%s` is not valid; must be sha1 or sha256.", name)
+}
+
+// Size resolves the amount of bits produced by hash.
+func (h IDHash) Size() int {
+	return h.new().Size() * 8
+}
+
+func (h IDHash) new() hash.Hash {
+	if h == HashSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// IDSpace determines the IDs of a Chord ring, being the amount of bits of each
+// ID and the hash used to derive IDs from key names and node addresses.
+//
+// Hashes are truncated to the amount of bits of the ID space, which allows for
+// small rings to be used when testing. All nodes of a ring must use the same
+// ID space.
+type IDSpace struct {
+	Bits int
+	Hash IDHash
+}
+
+// Validate fails unless the amount of bits of ID space is within [1, N], where
+// N is the amount of bits produced by its hash.
+func (space IDSpace) Validate() error {
+	if space.Bits < 1 || space.Bits > space.Hash.Size() {
+		return fmt.Errorf("ID bits must be within [1, %d] using %s, got %d.", space.Hash.Size(), space.Hash, space.Bits)
+	}
+	return nil
+}
+
+// String produces a canonical string representation of ID space, such as
+// `sha1/160`.
+func (space IDSpace) String() string {
+	return fmt.Sprintf("%s/%d", space.Hash, space.Bits)
+}
+
+// Parses ID space string representation produced by IDSpace.String.
+func parseIDSpace(s string) (IDSpace, error) {
+	space := IDSpace{}
+	i := strings.LastIndex(s, "/")
+	if i == -1 {
+		return space, fmt.Errorf("ID space `%s` is not valid.", s)
+	}
+	if err := space.Hash.Set(s[:i]); err != nil {
+		return space, err
+	}
+	bits, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return space, fmt.Errorf("ID space `%s` is not valid.", s)
+	}
+	space.Bits = bits
+	return space, nil
+}
+
+func (space IDSpace) parseID(s string) (*data.ID, bool) {
+	return data.ParseID(s, space.Bits)
+}
+
+// Resolves ID of identified virtual node at given address.
+func (space IDSpace) vnodeToID(addr *net.TCPAddr, vnode int) *data.ID {
+	return space.NameToID(formatNodeAddr(addr, vnode))
 }
 
-func addrToID(addr *net.TCPAddr) *data.ID {
+// NameToID hashes given arbitrary key name into an ID on the Chord ring.
+func (space IDSpace) NameToID(name string) *data.ID {
+	h := space.Hash.new()
+	h.Write([]byte(name))
 	value := new(big.Int)
-	sum := sha1.Sum([]byte(addr.String()))
-	value.SetBytes(sum[:])
-	return data.NewID(value, idBits)
+	value.SetBytes(h.Sum(nil))
+	return data.NewID(value, space.Bits)
 }
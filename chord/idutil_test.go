@@ -0,0 +1,66 @@
+package chord
+
+import "testing"
+
+func TestNameToID(t *testing.T) {
+	space := NewConfig().IDSpace
+	a := space.NameToID("apple")
+	b := space.NameToID("äpple")
+
+	if a.Bits() != space.Bits {
+		t.Errorf("NameToID(apple).Bits() %d != %d", a.Bits(), space.Bits)
+	}
+	if a.Eq(b) {
+		t.Errorf("NameToID(apple) %v == NameToID(äpple) %v", a, b)
+	}
+	if !a.Eq(space.NameToID("apple")) {
+		t.Errorf("NameToID(apple) not stable")
+	}
+
+	addr := fakeAddr(1)
+	if !space.vnodeToID(addr, 0).Eq(space.NameToID(addr.String())) {
+		t.Errorf("vnodeToID(%v, 0) != NameToID(%v)", addr, addr)
+	}
+}
+
+func TestIDSpace(t *testing.T) {
+	small := IDSpace{Bits: 8, Hash: HashSHA256}
+	if id := small.NameToID("apple"); id.Bits() != 8 || id.BigInt().Int64() >= 256 {
+		t.Errorf("NameToID(apple) %v expected to be truncated to 8 bits", id)
+	}
+	if space, err := parseIDSpace(small.String()); err != nil || space != small {
+		t.Errorf("parseIDSpace(%v) %v != %v (%v)", small, space, small, err)
+	}
+	if err := (IDSpace{Bits: 161, Hash: HashSHA1}).Validate(); err == nil {
+		t.Error("ID space of 161 bits expected to be invalid using sha1")
+	}
+	if err := (IDSpace{Bits: 256, Hash: HashSHA256}).Validate(); err != nil {
+		t.Errorf("ID space of 256 bits expected to be valid using sha256, got %v", err)
+	}
+}
+
+func TestNodeRef(t *testing.T) {
+	space := NewConfig().IDSpace
+	addr := fakeAddr(1)
+	if str := formatNodeAddr(addr, 0); str != addr.String() {
+		t.Errorf("formatNodeAddr(%v, 0) %s != %v", addr, str, addr)
+	}
+	node := newRemoteNode(NewHTTPTransport(), newID64(5, space.Bits), addr, 3, nil)
+	ref := nodeRef(node)
+	id, parsedAddr, vnode, err := parseNodeRef(ref, space)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Eq(node.ID()) || parsedAddr.String() != addr.String() || vnode != 3 {
+		t.Errorf("parseNodeRef(%s) %v@%v/%d != %s", ref, id, parsedAddr, vnode, ref)
+	}
+	if id, _, _, err = parseNodeRef(formatNodeAddr(addr, 3), space); err != nil || !id.Eq(space.vnodeToID(addr, 3)) {
+		t.Errorf("parseNodeRef(%v/3) expected to derive ID %v, got %v (%v)", addr, space.vnodeToID(addr, 3), id, err)
+	}
+	if _, _, _, err = parseNodeRef(addr.String()+"/x", space); err == nil {
+		t.Errorf("parseNodeRef(%v/x) expected to fail", addr)
+	}
+	if space.vnodeToID(addr, 1).Eq(space.vnodeToID(addr, 2)) {
+		t.Errorf("vnodeToID(%v, 1) == vnodeToID(%v, 2)", addr, addr)
+	}
+}
@@ -1,48 +1,120 @@
 package chord
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ltu-tmmoa/chord-sky/data"
 )
 
 // localNode represents a potential member of a Chord ring.
+//
+// Nodes are safe for concurrent use. Their links to other nodes are guarded by
+// a mutex, which is never held while calling other nodes, as those may call
+// back into this node.
 type localNode struct {
-	addr        net.TCPAddr
-	id          data.ID
+	addr    net.TCPAddr
+	vnode   int
+	id      atomic.Value // *data.ID
+	storage data.Storage
+	config  *Config
+
+	mutex       sync.RWMutex
 	ftable      *fingerTable
 	succlist    []Node
 	predecessor Node
-	storage     data.Storage
+
+	// Serializes creating and locally storing new versions of each key,
+	// which would otherwise let concurrent writes be given equal clocks.
+	versioning keyMutex
+
+	// Set when a predecessor fails or leaves, causing this node to become
+	// owner of the keys it held as replicas of that predecessor.
+	promoting bool
+
+	// Set once this node has left its ring.
+	left bool
 }
 
 // NewLocalNode creates a new local node from given address, which ought to be
-// the application's public-facing IP address.
-func newLocalNode(addr *net.TCPAddr) *localNode {
-	return newLocalNodeID(addr, addrToID(addr))
+// the application's public-facing IP address, and the index of the node among
+// the virtual nodes hosted at that address.
+//
+// The ID of the node is the one configured for its index, if any, and is
+// otherwise derived from its address and index.
+//
+// The keys of the node are persisted in the configured data directory, if
+// any, in which case any keys persisted by a previous instance of the node are
+// loaded.
+func newLocalNode(addr *net.TCPAddr, vnode int, config *Config) (*localNode, error) {
+	storage, err := openStorage(config, vnode)
+	if err != nil {
+		return nil, err
+	}
+	id := config.IDSpace.vnodeToID(addr, vnode)
+	if vnode < len(config.IDs) {
+		id = config.IDs[vnode]
+	}
+	node := newLocalNodeStorage(addr, id, storage, config)
+	node.vnode = vnode
+	return node, nil
+}
+
+func newLocalNodeID(addr *net.TCPAddr, id *data.ID, config *Config) *localNode {
+	return newLocalNodeStorage(addr, id, data.NewMemoryStorage(config.IDSpace.Bits), config)
 }
 
-func newLocalNodeID(addr *net.TCPAddr, id *data.ID) *localNode {
+func newLocalNodeStorage(addr *net.TCPAddr, id *data.ID, storage data.Storage, config *Config) *localNode {
 	node := &localNode{
 		addr:    *addr,
-		id:      *id,
-		storage: data.NewMemoryStorage(),
+		storage: storage,
+		config:  config,
+	}
+	node.id.Store(id)
+	if config.Versioned {
+		node.storage = data.NewVersionedStorage(node.storage)
 	}
 	node.ftable = newFingerTable(node)
 	return node
 }
 
 func (node *localNode) ID() *data.ID {
-	return &node.id
+	return node.id.Load().(*data.ID)
+}
+
+// Assigns new ID to this node, which must not yet have joined a ring.
+func (node *localNode) setID(id *data.ID) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	node.id.Store(id)
+	node.ftable = newFingerTable(node)
 }
 
 func (node *localNode) TCPAddr() *net.TCPAddr {
 	return &node.addr
 }
 
+func (node *localNode) VNode() int {
+	return node.vnode
+}
+
+func (node *localNode) IDSpace() (IDSpace, error) {
+	return node.config.IDSpace, nil
+}
+
+func (node *localNode) IDSpaceContext(ctx context.Context) (IDSpace, error) {
+	return node.IDSpace()
+}
+
 func (node *localNode) FingerStart(i int) *data.ID {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
 	return node.ftable.fingerStart(i)
 }
 
@@ -50,21 +122,46 @@ func (node *localNode) FingerNode(i int) (Node, error) {
 	return node.fingerNode(i), nil
 }
 
+func (node *localNode) FingerNodeContext(ctx context.Context, i int) (Node, error) {
+	return node.FingerNode(i)
+}
+
 func (node *localNode) fingerNode(i int) Node {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
 	return node.ftable.fingerNode(i)
 }
 
 func (node *localNode) SetFingerNode(i int, fing Node) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
 	node.ftable.setFingerNode(i, fing)
 	return nil
 }
 
+func (node *localNode) SetFingerNodeContext(ctx context.Context, i int, fing Node) error {
+	return node.SetFingerNode(i, fing)
+}
+
 func (node *localNode) Successor() (Node, error) {
 	return node.FingerNode(1)
 }
 
+func (node *localNode) SuccessorContext(ctx context.Context) (Node, error) {
+	return node.Successor()
+}
+
 func (node *localNode) SuccessorList() ([]Node, error) {
-	return node.succlist, nil
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
+	return append([]Node(nil), node.succlist...), nil
+}
+
+func (node *localNode) SuccessorListContext(ctx context.Context) ([]Node, error) {
+	return node.SuccessorList()
 }
 
 func (node *localNode) successor() Node {
@@ -72,24 +169,54 @@ func (node *localNode) successor() Node {
 }
 
 func (node *localNode) Predecessor() (Node, error) {
+	return node.PredecessorContext(context.Background())
+}
+
+// PredecessorContext resolves the predecessor of this node, looking it up if
+// not known, in which case the lookup gives up once `ctx` is done.
+func (node *localNode) PredecessorContext(ctx context.Context) (Node, error) {
+	if pred := node.currentPredecessor(); pred != nil {
+		return pred, nil
+	}
+	pred, err := node.FindPredecessorContext(ctx, node.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
 	if node.predecessor == nil {
-		pred, err := node.FindPredecessor(node.ID())
-		if err != nil {
-			return nil, err
-		}
-		if node.predecessor == nil {
-			node.predecessor = pred
-		}
+		node.predecessor = pred
 	}
 	return node.predecessor, nil
 }
 
+// Resolves the predecessor of this node, or `nil` if not known.
+func (node *localNode) currentPredecessor() Node {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
+	return node.predecessor
+}
+
 func (node *localNode) FindSuccessor(id *data.ID) (Node, error) {
-	pred, err := node.FindPredecessor(id)
+	return node.FindSuccessorContext(context.Background(), id)
+}
+
+func (node *localNode) FindSuccessorContext(ctx context.Context, id *data.ID) (Node, error) {
+	return node.LookupSuccessor(ctx, id, node.config.Lookup)
+}
+
+func (node *localNode) LookupSuccessor(ctx context.Context, id *data.ID, mode LookupMode) (Node, error) {
+	if mode == LookupRecursive {
+		return node.findSuccessorRecursive(ctx, id)
+	}
+	pred, err := node.FindPredecessorContext(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	succ, err := pred.Successor()
+	succ, err := pred.SuccessorContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -97,29 +224,68 @@ func (node *localNode) FindSuccessor(id *data.ID) (Node, error) {
 }
 
 func (node *localNode) FindPredecessor(id *data.ID) (Node, error) {
+	return node.FindPredecessorContext(context.Background(), id)
+}
+
+// FindPredecessorContext walks the ring until finding the predecessor of given
+// ID, sharing the deadline of `ctx` among all nodes called along the way.
+func (node *localNode) FindPredecessorContext(ctx context.Context, id *data.ID) (Node, error) {
 	var n0 Node
 	n0 = node
 	for {
-		succ, err := n0.Successor()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		succ, err := n0.SuccessorContext(ctx)
 		if err != nil {
 			return nil, err
 		}
 		if data.IDIntervalContainsEI(n0.ID(), succ.ID(), id) {
 			return n0, nil
 		}
-		n0, err = closestPrecedingFinger(n0, id)
+		n0, err = closestPrecedingFinger(ctx, n0, id)
 		if err != nil {
 			return nil, err
 		}
 	}
 }
 
+// Finds successor of given ID by forwarding the lookup to the closest finger
+// of this node preceding the ID, unless the ID lies between this node and its
+// successor.
+//
+// Only the finger table of this node is consulted, which means that the
+// lookup makes a single call per hop rather than several. As inconsistent
+// finger tables could make the lookup go around the ring indefinitely, it
+// fails after twice as many hops as there are bits in an ID.
+func (node *localNode) findSuccessorRecursive(ctx context.Context, id *data.ID) (Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hops := lookupHops(ctx)
+	if max := 2 * node.ID().Bits(); hops >= max {
+		return nil, fmt.Errorf("Lookup of %s exceeded %d hops.", id, max)
+	}
+	succ := node.successor()
+	if data.IDIntervalContainsEI(node.ID(), succ.ID(), id) {
+		return succ, nil
+	}
+	next, err := closestPrecedingFinger(ctx, node, id)
+	if err != nil {
+		return nil, err
+	}
+	if next.ID().Eq(node.ID()) {
+		next = succ
+	}
+	return next.LookupSuccessor(withLookupHops(ctx, hops+1), id, LookupRecursive)
+}
+
 // Returns closest finger preceding ID.
 //
 // See Chord paper figure 4.
-func closestPrecedingFinger(n Node, id *data.ID) (Node, error) {
+func closestPrecedingFinger(ctx context.Context, n Node, id *data.ID) (Node, error) {
 	for i := n.ID().Bits(); i > 0; i-- {
-		f, err := n.FingerNode(i)
+		f, err := n.FingerNodeContext(ctx, i)
 		if err != nil {
 			return nil, err
 		}
@@ -131,51 +297,79 @@ func closestPrecedingFinger(n Node, id *data.ID) (Node, error) {
 }
 
 func (node *localNode) SetSuccessor(succ Node) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
 	node.ftable.setFingerNode(1, succ)
 	node.succlist = []Node{succ}
 	return nil
 }
 
-func (node *localNode) setSuccessorList(succs []Node) error {
-	nsuccs := []Node{}
-	for _, succ := range succs {
-		id := succ.ID()
-		hits := 0
-		for _, osucc := range node.succlist {
-			oid := osucc.ID()
-			if id.Eq(oid) {
-				hits++
-			}
-		}
-		if hits == 0 {
-			nsuccs = append(nsuccs, succ)
-		}
-	}
-	for _, nsucc := range nsuccs {
-		if err := node.uploadStorageTo(nsucc); err != nil {
-			return err
-		}
-	}
+func (node *localNode) SetSuccessorContext(ctx context.Context, succ Node) error {
+	return node.SetSuccessor(succ)
+}
+
+func (node *localNode) setSuccessorList(succs []Node) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
 	node.succlist = succs
-	return nil
 }
 
+// Resolves the amount of successors to keep in the successor list, which is
+// at least large enough to hold all replicas of this node's keys.
+func (node *localNode) successorListLen() int {
+	n := node.config.Replicas - 1
+	if n < 3 {
+		n = 3
+	}
+	return n
+}
+
+// SetPredecessor sets the predecessor of this node.
+//
+// If the current predecessor lies between the new predecessor and this node,
+// the current predecessor is assumed to have left and this node to have become
+// owner of its keys.
 func (node *localNode) SetPredecessor(pred Node) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	old := node.predecessor
+	if old != nil && pred != nil && data.IDIntervalContainsEE(pred.ID(), node.ID(), old.ID()) {
+		node.promoting = true
+	}
 	node.predecessor = pred
 	return nil
 }
 
+func (node *localNode) SetPredecessorContext(ctx context.Context, pred Node) error {
+	return node.SetPredecessor(pred)
+}
+
 func (node *localNode) Storage() data.Storage {
 	return node.storage
 }
 
+// Storage of this node when acting as owner of the keys it is provided,
+// causing reads and writes to involve the replicas of this node.
+//
+// Reads and writes succeed only if at least `readQuorum` and `writeQuorum`
+// replicas, respectively, respond.
+func (node *localNode) primaryStorage(readQuorum, writeQuorum int) data.Storage {
+	return newReplicatingStorage(node, readQuorum, writeQuorum)
+}
+
 func (node *localNode) disassociateNode(n Node) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
 	id := n.ID()
 	node.ftable.removeFingerNodesByID(id)
-	succlist := node.succlist
-	for i, succ := range succlist {
-		if succ.ID().Eq(id) {
-			succlist = append(node.succlist[:i], node.succlist[i+1:]...)
+	succlist := make([]Node, 0, len(node.succlist))
+	for _, succ := range node.succlist {
+		if !succ.ID().Eq(id) {
+			succlist = append(succlist, succ)
 		}
 	}
 	if len(succlist) > 0 {
@@ -184,6 +378,7 @@ func (node *localNode) disassociateNode(n Node) {
 	node.succlist = succlist
 	if node.predecessor != nil && node.predecessor.ID().Eq(id) {
 		node.predecessor = nil
+		node.promoting = true
 	}
 }
 
@@ -209,5 +404,5 @@ func (node *localNode) writeRingTextTo(w io.Writer) {
 
 // String produces canonical string representation of this node.
 func (node *localNode) String() string {
-	return fmt.Sprintf("%s@%s", node.id.String(), node.addr.String())
+	return nodeRef(node)
 }
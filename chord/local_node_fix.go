@@ -6,6 +6,26 @@ import (
 	"github.com/ltu-tmmoa/chord-sky/data"
 )
 
+// Refreshes this node by fixing its successor list, ring links and a random
+// finger, and by promoting any replicas of a former predecessor.
+//
+// Should be called periodically in order to ensure node data integrity.
+func (node *localNode) refresh() error {
+	if node.hasLeft() {
+		return nil
+	}
+	if err := node.fixSuccessorList(); err != nil {
+		return err
+	}
+	if err := node.stabilize(); err != nil {
+		return err
+	}
+	if err := node.fixRandomFinger(); err != nil {
+		return err
+	}
+	return node.promoteReplicas()
+}
+
 // Attempts to fix any ring issues arising from joining or leaving chord ring
 // nodes.
 //
@@ -17,8 +37,8 @@ func (node *localNode) stabilize() error {
 	if err != nil {
 		return err
 	}
-	if data.IDIntervalContainsEE(node.ID(), succ.ID(), x.ID()) {
-		node.SetSuccessor(succ)
+	if x != nil && data.IDIntervalContainsEE(node.ID(), succ.ID(), x.ID()) {
+		node.SetSuccessor(x)
 	}
 	succ = node.successor()
 	return node.notify(succ)
@@ -42,19 +62,24 @@ func (node *localNode) fixSuccessorList() error {
 	succs := []Node{succ}
 
 	var err error
-	for i := 1; i < 3; i++ {
+	for i := 1; i < node.successorListLen(); i++ {
 		succ, err = succ.Successor()
 		if err != nil {
 			return err
 		}
 		succs = append(succs, succ)
 	}
+	replicas := node.replicaNodes()
 	node.setSuccessorList(succs)
-	return nil
+	return node.fixReplicas(replicas)
 }
 
 func (node *localNode) fixRandomFinger() error {
-	return node.fixFinger((rand.Int() % node.ID().Bits()) + 1)
+	m := node.ID().Bits()
+	if node.config.Rand != nil {
+		return node.fixFinger(node.config.Rand.Intn(m) + 1)
+	}
+	return node.fixFinger(rand.Intn(m) + 1)
 }
 
 func (node *localNode) fixFinger(i int) error {
@@ -66,8 +91,12 @@ func (node *localNode) fixFinger(i int) error {
 }
 
 func (node *localNode) fixAllFingers() error {
-	for i := range node.ftable.fingers {
-		if err := node.fixFinger(i + 1); err != nil {
+	node.mutex.RLock()
+	n := len(node.ftable.fingers)
+	node.mutex.RUnlock()
+
+	for i := 1; i <= n; i++ {
+		if err := node.fixFinger(i); err != nil {
 			return err
 		}
 	}
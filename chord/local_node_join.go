@@ -1,6 +1,7 @@
 package chord
 
 import (
+	"fmt"
 	"math/big"
 
 	"github.com/ltu-tmmoa/chord-sky/data"
@@ -9,27 +10,39 @@ import (
 
 // Join makes this node join the ring of given other node.
 //
-// If given node is nil, this node will form its own ring.
+// If given node is nil, this node will form its own ring. Joining fails if the
+// ring of given node uses another ID space than this node.
 //
 // See Chord paper figure 6.
-func (node *localNode) join(node0 Node) {
+func (node *localNode) join(node0 Node) error {
 	if node0 != nil {
-		node.initfingerTable(node0)
+		space, err := node0.IDSpace()
+		if err != nil {
+			return err
+		}
+		if space != node.config.IDSpace {
+			return fmt.Errorf("Ring of %v uses ID space %v, while this node uses %v.", node0, space, node.config.IDSpace)
+		}
+		if err = node.initfingerTable(node0); err != nil {
+			return err
+		}
 		node.updateOthers()
-		if err := node.downloadStorageOf(node.successor()); err != nil {
-			log.Logger.Println("Failed to download storage.", err.Error())
+		if err = node.finishKeyHandoff(); err != nil {
+			log.Logger.Println("Failed to take over owned keys.", err.Error())
 		}
 	} else {
 		node.SetSuccessor(node)
 		node.SetPredecessor(node)
 	}
+	return nil
 }
 
 // Initializes finger table of local node; node0 is an arbitrary node already
 // in the network.
 //
-// Panics if failing to resolve successor or predecessor. All other operations
-// are carried out on a best-effort basis.
+// Fails if unable to resolve successor or predecessor, or to copy the keys to
+// be owned by this node. All other operations are carried out on a best-effort
+// basis.
 //
 // See Chord paper figure 6.
 func (node *localNode) initfingerTable(node0 Node) error {
@@ -47,6 +60,9 @@ func (node *localNode) initfingerTable(node0 Node) error {
 		node.SetSuccessor(succ)
 		node.SetPredecessor(pred)
 
+		if err = node.beginKeyHandoff(succ); err != nil {
+			return err
+		}
 		if err = pred.SetSuccessor(node); err != nil {
 			return err
 		}
@@ -56,7 +72,7 @@ func (node *localNode) initfingerTable(node0 Node) error {
 	}
 	// Update this node's finger table, on best-effort basis.
 	{
-		m := node.id.Bits()
+		m := node.ID().Bits()
 		for i := 1; i < m; i++ {
 			this := node.fingerNode(i)
 			nextStart := node.FingerStart(i + 1)
@@ -0,0 +1,73 @@
+package chord
+
+import (
+	"errors"
+	"io"
+
+	"github.com/ltu-tmmoa/chord-sky/log"
+)
+
+// errNodeLeft is returned by nodes that have left their ring, which their
+// peers treat as failed.
+var errNodeLeft = errors.New("Node has left its ring.")
+
+// Leave makes this node leave its ring, handing its keys and links over to
+// its neighbours.
+//
+// All keys owned by this node are first uploaded to its successor, which
+// becomes their owner. The predecessor and successor of this node are then
+// made to refer to each other, which makes the successor promote the keys
+// when next refreshed, uploading them to all its replicas. This includes the
+// node that becomes the last replica of the keys, which didn't hold them
+// before.
+//
+// This node then forms its own ring, but is marked as having left, which
+// makes it refuse any further requests of its peers. The peers stop referring
+// to this node as soon as failing to reach it. A node that has left may not
+// rejoin a ring.
+func (node *localNode) leave() error {
+	succ := node.successor()
+	if succ == nil || succ.ID().Eq(node.ID()) {
+		return nil
+	}
+	pred, err := node.Predecessor()
+	if err != nil {
+		return err
+	}
+	log.Logger.Println("Leaving ring, handing keys over to", succ, "...")
+	if err = node.uploadPrimaryStorageTo(succ); err != nil {
+		return err
+	}
+	if err = pred.SetSuccessor(succ); err != nil {
+		return err
+	}
+	if err = succ.SetPredecessor(pred); err != nil {
+		return err
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	node.ftable = newFingerTable(node)
+	node.ftable.setFingerNode(1, node)
+	node.succlist = []Node{node}
+	node.predecessor = node
+	node.left = true
+	return nil
+}
+
+// Determines whether this node has left its ring.
+func (node *localNode) hasLeft() bool {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
+	return node.left
+}
+
+// Closes the storage of this node, if required, after which it may no longer
+// be used.
+func (node *localNode) close() error {
+	if closer, ok := node.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -1,36 +1,304 @@
 package chord
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
 	"github.com/ltu-tmmoa/chord-sky/log"
 )
 
-func (node *localNode) downloadStorageOf(peer Node) error {
-	log.Logger.Println("Downloading storage from", peer, "...")
-	return transferStorage(peer, node)
+// Resolves name of the storage log file of identified virtual node, kept in
+// the configured data directory.
+func storageLogName(vnode int) string {
+	if vnode == 0 {
+		return "storage.log"
+	}
+	return fmt.Sprintf("storage.%d.log", vnode)
 }
 
-func (node *localNode) uploadStorageTo(peer Node) error {
-	log.Logger.Println("Uploading storage to", peer, "...")
-	return transferStorage(node, peer)
+// Opens storage of identified virtual node according to given configuration,
+// which is persisted in its data directory if one is configured, and otherwise
+// kept in memory.
+func openStorage(config *Config, vnode int) (data.Storage, error) {
+	if len(config.DataDir) == 0 {
+		return data.NewMemoryStorage(config.IDSpace.Bits), nil
+	}
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(config.DataDir, storageLogName(vnode))
+	log.Logger.Println("Replaying storage log", path, "...")
+	return data.OpenFileStorage(path, config.IDSpace.Bits, config.Sync)
 }
 
-func transferStorage(fromNode, toNode Node) error {
-	if fromNode.ID().Eq(toNode.ID()) {
+// Copies the keys this node is about to own, being those in (predecessor,
+// node], from its successor, which owns them until told about this node.
+//
+// This is the first of two phases of handing key ownership over to a joining
+// node. Keys are copied before any other node refers to this node, as it would
+// otherwise be handed writes to keys it is yet to receive. See
+// finishKeyHandoff.
+func (node *localNode) beginKeyHandoff(succ Node) error {
+	log.Logger.Println("Copying owned keys from", succ, "...")
+	fromKey, toKey, err := node.primaryKeyRange()
+	if err != nil {
+		return err
+	}
+	return transferKeyRange(succ.Storage(), node.storage, fromKey, toKey)
+}
+
+// Completes handing ownership of the keys in (predecessor, node] over to this
+// node, after its successor has been made to refer to it as predecessor.
+//
+// Entries written to the successor since copied are copied anew, after which
+// the keys are removed from the node no longer meant to hold them, if any.
+// Each key is only removed if not changed since last copied, which prevents
+// writes arriving at the former owner during the handoff from being lost.
+func (node *localNode) finishKeyHandoff() error {
+	succ := node.successor()
+	if succ == nil || succ.ID().Eq(node.ID()) {
+		return nil
+	}
+	holder, err := node.formerKeyHolder(succ)
+	if err != nil {
+		return err
+	}
+	fromKey, toKey, err := node.primaryKeyRange()
+	if err != nil {
+		return err
+	}
+	if holder == nil || !holder.ID().Eq(succ.ID()) {
+		if err = transferKeyRange(succ.Storage(), node.storage, fromKey, toKey); err != nil {
+			return err
+		}
+	}
+	if holder == nil {
 		return nil
 	}
-	fromStorage := fromNode.Storage()
-	toStorage := toNode.Storage()
+	log.Logger.Println("Removing owned keys from", holder, "...")
+	return moveKeyRange(holder.Storage(), node.storage, fromKey, toKey)
+}
+
+// Resolves the node holding replicas of the keys in (predecessor, node] of
+// this node before it joined, but not after, or `nil` if no such node exists.
+//
+// Before this node joined, the keys were held by its successor and the R-1
+// successors of its successor, where R is the configured amount of replicas.
+// Afterwards, they are held by this node and its R-1 successors, which leaves
+// the last of the former holders without need to hold them.
+func (node *localNode) formerKeyHolder(succ Node) (Node, error) {
+	n := node.config.Replicas - 1
+	if n <= 0 {
+		return succ, nil
+	}
+	succs, err := succ.SuccessorList()
+	if err != nil {
+		return nil, err
+	}
+	if len(succs) < n {
+		return nil, nil
+	}
+	holder := succs[n-1]
+	holders := append([]Node{node, succ}, succs[:n-1]...)
+	if holder == nil || containsNodeWithID(holders, holder.ID()) {
+		return nil, nil
+	}
+	return holder, nil
+}
 
-	keys, err := fromStorage.GetKeyRange(toNode.ID(), fromNode.ID())
+// Resolves the keys owned by this node, being those in (predecessor, node],
+// as a range [fromKey, toKey).
+//
+// Fails if the predecessor of this node is not known and cannot be found.
+func (node *localNode) primaryKeyRange() (*data.ID, *data.ID, error) {
+	pred, err := node.Predecessor()
+	if err != nil {
+		return nil, nil, err
+	}
+	return calcfingerStart(pred.ID(), 0), calcfingerStart(node.ID(), 0), nil
+}
+
+// Copies all entries within [fromKey, toKey) from one storage to another.
+//
+// Entries are only copied if superseding those already held by the receiving
+// storage, which prevents tombstones from being replaced by stale entries.
+func transferKeyRange(fromStorage, toStorage data.Storage, fromKey, toKey *data.ID) error {
+	keys, err := fromStorage.GetKeyRange(fromKey, toKey)
 	if err != nil {
 		return err
 	}
 	for _, key := range keys {
-		value, err := fromStorage.Get(key)
+		entry, err := fromStorage.GetEntry(key)
+		if err == data.ErrNotFound {
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		toStorage.Set(key, value)
+		if err = replicateEntry(context.Background(), toStorage, key, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves all entries within [fromKey, toKey) from one storage to another.
+//
+// Entries are copied as by transferKeyRange, and then removed from the sending
+// storage only if not changed since copied. Changed entries are copied again.
+func moveKeyRange(fromStorage, toStorage data.Storage, fromKey, toKey *data.ID) error {
+	keys, err := fromStorage.GetKeyRange(fromKey, toKey)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		for {
+			entry, err := fromStorage.GetEntry(key)
+			if err == data.ErrNotFound {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err = replicateEntry(context.Background(), toStorage, key, entry); err != nil {
+				return err
+			}
+			pre := &data.Precondition{IfMatch: entry.ETag()}
+			if entry.Tombstone() {
+				pre = &data.Precondition{IfNoneMatch: "*"}
+			}
+			err = fromStorage.CompareAndRemove(key, pre)
+			if err == data.ErrPreconditionFailed {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
 	}
 	return nil
 }
+
+// Resolves the nodes holding replicas of the keys owned by this node, which
+// are the first R-1 distinct nodes of the successor list, where R is the
+// configured amount of replicas.
+func (node *localNode) replicaNodes() []Node {
+	n := node.config.Replicas - 1
+	replicas := make([]Node, 0, n)
+	succlist, _ := node.SuccessorList()
+	for _, succ := range succlist {
+		if len(replicas) >= n {
+			break
+		}
+		if succ == nil || succ.ID().Eq(node.ID()) || containsNodeWithID(replicas, succ.ID()) {
+			continue
+		}
+		replicas = append(replicas, succ)
+	}
+	return replicas
+}
+
+func containsNodeWithID(nodes []Node, id *data.ID) bool {
+	for _, n := range nodes {
+		if n.ID().Eq(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Uploads owned keys to any current replicas not present in `oldReplicas`.
+func (node *localNode) fixReplicas(oldReplicas []Node) error {
+	for _, replica := range node.replicaNodes() {
+		if containsNodeWithID(oldReplicas, replica.ID()) {
+			continue
+		}
+		if err := node.uploadPrimaryStorageTo(replica); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes sure keys previously owned by a failed or departed predecessor are
+// replicated.
+//
+// As replicas are kept by the successors of a key's owner, this node already
+// holds the keys of its former predecessor. The ring routes those keys to this
+// node as soon as the predecessor is gone, which leaves only the replication
+// factor to be restored once a new predecessor is known.
+func (node *localNode) promoteReplicas() error {
+	node.mutex.RLock()
+	promoting := node.promoting && node.predecessor != nil
+	node.mutex.RUnlock()
+
+	if !promoting {
+		return nil
+	}
+	log.Logger.Println("Promoting replicas of former predecessor ...")
+	for _, replica := range node.replicaNodes() {
+		if err := node.uploadPrimaryStorageTo(replica); err != nil {
+			return err
+		}
+	}
+	node.mutex.Lock()
+	node.promoting = false
+	node.mutex.Unlock()
+	return nil
+}
+
+// Uploads all keys owned by this node, being those in (predecessor, node], to
+// given peer.
+func (node *localNode) uploadPrimaryStorageTo(peer Node) error {
+	log.Logger.Println("Uploading owned keys to replica", peer, "...")
+	fromKey, toKey, err := node.primaryKeyRange()
+	if err != nil {
+		return err
+	}
+	return transferKeyRange(node.storage, peer.Storage(), fromKey, toKey)
+}
+
+// Removes any expired entries from the storage of this node.
+func (node *localNode) removeExpired() {
+	if expiring, ok := node.storage.(data.ExpiringStorage); ok {
+		if removed := expiring.RemoveExpired(time.Now()); removed > 0 {
+			log.Logger.Println("Removed", removed, "expired entries.")
+		}
+	}
+}
+
+// Compacts the storage of this node, reclaiming space occupied by replaced,
+// removed and expired entries.
+func (node *localNode) compactStorage() error {
+	compacting, ok := node.storage.(data.CompactingStorage)
+	if !ok {
+		return data.ErrNotSupported
+	}
+	log.Logger.Println("Compacting storage ...")
+	return compacting.Compact()
+}
+
+// Writes point-in-time snapshot of the storage of this node to `w`.
+func (node *localNode) writeStorageSnapshot(w io.Writer) error {
+	snapshotting, ok := node.storage.(data.SnapshottingStorage)
+	if !ok {
+		return data.ErrNotSupported
+	}
+	return snapshotting.WriteSnapshot(w)
+}
+
+// Replaces all keys of the storage of this node with those of given snapshot.
+func (node *localNode) readStorageSnapshot(r io.Reader) error {
+	snapshotting, ok := node.storage.(data.SnapshottingStorage)
+	if !ok {
+		return data.ErrNotSupported
+	}
+	log.Logger.Println("Restoring storage snapshot ...")
+	return snapshotting.ReadSnapshot(r)
+}
@@ -1,6 +1,16 @@
 package chord
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
 
 func TestNodeJoin2(t *testing.T) {
 	nodes := prepareNodes(0, 1)
@@ -195,10 +205,456 @@ func TestNodeJoin8(t *testing.T) {
 	}
 }
 
+func TestNodeJoinIDSpace(t *testing.T) {
+	nodes := prepareNodes(0, 4)
+	nodes[1].config.IDSpace.Hash = HashSHA256
+
+	nodes[0].join(nil)
+	if err := nodes[1].join(nodes[0]); err == nil {
+		t.Error("Joining ring of other ID space expected to fail.")
+	}
+	if succ := nodes[0].successor(); !succ.ID().Eq(nodes[0].ID()) {
+		t.Errorf("{%v}.successor expected to be itself, was %v", nodes[0], succ)
+	}
+}
+
+func TestNodeReplication(t *testing.T) {
+	nodes := prepareNodes(0, 1, 3, 6)
+
+	nodes[0].join(nil)
+	nodes[1].join(nodes[0])
+	nodes[2].join(nodes[1])
+	nodes[3].join(nodes[2])
+
+	for _, node := range nodes {
+		node.fixSuccessorList()
+		node.fixAllFingers()
+	}
+
+	key := newID64(2, M3)
+	expectHolders := func(ids ...int64) {
+		for _, node := range nodes {
+			value, _ := node.storage.Get(key)
+			expected := false
+			for _, id := range ids {
+				if node.ID().Eq(newID64(id, M3)) {
+					expected = true
+				}
+			}
+			if expected && string(value) != "2" {
+				t.Errorf("{%v}.storage[%v] expected to be 2, was %s", node, key, value)
+			}
+			if !expected && len(value) != 0 {
+				t.Errorf("{%v}.storage[%v] expected to be empty, was %s", node, key, value)
+			}
+		}
+	}
+
+	// Node 3 owns key 2 and replicates it to its two successors.
+	nodes[2].primaryStorage(1, 3).Set(key, []byte("2"))
+	expectHolders(3, 6, 0)
+
+	// Node 3 fails, causing node 6 to own key 2 and replicate it anew.
+	failed := nodes[2]
+	nodes = append(nodes[:2], nodes[3])
+	for _, node := range nodes {
+		node.disassociateNode(failed)
+	}
+	nodes[2].SetPredecessor(nodes[1])
+	for _, node := range nodes {
+		node.fixSuccessorList()
+	}
+	if err := nodes[2].promoteReplicas(); err != nil {
+		t.Fatal(err)
+	}
+	expectHolders(6, 0, 1)
+}
+
+func TestNodeQuorum(t *testing.T) {
+	nodes := prepareNodes(0, 4)
+
+	nodes[0].join(nil)
+	nodes[1].join(nodes[0])
+
+	for _, node := range nodes {
+		node.fixSuccessorList()
+		node.fixAllFingers()
+	}
+
+	// Only two of three replicas exist, making a quorum of three unreachable.
+	key := newID64(3, M3)
+	if err := nodes[1].primaryStorage(1, 3).Set(key, []byte("3")); err == nil {
+		t.Error("Write quorum of 3 expected to fail.")
+	} else if _, ok := err.(*quorumError); !ok {
+		t.Errorf("Write quorum of 3 expected to fail with quorum error, got %v", err)
+	}
+	if err := nodes[1].primaryStorage(1, 2).Set(key, []byte("3")); err != nil {
+		t.Errorf("Write quorum of 2 expected to succeed, got %v", err)
+	}
+	if _, err := nodes[1].primaryStorage(3, 1).Get(key); err == nil {
+		t.Error("Read quorum of 3 expected to fail.")
+	}
+	if value, err := nodes[1].primaryStorage(2, 1).Get(key); err != nil || string(value) != "3" {
+		t.Errorf("Read quorum of 2 expected to yield 3, got %s %v", value, err)
+	}
+	if _, err := nodes[1].primaryStorage(2, 1).Get(newID64(2, M3)); err != data.ErrNotFound {
+		t.Errorf("Read of missing key expected to fail with not found, got %v", err)
+	}
+}
+
+func TestNodeReplicaFanOut(t *testing.T) {
+	silenceLog(t)
+
+	release := make(chan struct{})
+	var puts int32
+	replica := dialHTTPTest(t, NewHTTPTransport(), func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return
+		}
+		if req.Method == http.MethodGet {
+			httpWrite(w, http.StatusNotFound, "")
+			return
+		}
+		atomic.AddInt32(&puts, 1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	node := newLocalNodeID(fakeAddr(1), newID64(1, 160), NewConfig())
+	node.join(nil)
+	node.setSuccessorList([]Node{replica})
+	key := newID64(3, 160)
+
+	// A write quorum of one is reached without waiting for the replica.
+	done := make(chan error, 1)
+	go func() {
+		done <- node.primaryStorage(1, 1).Set(key, []byte("3"))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Write quorum of 1 expected to be reached without waiting for replica")
+	}
+
+	// A write quorum of two cannot be reached before the deadline passes.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := node.primaryStorage(1, 2).SetContext(ctx, key, []byte("4"))
+	if qerr, ok := err.(*quorumError); !ok || qerr.cause != context.DeadlineExceeded {
+		t.Errorf("Write quorum of 2 expected to fail due to %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// The first write reaches the replica once it responds.
+	close(release)
+	for start := time.Now(); atomic.LoadInt32(&puts) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Write expected to reach replica after quorum was reached")
+		}
+	}
+}
+
+func TestNodeReplicateStale(t *testing.T) {
+	replica := data.NewMemoryStorage(M3)
+	key := newID64(2, M3)
+	replica.SetEntry(key, &data.Entry{Value: []byte("5"), Version: 5})
+
+	// A delayed write of an earlier version leaves the later one in place.
+	if err := replicateEntry(context.Background(), replica, key, &data.Entry{Value: []byte("4"), Version: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := replica.Get(key); string(value) != "5" {
+		t.Errorf("Replica expected to hold 5, held %s", value)
+	}
+	if err := replicateEntry(context.Background(), replica, key, &data.Entry{Value: []byte("6"), Version: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := replica.Get(key); string(value) != "6" {
+		t.Errorf("Replica expected to hold 6, held %s", value)
+	}
+}
+
+// Replicates versions of a key concurrently to a replica reached via HTTP,
+// which is meant to be run with `go test -race`.
+func TestNodeReplicateConcurrently(t *testing.T) {
+	silenceLog(t)
+
+	service, addr := startHTTPService(t, NewConfig())
+	if err := service.Join(nil); err != nil {
+		t.Fatal(err)
+	}
+	lnode := service.pool.lnodes[0]
+	pool, err := newNodePool(fakeAddr(1), NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := newRemoteNode(NewHTTPTransport(), lnode.ID(), addr, lnode.VNode(), pool)
+	key := newID64(3, 160)
+
+	// The version held by the replica never decreases, whatever order the
+	// versions arrive in.
+	const writers, versions = 8, 200
+	stop := make(chan struct{})
+	regressed := make(chan uint64, 1)
+	go func() {
+		held := uint64(0)
+		for {
+			select {
+			case <-stop:
+				close(regressed)
+				return
+			default:
+			}
+			if entry, err := lnode.storage.GetEntry(key); err == nil {
+				if entry.Version < held {
+					regressed <- entry.Version
+				}
+				held = entry.Version
+			}
+		}
+	}()
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for v := versions - w; v > 0; v -= writers {
+				entry := &data.Entry{Value: []byte(fmt.Sprint(v)), Version: uint64(v)}
+				if err := replicateEntry(context.Background(), replica.Storage(), key, entry); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	if version, ok := <-regressed; ok {
+		t.Errorf("Replica expected never to regress, went back to version %d", version)
+	}
+	if entry, err := lnode.storage.GetEntry(key); err != nil || entry.Version != versions {
+		t.Errorf("Replica expected to hold version %d, held %v (%v)", versions, entry, err)
+	}
+}
+
+// Writes a versioned key concurrently without causal context, which is meant
+// to be run with `go test -race`.
+func TestNodeVersionConcurrently(t *testing.T) {
+	config := NewConfig()
+	config.IDSpace.Bits = M3
+	config.Versioned = true
+	node := newLocalNodeID(fakeAddr(0), newID64(0, M3), config)
+	node.join(nil)
+	key := newID64(2, M3)
+
+	// Each write is given a version of its own, which descends from all
+	// earlier writes coordinated by the node, leaving only the last one.
+	const writers, writes = 8, 50
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := node.primaryStorage(1, 1).Set(key, []byte(fmt.Sprint(w, i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	entry, err := node.storage.GetEntry(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.Siblings) != 0 {
+		t.Errorf("{%v}.storage[%v] expected to hold no siblings, held %v", node, key, entry.Siblings)
+	}
+	if counter := entry.Clock[node.ID().String()]; counter != writers*writes {
+		t.Errorf("{%v}.storage[%v] expected to be version %d, was %d", node, key, writers*writes, counter)
+	}
+}
+
+func TestNodeTombstone(t *testing.T) {
+	nodes := prepareNodes(0, 1, 3, 6)
+
+	nodes[0].join(nil)
+	nodes[1].join(nodes[0])
+	nodes[2].join(nodes[1])
+	nodes[3].join(nodes[2])
+
+	for _, node := range nodes {
+		node.fixSuccessorList()
+		node.fixAllFingers()
+	}
+
+	// Node 3 owns key 2, replicating it to nodes 6 and 0.
+	key := newID64(2, M3)
+	primary := nodes[2].primaryStorage(1, 3)
+	primary.Set(key, []byte("2"))
+	stale, _ := nodes[3].storage.GetEntry(key)
+	if err := primary.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.Get(key); err != data.ErrNotFound {
+		t.Errorf("Removed key expected to be not found, got %v", err)
+	}
+
+	// Node 6 misses the removal, and then uploads its keys to node 3.
+	nodes[3].storage.SetEntry(key, stale)
+	if err := transferKeyRange(nodes[3].storage, nodes[2].storage, key, calcfingerStart(key, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.Get(key); err != data.ErrNotFound {
+		t.Errorf("Removed key expected to stay removed after transfer, got %v", err)
+	}
+
+	// Tombstones are removed once their grace period has passed.
+	grace := nodes[2].config.TombstoneGrace
+	nodes[2].storage.(data.ExpiringStorage).RemoveExpired(time.Now().Add(grace + time.Second))
+	if keys, _ := nodes[2].storage.GetAllKeys(); len(keys) != 0 {
+		t.Errorf("{%v}.storage expected to be empty, held %v", nodes[2], keys)
+	}
+}
+
+func TestNodeTransferExpiry(t *testing.T) {
+	nodes := prepareNodes(0, 4)
+
+	// Key 2 is handed over from node 0 to node 4, and expires an hour from now.
+	key := newID64(2, M3)
+	expires := time.Now().Add(time.Hour)
+	nodes[0].join(nil)
+	nodes[0].storage.SetEntry(key, &data.Entry{Value: []byte("2"), Expires: expires})
+	nodes[1].join(nodes[0])
+
+	entry, _ := nodes[1].storage.GetEntry(key)
+	if entry == nil || !entry.Expires.Equal(expires) {
+		t.Errorf("{%v}.storage[%v] expected to expire at %v, was %v", nodes[1], key, expires, entry)
+	}
+}
+
+func TestNodeJoinHandoff(t *testing.T) {
+	nodes := prepareNodes(0, 4)
+	for _, node := range nodes {
+		node.config.Replicas = 1
+	}
+
+	nodes[0].join(nil)
+	nodes[0].storage.Set(newID64(2, M3), []byte("2"))
+	nodes[0].storage.Set(newID64(3, M3), []byte("3"))
+	nodes[0].storage.Set(newID64(6, M3), []byte("6"))
+
+	// Key 3 is written to node 0 after being copied to joining node 4.
+	if err := nodes[1].initfingerTable(nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].storage.CompareAndSetEntry(newID64(3, M3), nil, &data.Entry{Value: []byte("4")})
+	if err := nodes[1].finishKeyHandoff(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectKeys := func(node *localNode, values ...string) {
+		keys, _ := node.storage.GetAllKeys()
+		if len(keys) != len(values) {
+			t.Errorf("{%v}.storage expected to hold %v, held %v", node, values, keys)
+			return
+		}
+		for i, key := range keys {
+			if value, _ := node.storage.Get(key); string(value) != values[i] {
+				t.Errorf("{%v}.storage[%v] expected to be %s, was %s", node, key, values[i], value)
+			}
+		}
+	}
+	expectKeys(nodes[0], "6")
+	expectKeys(nodes[1], "2", "4")
+}
+
+func TestNodeLeave(t *testing.T) {
+	nodes := prepareNodes(0, 1, 3, 6)
+
+	nodes[0].join(nil)
+	nodes[1].join(nodes[0])
+	nodes[2].join(nodes[1])
+	nodes[3].join(nodes[2])
+
+	for _, node := range nodes {
+		node.fixSuccessorList()
+		node.fixAllFingers()
+	}
+
+	// Node 3 owns key 2, and hands it over to node 6 when leaving.
+	key := newID64(2, M3)
+	nodes[2].storage.Set(key, []byte("2"))
+	if err := nodes[2].leave(); err != nil {
+		t.Fatal(err)
+	}
+	if succ := nodes[1].successor(); !succ.ID().Eq(nodes[3].ID()) {
+		t.Errorf("{%v}.successor expected to be %v, was %v", nodes[1], nodes[3], succ)
+	}
+	if pred := nodes[3].predecessor; !pred.ID().Eq(nodes[1].ID()) {
+		t.Errorf("{%v}.predecessor expected to be %v, was %v", nodes[3], nodes[1], pred)
+	}
+	if value, _ := nodes[3].storage.Get(key); string(value) != "2" {
+		t.Errorf("{%v}.storage[%v] expected to be 2, was %s", nodes[3], key, value)
+	}
+	if succ := nodes[2].successor(); !succ.ID().Eq(nodes[2].ID()) {
+		t.Errorf("{%v}.successor expected to be itself, was %v", nodes[2], succ)
+	}
+	if !nodes[2].hasLeft() {
+		t.Errorf("{%v} expected to have left", nodes[2])
+	}
+
+	// Node 6 then replicates key 2 to nodes 0 and 1, the latter of which
+	// only became a replica of the key as node 3 left.
+	if err := nodes[3].refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes[:2] {
+		if value, _ := node.storage.Get(key); string(value) != "2" {
+			t.Errorf("{%v}.storage[%v] expected to be 2, was %s", node, key, value)
+		}
+	}
+}
+
+// Node referred to by a stale entry, claiming an ID other than that of the
+// local node it resolves to.
+type staleNode struct {
+	*localNode
+	id *data.ID
+}
+
+func (node staleNode) ID() *data.ID {
+	return node.id
+}
+
+func TestNodeLookupHops(t *testing.T) {
+	node := prepareNodes(0)[0]
+
+	// Node 0 refers to itself as node 4, and so keeps forwarding lookups of
+	// IDs beyond 4 to itself.
+	stale := staleNode{node, newID64(4, M3)}
+	node.SetSuccessor(stale)
+	for i := 2; i <= M3; i++ {
+		node.ftable.setFingerNode(i, stale)
+	}
+	if succ, err := node.LookupSuccessor(context.Background(), newID64(6, M3), LookupRecursive); err == nil {
+		t.Errorf("Recursive lookup expected to fail after too many hops, yielded %v", succ)
+	}
+	succ, err := node.LookupSuccessor(context.Background(), newID64(2, M3), LookupRecursive)
+	if err != nil || !succ.ID().Eq(stale.ID()) {
+		t.Errorf("Recursive lookup of 2 expected to yield 4, yielded %v (%v)", succ, err)
+	}
+}
+
 func prepareNodes(ids ...int64) []*localNode {
 	nodes := make([]*localNode, len(ids))
 	for i, s := range ids {
-		nodes[i] = newLocalNodeID(fakeAddr(byte(s)), newID64(s, M3))
+		config := NewConfig()
+		config.IDSpace.Bits = M3
+		nodes[i] = newLocalNodeID(fakeAddr(byte(s)), newID64(s, M3), config)
 	}
 	return nodes
 }
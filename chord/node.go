@@ -1,7 +1,12 @@
 package chord
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/ltu-tmmoa/chord-sky/data"
 )
@@ -11,9 +16,20 @@ type Node interface {
 	// ID returns node ID.
 	ID() *data.ID
 
+	// IDSpace provides the ID space of the node's ring.
+	IDSpace() (IDSpace, error)
+
+	// IDSpaceContext is like IDSpace, but fails if `ctx` is done before the
+	// ID space is resolved.
+	IDSpaceContext(ctx context.Context) (IDSpace, error)
+
 	// TCPAddr provides node network address.
 	TCPAddr() *net.TCPAddr
 
+	// VNode provides index of node among the virtual nodes hosted at its
+	// network address.
+	VNode() int
+
 	// fingerStart resolves start ID of finger table entry i.
 	//
 	// The result is only defined for i in [1,M], where M is the amount of bits
@@ -26,36 +42,189 @@ type Node interface {
 	// set at node ring creation.
 	FingerNode(i int) (Node, error)
 
+	// FingerNodeContext is like FingerNode, but fails if `ctx` is done before
+	// the finger is resolved.
+	FingerNodeContext(ctx context.Context, i int) (Node, error)
+
 	// SetFingerNode attempts to set this node's ith finger to given node.
 	//
 	// The operation is only valid for i in [1,M], where M is the amount of
 	// bits set at node ring creation.
 	SetFingerNode(i int, fing Node) error
 
+	// SetFingerNodeContext is like SetFingerNode, but fails if `ctx` is done
+	// before the finger is set.
+	SetFingerNodeContext(ctx context.Context, i int, fing Node) error
+
 	// Successor yields the next node in this node's ring.
 	Successor() (Node, error)
 
+	// SuccessorContext is like Successor, but fails if `ctx` is done before
+	// the successor is resolved.
+	SuccessorContext(ctx context.Context) (Node, error)
+
 	// SuccessorList yields a list of nodes succeeding the current one.
 	SuccessorList() ([]Node, error)
 
+	// SuccessorListContext is like SuccessorList, but fails if `ctx` is done
+	// before the list is resolved.
+	SuccessorListContext(ctx context.Context) ([]Node, error)
+
 	// Predecessor yields the previous node in this node's ring.
 	Predecessor() (Node, error)
 
+	// PredecessorContext is like Predecessor, but fails if `ctx` is done
+	// before the predecessor is resolved.
+	PredecessorContext(ctx context.Context) (Node, error)
+
 	// FindSuccessor asks this node to find successor of given ID.
 	FindSuccessor(id *data.ID) (Node, error)
 
+	// FindSuccessorContext is like FindSuccessor, but gives up once `ctx` is
+	// done, including on any nodes asked on behalf of this node.
+	FindSuccessorContext(ctx context.Context, id *data.ID) (Node, error)
+
+	// LookupSuccessor is like FindSuccessorContext, but makes this node find
+	// the successor using given lookup mode rather than its default one.
+	LookupSuccessor(ctx context.Context, id *data.ID, mode LookupMode) (Node, error)
+
 	// FindPredecessor asks this node to find a predecessor of given ID.
 	FindPredecessor(id *data.ID) (Node, error)
 
+	// FindPredecessorContext is like FindPredecessor, but gives up once `ctx`
+	// is done, including on any nodes asked on behalf of this node.
+	FindPredecessorContext(ctx context.Context, id *data.ID) (Node, error)
+
 	// SetSuccessor attempts to set this node's successors to given node.
 	SetSuccessor(succ Node) error
 
+	// SetSuccessorContext is like SetSuccessor, but fails if `ctx` is done
+	// before the successor is set.
+	SetSuccessorContext(ctx context.Context, succ Node) error
+
 	// SetPredecessor attempts to set this node's predecessor to given node.
 	SetPredecessor(pred Node) error
 
+	// SetPredecessorContext is like SetPredecessor, but fails if `ctx` is
+	// done before the predecessor is set.
+	SetPredecessorContext(ctx context.Context, pred Node) error
+
 	// Storage exposes the data held by the node.
 	Storage() data.Storage
 
 	// String turns Node into its canonical string representation.
 	String() string
 }
+
+// LookupMode determines how the successor of an ID is found, with the nodes
+// along the way between the asking node and the successor being called either
+// by the asking node or by each other.
+type LookupMode int
+
+const (
+	// LookupIterative makes the asking node call each node along the way,
+	// asking for its successor and fingers.
+	LookupIterative LookupMode = iota
+
+	// LookupRecursive makes the asking node forward the lookup to its closest
+	// finger preceding the ID, which forwards it in turn, until reaching the
+	// predecessor of the ID.
+	LookupRecursive
+)
+
+var lookupModeNames = []string{"iterative", "recursive"}
+
+func (mode LookupMode) String() string {
+	if mode < 0 || int(mode) >= len(lookupModeNames) {
+		return fmt.Sprintf("LookupMode(%d)", int(mode))
+	}
+	return lookupModeNames[mode]
+}
+
+// Set assigns lookup mode from its name, which is either `iterative` or
+// `recursive`, making it usable as a command line flag.
+func (mode *LookupMode) Set(name string) error {
+	for i, n := range lookupModeNames {
+		if n == name {
+			*mode = LookupMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Lookup mode `%s` is not valid; must be iterative or recursive.", name)
+}
+
+// Key of the context value counting the hops made by a recursive lookup.
+type lookupHopsKey struct{}
+
+// Derives context recording that a recursive lookup has made given number of
+// hops.
+func withLookupHops(ctx context.Context, hops int) context.Context {
+	return context.WithValue(ctx, lookupHopsKey{}, hops)
+}
+
+// Resolves the number of hops recorded by withLookupHops, or 0 if none.
+func lookupHops(ctx context.Context) int {
+	hops, _ := ctx.Value(lookupHopsKey{}).(int)
+	return hops
+}
+
+// Produces reference to node, identifying it among all nodes of its ring.
+//
+// The reference consists of the ID of the node, followed by `@` and the node
+// address produced by formatNodeAddr. As IDs may be assigned explicitly, they
+// cannot always be derived from node addresses.
+func nodeRef(node Node) string {
+	return formatNodeRef(node.ID(), node.TCPAddr(), node.VNode())
+}
+
+// Formats reference of identified node, as produced by nodeRef.
+func formatNodeRef(id *data.ID, addr *net.TCPAddr, vnode int) string {
+	return fmt.Sprintf("%s@%s", id.String(), formatNodeAddr(addr, vnode))
+}
+
+// Formats address of identified virtual node at given network address.
+//
+// The address consists of the network address followed by a slash and the
+// index of the virtual node, unless being 0, which makes the address of the
+// first virtual node of a process equal to its network address.
+func formatNodeAddr(addr *net.TCPAddr, vnode int) string {
+	if vnode == 0 {
+		return addr.String()
+	}
+	return fmt.Sprintf("%s/%d", addr.String(), vnode)
+}
+
+// Parses node reference produced by nodeRef, with IDs of given ID space.
+//
+// References without IDs are accepted, in which case the ID is derived from
+// the node address.
+func parseNodeRef(ref string, space IDSpace) (*data.ID, *net.TCPAddr, int, error) {
+	var id *data.ID
+	if i := strings.Index(ref, "@"); i != -1 {
+		var ok bool
+		if id, ok = space.parseID(ref[:i]); !ok {
+			return nil, nil, 0, fmt.Errorf("Node reference `%s` is not valid.", ref)
+		}
+		ref = ref[i+1:]
+	}
+	vnode := 0
+	if i := strings.LastIndex(ref, "/"); i != -1 {
+		var err error
+		vnode, err = strconv.Atoi(ref[i+1:])
+		if err != nil || vnode < 0 {
+			return nil, nil, 0, fmt.Errorf("Node reference `%s` is not valid.", ref)
+		}
+		ref = ref[:i]
+	}
+	if len(ref) == 0 {
+		return nil, nil, 0, errors.New("Cannot resolve empty node reference.")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", ref)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if id == nil {
+		id = space.vnodeToID(addr, vnode)
+	}
+	return id, addr, vnode, nil
+}
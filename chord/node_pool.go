@@ -1,60 +1,306 @@
 package chord
 
-import "net"
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
 
-// Holds a single local node and a set of remote nodes, allowing management of
-// remote node lifetimes.
+	"github.com/ltu-tmmoa/chord-sky/data"
+	"github.com/ltu-tmmoa/chord-sky/log"
+)
+
+// Holds the local virtual nodes of a process and a set of remote nodes,
+// allowing management of remote node lifetimes.
+//
+// Pools are safe for concurrent use. The set of local nodes never changes
+// after pool creation, while the set of remote nodes is guarded by a mutex.
 type nodePool struct {
-	lnode *localNode
+	lnodes    []*localNode
+	config    *Config
+	transport Transport
+	detector  *failureDetector
+
+	mutex sync.Mutex
 	nodes map[string]Node
 }
 
-func newNodePool(laddr *net.TCPAddr) *nodePool {
-	lnode := newLocalNode(laddr)
-	return &nodePool{
-		lnode: lnode,
-		nodes: map[string]Node{
-			laddr.String(): lnode,
-		},
+// Creates pool of the configured amount of local virtual nodes, all sharing
+// given address.
+func newNodePool(laddr *net.TCPAddr, config *Config) (*nodePool, error) {
+	n := config.VirtualNodes
+	if n < 1 {
+		n = 1
+	}
+	pool := &nodePool{
+		lnodes:    make([]*localNode, 0, n),
+		nodes:     map[string]Node{},
+		config:    config,
+		transport: config.Transport,
+		detector:  newFailureDetector(config.FailureDetector),
 	}
+	if pool.transport == nil {
+		pool.transport = NewHTTPTransport()
+	}
+	for vnode := 0; vnode < n; vnode++ {
+		lnode, err := newLocalNode(laddr, vnode, config)
+		if err != nil {
+			pool.close()
+			return nil, err
+		}
+		pool.lnodes = append(pool.lnodes, lnode)
+		pool.nodes[nodeRef(lnode)] = lnode
+	}
+	return pool, nil
 }
 
-func (pool *nodePool) getOrCreateNode(addr *net.TCPAddr) Node {
-	key := addr.String()
-	if node, ok := pool.nodes[key]; ok && node != nil {
-		return node
+// Resolves identified node, dialing it using the transport of the pool unless
+// already known.
+func (pool *nodePool) getOrCreateNode(id *data.ID, addr *net.TCPAddr, vnode int) Node {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	key := formatNodeRef(id, addr, vnode)
+	if n, ok := pool.nodes[key]; ok && n != nil {
+		return n
 	}
-	node := newRemoteNode(addr, pool)
+	node := pool.transport.Dial(id, addr, vnode, pool)
 	pool.nodes[key] = node
+	pool.detector.track(key, pool.now())
 	return node
 }
 
+// Resolves node of given reference, produced by nodeRef.
+func (pool *nodePool) parseNode(ref string) (Node, error) {
+	id, addr, vnode, err := parseNodeRef(ref, pool.config.IDSpace)
+	if err != nil {
+		return nil, err
+	}
+	return pool.getOrCreateNode(id, addr, vnode), nil
+}
+
+// IDSpace provides the configured ID space of the pool.
+func (pool *nodePool) IDSpace() IDSpace {
+	return pool.config.IDSpace
+}
+
+// ResolveNode resolves identified node, dialing it unless already known.
+func (pool *nodePool) ResolveNode(id *data.ID, addr *net.TCPAddr, vnode int) Node {
+	return pool.getOrCreateNode(id, addr, vnode)
+}
+
+// NodeResponded records that given remote node responded, lowering its
+// suspicion level.
+func (pool *nodePool) NodeResponded(node Node) {
+	pool.detector.responded(nodeRef(node), pool.now())
+}
+
+// NodeFailed records that given remote node failed to respond due to given
+// error, removing it from the pool if its suspicion level has reached the
+// configured threshold.
+func (pool *nodePool) NodeFailed(node Node, err error) {
+	phi := pool.detector.failed(nodeRef(node), pool.now())
+	if phi < pool.config.FailureDetector.Threshold {
+		log.Logger.Printf("Node %s failed to respond (phi %.2f): %s", node.String(), phi, err.Error())
+		return
+	}
+	pool.removeNode(node)
+	log.Logger.Printf("Node %s disconnected (phi %.2f): %s", node.String(), phi, err.Error())
+}
+
+// Resolves the current time, as provided by the configured clock.
+func (pool *nodePool) now() time.Time {
+	if pool.config.Clock != nil {
+		return pool.config.Clock()
+	}
+	return time.Now()
+}
+
+// Resolves local virtual node with the same ID as given node, if any.
+func (pool *nodePool) localNode(node Node) (*localNode, bool) {
+	for _, lnode := range pool.lnodes {
+		if lnode.ID().Eq(node.ID()) {
+			return lnode, true
+		}
+	}
+	return nil, false
+}
+
 func (pool *nodePool) removeNode(node Node) {
-	key := node.TCPAddr().String()
-	if node, ok := pool.nodes[key]; ok && node != pool.lnode {
-		pool.lnode.disassociateNode(node)
-		delete(pool.nodes, key)
+	key := nodeRef(node)
+
+	pool.mutex.Lock()
+	node, ok := pool.nodes[key]
+	if _, isLocal := node.(*localNode); !ok || isLocal {
+		pool.mutex.Unlock()
+		return
+	}
+	delete(pool.nodes, key)
+	pool.detector.forget(key)
+	pool.mutex.Unlock()
+
+	for _, lnode := range pool.lnodes {
+		lnode.disassociateNode(node)
+	}
+}
+
+// Makes all local virtual nodes join the ring of given node. The first
+// virtual node joins via given node, while the others join via the first.
+//
+// If given node is nil, the virtual nodes form their own ring. If balancing is
+// enabled, virtual nodes without configured IDs are given new IDs before
+// joining. See balancedID.
+func (pool *nodePool) join(node0 Node) error {
+	for vnode, lnode := range pool.lnodes {
+		via := node0
+		if vnode > 0 {
+			via = pool.lnodes[0]
+		}
+		if via != nil && pool.config.Balance && vnode >= len(pool.config.IDs) {
+			id, err := balancedID(via, lnode.ID())
+			if err != nil {
+				return err
+			}
+			pool.setLocalNodeID(lnode, id)
+		}
+		if err := lnode.join(via); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// Assigns new ID to given local node, which must not yet have joined a ring.
+func (pool *nodePool) setLocalNodeID(lnode *localNode, id *data.ID) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	delete(pool.nodes, nodeRef(lnode))
+	lnode.setID(id)
+	pool.nodes[nodeRef(lnode)] = lnode
+}
+
+// Makes all local virtual nodes leave their ring.
+func (pool *nodePool) leave() error {
+	for _, lnode := range pool.lnodes {
+		if err := lnode.leave(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Closes the storages of all local virtual nodes.
+func (pool *nodePool) close() error {
+	var firstErr error
+	for _, lnode := range pool.lnodes {
+		if err := lnode.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Refreshes all local virtual nodes, returning the first error encountered,
+// if any.
 func (pool *nodePool) refresh() error {
 	defer func() {
-		for _, node := range pool.nodes {
-			rnode, ok := node.(*remoteNode)
-			if ok {
-				rnode.Heartbeat()
-			}
+		for _, rnode := range pool.remoteNodes() {
+			rnode.Heartbeat()
 		}
 	}()
 
-	if err := pool.lnode.fixSuccessorList(); err != nil {
-		return err
+	var firstErr error
+	for _, lnode := range pool.lnodes {
+		if err := lnode.refresh(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Resolves all remote nodes of the pool, ordered by reference, which makes
+// refreshes reproducible.
+func (pool *nodePool) remoteNodes() []RemoteNode {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	refs := make([]string, 0, len(pool.nodes))
+	for ref := range pool.nodes {
+		refs = append(refs, ref)
 	}
-	if err := pool.lnode.stabilize(); err != nil {
-		return err
+	sort.Strings(refs)
+	rnodes := make([]RemoteNode, 0, len(refs))
+	for _, ref := range refs {
+		if rnode, ok := pool.nodes[ref].(RemoteNode); ok {
+			rnodes = append(rnodes, rnode)
+		}
 	}
-	if err := pool.lnode.fixRandomFinger(); err != nil {
-		return err
+	return rnodes
+}
+
+// GetKeyRange gets all keys within [fromKey, toKey) held by the storages of
+// all local virtual nodes, in ring order starting at `fromKey`. Removed keys
+// are left out, even if their tombstones are still held.
+func (pool *nodePool) GetKeyRange(fromKey, toKey *data.ID) ([]*data.ID, error) {
+	return pool.GetKeyRangeContext(context.Background(), fromKey, toKey)
+}
+
+// GetKeyRangeContext is like GetKeyRange, but fails if `ctx` is done before
+// the keys of all storages are got.
+func (pool *nodePool) GetKeyRangeContext(ctx context.Context, fromKey, toKey *data.ID) ([]*data.ID, error) {
+	return pool.mergeKeys(fromKey, func(storage data.LiveKeyStorage) ([]*data.ID, error) {
+		return storage.GetLiveKeyRangeContext(ctx, fromKey, toKey)
+	})
+}
+
+// GetAllKeys gets all keys held by the storages of all local virtual nodes,
+// in ascending order. Removed keys are left out, even if their tombstones are
+// still held.
+func (pool *nodePool) GetAllKeys() ([]*data.ID, error) {
+	return pool.GetAllKeysContext(context.Background())
+}
+
+// GetAllKeysContext is like GetAllKeys, but fails if `ctx` is done before the
+// keys of all storages are got.
+func (pool *nodePool) GetAllKeysContext(ctx context.Context) ([]*data.ID, error) {
+	return pool.mergeKeys(nil, func(storage data.LiveKeyStorage) ([]*data.ID, error) {
+		return storage.GetAllLiveKeysContext(ctx)
+	})
+}
+
+// Merges keys listed by `list` for the storage of each local virtual node,
+// ordering them by their distance from `fromKey`, or ascending if `nil`.
+//
+// The storages are listed as LiveKeyStorage, leaving out keys whose entries
+// are tombstones, as those are only held until their removal has been handed
+// off to other nodes. ErrNotSupported is returned if some storage is not a
+// LiveKeyStorage.
+func (pool *nodePool) mergeKeys(fromKey *data.ID, list func(storage data.LiveKeyStorage) ([]*data.ID, error)) ([]*data.ID, error) {
+	seen := map[string]bool{}
+	keys := []*data.ID{}
+	for _, lnode := range pool.lnodes {
+		storage, ok := lnode.storage.(data.LiveKeyStorage)
+		if !ok {
+			return nil, data.ErrNotSupported
+		}
+		lkeys, err := list(storage)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range lkeys {
+			if str := key.String(); !seen[str] {
+				seen[str] = true
+				keys = append(keys, key)
+			}
+		}
 	}
-	return nil
+	sort.Slice(keys, func(i, j int) bool {
+		if fromKey == nil {
+			return keys[i].Cmp(keys[j]) < 0
+		}
+		return keys[i].Diff(fromKey).Cmp(keys[j].Diff(fromKey)) < 0
+	})
+	return keys, nil
 }
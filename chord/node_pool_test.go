@@ -0,0 +1,121 @@
+package chord
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
+
+func TestNodePoolVirtualNodes(t *testing.T) {
+	config := NewConfig()
+	config.VirtualNodes = 4
+	pool, err := newNodePool(fakeAddr(1), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.join(nil)
+	for _, lnode := range pool.lnodes {
+		lnode.fixSuccessorList()
+		lnode.fixAllFingers()
+	}
+
+	if node := pool.getOrCreateNode(pool.lnodes[2].ID(), fakeAddr(1), 2); node != pool.lnodes[2] {
+		t.Errorf("Node %v/2 expected to be local, was %v", fakeAddr(1), node)
+	}
+
+	// The virtual nodes form a ring ordered by their IDs.
+	lnodes := append([]*localNode{}, pool.lnodes...)
+	sort.Slice(lnodes, func(i, j int) bool {
+		return lnodes[i].ID().Cmp(lnodes[j].ID()) < 0
+	})
+	for i, lnode := range lnodes {
+		succ := lnodes[(i+1)%len(lnodes)]
+		if !lnode.successor().ID().Eq(succ.ID()) {
+			t.Errorf("{%v}.successor expected to be %v, was %v", lnode, succ, lnode.successor())
+		}
+		if !succ.predecessor.ID().Eq(lnode.ID()) {
+			t.Errorf("{%v}.predecessor expected to be %v, was %v", succ, lnode, succ.predecessor)
+		}
+	}
+}
+
+func TestNodePoolKeysRemoved(t *testing.T) {
+	config := NewConfig()
+	config.VirtualNodes = 2
+	pool, err := newNodePool(fakeAddr(1), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are listed if held by any virtual node, whether or not some other
+	// virtual node holds their tombstones.
+	first, second := newID64(1, 160), newID64(2, 160)
+	tombstone := &data.Entry{Deleted: time.Now()}
+	pool.lnodes[0].storage.SetEntry(first, tombstone)
+	pool.lnodes[1].storage.Set(first, []byte("1"))
+	pool.lnodes[0].storage.Set(second, []byte("2"))
+	pool.lnodes[1].storage.SetEntry(second, tombstone)
+	pool.lnodes[1].storage.SetEntry(newID64(3, 160), tombstone)
+
+	keys, err := pool.GetAllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !keys[0].Eq(first) || !keys[1].Eq(second) {
+		t.Errorf("Pool expected to list keys [%v %v], listed %v", first, second, keys)
+	}
+}
+
+type fakeTransport struct {
+	dials int
+}
+
+func (transport *fakeTransport) Dial(id *data.ID, addr *net.TCPAddr, vnode int, peers Peers) RemoteNode {
+	transport.dials++
+	return newRemoteNode(NewHTTPTransport(), id, addr, vnode, peers)
+}
+
+func TestNodePoolTransport(t *testing.T) {
+	transport := &fakeTransport{}
+	config := NewConfig()
+	config.Transport = transport
+	now := time.Now()
+	config.Clock = func() time.Time {
+		return now
+	}
+	pool, err := newNodePool(fakeAddr(1), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := formatNodeRef(newID64(5, config.IDSpace.Bits), fakeAddr(2), 1)
+	node, err := pool.parseNode(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.(RemoteNode); !ok || nodeRef(node) != ref {
+		t.Errorf("Node %s expected to be remote, was %v", ref, node)
+	}
+	if again, _ := pool.parseNode(ref); again != node {
+		t.Errorf("Node %s expected to be reused, was %v", ref, again)
+	}
+	if transport.dials != 1 {
+		t.Errorf("Node %s expected to be dialed once, was dialed %d times", ref, transport.dials)
+	}
+
+	// A single failure is not enough for the node to be disconnected, while
+	// a failure after a long silence is.
+	pool.NodeFailed(node, errors.New("Unreachable."))
+	if again, _ := pool.parseNode(ref); again != node {
+		t.Errorf("Node %s expected to remain connected after failing once", ref)
+	}
+	now = now.Add(time.Minute)
+	pool.NodeFailed(node, errors.New("Unreachable."))
+	if again, _ := pool.parseNode(ref); again == node || transport.dials != 2 {
+		t.Errorf("Node %s expected to be dialed again after being disconnected", ref)
+	}
+}
@@ -1,25 +1,30 @@
 package chord
 
 import (
+	"context"
 	"fmt"
 	"net"
 
 	"github.com/ltu-tmmoa/chord-sky/data"
 )
 
-// Represents some Chord node available remotely.
+// Represents some Chord node available remotely via HTTP.
 type remoteNode struct {
-	addr    net.TCPAddr
-	id      data.ID
-	pool    *nodePool
-	storage data.Storage
+	addr      net.TCPAddr
+	vnode     int
+	id        data.ID
+	peers     Peers
+	transport *HTTPTransport
+	storage   data.Storage
 }
 
-func newRemoteNode(addr *net.TCPAddr, pool *nodePool) *remoteNode {
+func newRemoteNode(transport *HTTPTransport, id *data.ID, addr *net.TCPAddr, vnode int, peers Peers) *remoteNode {
 	node := &remoteNode{
-		addr: *addr,
-		id:   *addrToID(addr),
-		pool: pool,
+		addr:      *addr,
+		vnode:     vnode,
+		id:        *id,
+		peers:     peers,
+		transport: transport,
 	}
 	node.storage = newRemoteStorage(node)
 	return node
@@ -33,6 +38,18 @@ func (node *remoteNode) TCPAddr() *net.TCPAddr {
 	return &node.addr
 }
 
+func (node *remoteNode) VNode() int {
+	return node.vnode
+}
+
+func (node *remoteNode) IDSpace() (IDSpace, error) {
+	return node.IDSpaceContext(context.Background())
+}
+
+func (node *remoteNode) IDSpaceContext(ctx context.Context) (IDSpace, error) {
+	return node.httpGetIDSpace(ctx, "idspace")
+}
+
 func (node *remoteNode) FingerStart(i int) *data.ID {
 	m := node.ID().Bits()
 	verifyIndexOrPanic(m, i)
@@ -40,11 +57,19 @@ func (node *remoteNode) FingerStart(i int) *data.ID {
 }
 
 func (node *remoteNode) FingerNode(i int) (Node, error) {
-	return node.httpGetNodef("fingers/%d", i)
+	return node.FingerNodeContext(context.Background(), i)
+}
+
+func (node *remoteNode) FingerNodeContext(ctx context.Context, i int) (Node, error) {
+	return node.httpGetNodef(ctx, "fingers/%d", i)
 }
 
 func (node *remoteNode) SetFingerNode(i int, fing Node) error {
-	return node.httpPut(fmt.Sprintf("fingers/%d", i), fing.TCPAddr().String())
+	return node.SetFingerNodeContext(context.Background(), i, fing)
+}
+
+func (node *remoteNode) SetFingerNodeContext(ctx context.Context, i int, fing Node) error {
+	return node.httpPut(ctx, fmt.Sprintf("fingers/%d", i), nodeRef(fing))
 }
 
 func (node *remoteNode) Heartbeat() {
@@ -52,31 +77,63 @@ func (node *remoteNode) Heartbeat() {
 }
 
 func (node *remoteNode) Successor() (Node, error) {
-	return node.httpGetNodef("successor")
+	return node.SuccessorContext(context.Background())
+}
+
+func (node *remoteNode) SuccessorContext(ctx context.Context) (Node, error) {
+	return node.httpGetNodef(ctx, "successor")
 }
 
 func (node *remoteNode) SuccessorList() ([]Node, error) {
-	return node.httpGetNodesf("successors")
+	return node.SuccessorListContext(context.Background())
+}
+
+func (node *remoteNode) SuccessorListContext(ctx context.Context) ([]Node, error) {
+	return node.httpGetNodesf(ctx, "successors")
 }
 
 func (node *remoteNode) Predecessor() (Node, error) {
-	return node.httpGetNodef("predecessor")
+	return node.PredecessorContext(context.Background())
+}
+
+func (node *remoteNode) PredecessorContext(ctx context.Context) (Node, error) {
+	return node.httpGetNodef(ctx, "predecessor")
 }
 
 func (node *remoteNode) FindSuccessor(id *data.ID) (Node, error) {
-	return node.httpGetNodef("successors?id=%s", id.String())
+	return node.FindSuccessorContext(context.Background(), id)
+}
+
+func (node *remoteNode) FindSuccessorContext(ctx context.Context, id *data.ID) (Node, error) {
+	return node.httpGetNodef(ctx, "successors?id=%s", id.String())
+}
+
+func (node *remoteNode) LookupSuccessor(ctx context.Context, id *data.ID, mode LookupMode) (Node, error) {
+	return node.httpGetNodef(ctx, "successors?id=%s&lookup=%s&hops=%d", id.String(), mode, lookupHops(ctx))
 }
 
 func (node *remoteNode) FindPredecessor(id *data.ID) (Node, error) {
-	return node.httpGetNodef("predecessors?id=%s", id.String())
+	return node.FindPredecessorContext(context.Background(), id)
+}
+
+func (node *remoteNode) FindPredecessorContext(ctx context.Context, id *data.ID) (Node, error) {
+	return node.httpGetNodef(ctx, "predecessors?id=%s", id.String())
 }
 
 func (node *remoteNode) SetSuccessor(succ Node) error {
-	return node.httpPut("successor", succ.TCPAddr().String())
+	return node.SetSuccessorContext(context.Background(), succ)
+}
+
+func (node *remoteNode) SetSuccessorContext(ctx context.Context, succ Node) error {
+	return node.httpPut(ctx, "successor", nodeRef(succ))
 }
 
 func (node *remoteNode) SetPredecessor(pred Node) error {
-	return node.httpPut("predecessor", pred.TCPAddr().String())
+	return node.SetPredecessorContext(context.Background(), pred)
+}
+
+func (node *remoteNode) SetPredecessorContext(ctx context.Context, pred Node) error {
+	return node.httpPut(ctx, "predecessor", nodeRef(pred))
 }
 
 func (node *remoteNode) Storage() data.Storage {
@@ -84,5 +141,5 @@ func (node *remoteNode) Storage() data.Storage {
 }
 
 func (node *remoteNode) String() string {
-	return fmt.Sprintf("%s@%s", node.ID().String(), node.TCPAddr().String())
+	return nodeRef(node)
 }
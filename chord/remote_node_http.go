@@ -2,122 +2,247 @@ package chord
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/ltu-tmmoa/chord-sky/data"
 	"github.com/ltu-tmmoa/chord-sky/log"
 )
 
-func (node *remoteNode) httpHeartbeat(path string) {
-	url := fmt.Sprintf("http://%s/node/%s", node.TCPAddr(), path)
-	res, err := http.Get(url)
-	if err != nil {
-		node.disconnect(err)
-		return
+// Header holding the time left until the deadline of a call, allowing the
+// called node to bound any calls it makes on behalf of the caller.
+const httpTimeoutHeader = "X-Chord-Timeout"
+
+// HTTPTransport reaches remote nodes via the HTTP routes exposed by
+// HTTPService.
+type HTTPTransport struct {
+	// Client sends the requests of remote nodes. If nil, http.DefaultClient
+	// is used.
+	Client *http.Client
+
+	// Timeout bounds the duration of calls made without a deadline of their
+	// own, including any retries.
+	Timeout time.Duration
+
+	// Retries is the amount of times GET requests failing to reach their node
+	// are retried, as long as their deadlines allow.
+	Retries int
+
+	// Backoff is the longest delay before the first retry, which doubles for
+	// each retry after it. Actual delays are picked at random, up to their
+	// longest.
+	Backoff time.Duration
+}
+
+// NewHTTPTransport creates a transport reaching remote nodes via the HTTP
+// routes exposed by HTTPService, using default timeouts and retries.
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{
+		Timeout: 5 * time.Second,
+		Retries: 2,
+		Backoff: 100 * time.Millisecond,
 	}
-	if res.Body == nil {
-		node.disconnect(errors.New("No body in response."))
-		return
+}
+
+func (transport *HTTPTransport) Dial(id *data.ID, addr *net.TCPAddr, vnode int, peers Peers) RemoteNode {
+	return newRemoteNode(transport, id, addr, vnode, peers)
+}
+
+func (transport *HTTPTransport) client() *http.Client {
+	if transport.Client != nil {
+		return transport.Client
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	return http.DefaultClient
+}
+
+// Resolves a random delay before given retry, counted from zero.
+func (transport *HTTPTransport) backoff(retry int) time.Duration {
+	max := transport.Backoff << uint(retry)
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// Response of a remote node, read in full.
+type httpResponse struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte
+}
+
+func (node *remoteNode) httpHeartbeat(path string) {
+	res, err := node.httpGet(context.Background(), node.httpURL(path))
 	if err != nil {
-		node.disconnect(err)
 		return
 	}
-	log.Logger.Println("Node", node, "heartbeat (", string(body), ").")
+	log.Logger.Println("Node", node, "heartbeat (", string(res.Body), ").")
 }
 
-func (node *remoteNode) httpGetNodef(pathFormat string, pathArgs ...interface{}) (Node, error) {
+func (node *remoteNode) httpGetNodef(ctx context.Context, pathFormat string, pathArgs ...interface{}) (Node, error) {
 	path := fmt.Sprintf(pathFormat, pathArgs...)
-	url := fmt.Sprintf("http://%s/node/%s", node.TCPAddr(), path)
-	res, err := http.Get(url)
+	url := node.httpURL(path)
+	res, err := node.httpGet(ctx, url)
 	if err != nil {
-		node.disconnect(err)
 		return nil, err
 	}
-	if res.Body == nil {
-		node.disconnect(errors.New("No body in response."))
-		return nil, err
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP GET %s -> %d %s", url, res.StatusCode, res.Body)
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	return node.parseNode(string(res.Body))
+}
+
+func (node *remoteNode) httpGetIDSpace(ctx context.Context, path string) (IDSpace, error) {
+	url := node.httpURL(path)
+	res, err := node.httpGet(ctx, url)
 	if err != nil {
-		node.disconnect(err)
-		return nil, err
+		return IDSpace{}, err
 	}
-	addr, err := net.ResolveTCPAddr("tcp", string(body))
-	if err != nil {
-		node.disconnect(err)
-		return nil, err
+	if res.StatusCode != http.StatusOK {
+		return IDSpace{}, fmt.Errorf("HTTP GET %s -> %d %s", url, res.StatusCode, res.Status)
 	}
-	return node.pool.getOrCreateNode(addr), nil
+	return parseIDSpace(string(res.Body))
 }
 
-func (node *remoteNode) httpGetNodesf(pathFormat string, pathArgs ...interface{}) ([]Node, error) {
+func (node *remoteNode) httpGetNodesf(ctx context.Context, pathFormat string, pathArgs ...interface{}) ([]Node, error) {
 	path := fmt.Sprintf(pathFormat, pathArgs...)
-	url := fmt.Sprintf("http://%s/node/%s", node.TCPAddr(), path)
-	res, err := http.Get(url)
+	url := node.httpURL(path)
+	res, err := node.httpGet(ctx, url)
 	if err != nil {
-		node.disconnect(err)
-		return nil, err
-	}
-	if res.Body == nil {
-		node.disconnect(errors.New("No body in response."))
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		node.disconnect(err)
-		return nil, err
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP GET %s -> %d %s", url, res.StatusCode, res.Body)
 	}
-	tokens := bytes.Split(body, []byte{'\r', '\n'})
+	tokens := bytes.Split(res.Body, []byte{'\r', '\n'})
 	nodes := make([]Node, 0, len(tokens))
 	for _, token := range tokens {
 		if len(token) == 0 {
 			continue
 		}
-		addr, err := net.ResolveTCPAddr("tcp", string(token))
+		n, err := node.parseNode(string(token))
 		if err != nil {
-			node.disconnect(err)
 			return nil, err
 		}
-		nodes = append(nodes, node.pool.getOrCreateNode(addr))
+		nodes = append(nodes, n)
 	}
 	return nodes, nil
 }
 
-func (node *remoteNode) httpPut(path, body string) error {
-	url := fmt.Sprintf("http://%s/node/%s", node.TCPAddr().String(), path)
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBufferString(body))
-	if req.Body != nil {
-		defer req.Body.Close()
-	}
+func (node *remoteNode) httpPut(ctx context.Context, path, body string) error {
+	url := node.httpURL(path)
+	res, err := node.httpDo(ctx, http.MethodPut, url, nil, []byte(body))
 	if err != nil {
-		node.disconnect(err)
 		return err
 	}
-	res, err := http.DefaultClient.Do(req)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("HTTP PUT %s -> %d %s", url, res.StatusCode, res.Status)
+	}
+	return nil
+}
+
+func (node *remoteNode) httpGet(ctx context.Context, url string) (*httpResponse, error) {
+	return node.httpDo(ctx, http.MethodGet, url, nil, nil)
+}
+
+// Sends request to this node, notifying its peers of whether it responded or
+// not. A response with an error status still counts as the node having
+// responded, unless the status is 410, signalling that the node has left its
+// ring.
+//
+// The request must complete before the deadline of `ctx`, or within the
+// timeout of the transport of this node if `ctx` has no deadline. GET requests
+// failing to reach the node are retried, with jittered exponential backoff,
+// until the deadline passes. The node is reported as failed at most once per
+// request, and only if the request was not given up on due to `ctx` being
+// done.
+func (node *remoteNode) httpDo(ctx context.Context, method, url string, header http.Header, body []byte) (*httpResponse, error) {
+	transport := node.transport
+	caller := ctx
+	if _, ok := ctx.Deadline(); !ok && transport.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transport.Timeout)
+		defer cancel()
+	}
+	for retry := 0; ; retry++ {
+		res, err := node.httpTry(ctx, method, url, header, body)
+		if err == nil && res.StatusCode == http.StatusGone {
+			node.peers.NodeFailed(node, errNodeLeft)
+			return nil, errNodeLeft
+		}
+		if err == nil {
+			node.peers.NodeResponded(node)
+			return res, nil
+		}
+		if method != http.MethodGet || retry >= transport.Retries || !httpSleep(ctx, transport.backoff(retry)) {
+			if caller.Err() == nil {
+				node.peers.NodeFailed(node, err)
+			}
+			return nil, err
+		}
+	}
+}
+
+// Sleeps for given duration, returning false without sleeping it out if `ctx`
+// is done first.
+func httpSleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Makes a single attempt at sending request to this node, reading its
+// response in full.
+func (node *remoteNode) httpTry(ctx context.Context, method, url string, header http.Header, body []byte) (*httpResponse, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
 	if err != nil {
-		node.disconnect(err)
-		return err
+		return nil, err
 	}
-	if res.Body != nil {
-		defer res.Body.Close()
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
 	}
-	if res.StatusCode < 200 || res.StatusCode > 299 {
-		err := fmt.Errorf("HTTP PUT %s -> %d %s", url, res.StatusCode, res.Status)
-		node.disconnect(err)
-		return err
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(httpTimeoutHeader, time.Until(deadline).String())
 	}
-	return nil
+	res, err := node.transport.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &httpResponse{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Header:     res.Header,
+		Body:       resBody,
+	}, nil
+}
+
+// Resolves URL of given path, relative to the routes of this node.
+func (node *remoteNode) httpURL(path string) string {
+	return fmt.Sprintf("http://%s/node/%d/%s", node.TCPAddr(), node.vnode, path)
 }
 
-func (node *remoteNode) disconnect(err error) {
-	node.pool.removeNode(node)
-	log.Logger.Printf("Node %s disconnected: %s", node.String(), err.Error())
+// Resolves node of given reference, produced by nodeRef.
+func (node *remoteNode) parseNode(ref string) (Node, error) {
+	id, addr, vnode, err := parseNodeRef(ref, node.peers.IDSpace())
+	if err != nil {
+		return nil, err
+	}
+	return node.peers.ResolveNode(id, addr, vnode), nil
 }
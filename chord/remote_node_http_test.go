@@ -0,0 +1,157 @@
+package chord
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves given handler, dialing a remote node reaching it via HTTP.
+func dialHTTPTest(t *testing.T, transport *HTTPTransport, handler http.HandlerFunc) *remoteNode {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	pool, err := newNodePool(fakeAddr(1), NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	return newRemoteNode(transport, newID64(5, pool.IDSpace().Bits), addr, 0, pool)
+}
+
+// Drops connection of given request without responding.
+func httpDrop(t *testing.T, w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// Counts the failures reported to the peers of a remote node.
+type failureCountingPeers struct {
+	Peers
+	failures int32
+}
+
+func (peers *failureCountingPeers) NodeFailed(node Node, err error) {
+	atomic.AddInt32(&peers.failures, 1)
+	peers.Peers.NodeFailed(node, err)
+}
+
+func TestRemoteNodeRetries(t *testing.T) {
+	silenceLog(t)
+	transport := NewHTTPTransport()
+	transport.Backoff = 1 * time.Millisecond
+
+	mutex := sync.Mutex{}
+	calls := map[string]int{}
+	sent := func(method string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return calls[method]
+	}
+	ref := formatNodeRef(newID64(7, 160), fakeAddr(2), 0)
+	node := dialHTTPTest(t, transport, func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		calls[req.Method]++
+		n := calls[req.Method]
+		mutex.Unlock()
+
+		if n <= transport.Retries {
+			httpDrop(t, w)
+			return
+		}
+		httpWrite(w, http.StatusOK, ref)
+	})
+
+	succ, err := node.Successor()
+	if err != nil || nodeRef(succ) != ref {
+		t.Errorf("Successor expected to be %s after retries, was %v (%v)", ref, succ, err)
+	}
+	if n := sent(http.MethodGet); n != transport.Retries+1 {
+		t.Errorf("GET expected to be sent %d times, was sent %d times", transport.Retries+1, n)
+	}
+
+	if err = node.SetSuccessor(succ); err == nil {
+		t.Errorf("SetSuccessor expected to fail without being retried")
+	}
+	if n := sent(http.MethodPut); n != 1 {
+		t.Errorf("PUT expected to be sent once, was sent %d times", n)
+	}
+}
+
+func TestRemoteNodeDeadline(t *testing.T) {
+	silenceLog(t)
+	transport := NewHTTPTransport()
+	transport.Retries = 0
+
+	timeouts := make(chan time.Duration, 1)
+	node := dialHTTPTest(t, transport, func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := httpRequestContext(req)
+		defer cancel()
+		deadline, _ := ctx.Deadline()
+		timeouts <- time.Until(deadline)
+		<-ctx.Done()
+		httpWrite(w, http.StatusFailedDependency, ctx.Err())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := node.FindSuccessorContext(ctx, newID64(9, 160)); err == nil {
+		t.Errorf("FindSuccessorContext expected to fail once its deadline passed")
+	}
+	if elapsed := time.Since(start); elapsed > transport.Timeout/2 {
+		t.Errorf("FindSuccessorContext expected to give up after about 200ms, took %v", elapsed)
+	}
+	if timeout := <-timeouts; timeout <= 0 || timeout > 200*time.Millisecond {
+		t.Errorf("Remote node expected to be given at most 200ms, was given %v", timeout)
+	}
+}
+
+func TestRemoteNodeFailures(t *testing.T) {
+	silenceLog(t)
+	transport := NewHTTPTransport()
+	transport.Backoff = 1 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+	var gets int32
+	node := dialHTTPTest(t, transport, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("id") != "" {
+			<-release
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		httpDrop(t, w)
+	})
+	peers := &failureCountingPeers{Peers: node.peers}
+	node.peers = peers
+
+	// Retried requests report a single failure.
+	if _, err := node.Successor(); err == nil {
+		t.Errorf("Successor expected to fail")
+	}
+	if n := atomic.LoadInt32(&gets); n != int32(transport.Retries+1) {
+		t.Errorf("GET expected to be sent %d times, was sent %d times", transport.Retries+1, n)
+	}
+	if n := atomic.LoadInt32(&peers.failures); n != 1 {
+		t.Errorf("Node expected to be reported as failed once, was reported %d times", n)
+	}
+
+	// Requests outliving the deadline of their caller report no failures.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := node.FindSuccessorContext(ctx, newID64(9, 160)); err == nil {
+		t.Errorf("FindSuccessorContext expected to fail once its deadline passed")
+	}
+	if n := atomic.LoadInt32(&peers.failures); n != 1 {
+		t.Errorf("Node expected not to be reported as failed past deadline, was reported %d times", n)
+	}
+}
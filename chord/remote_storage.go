@@ -2,10 +2,9 @@ package chord
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"github.com/ltu-tmmoa/chord-sky/data"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 )
@@ -22,66 +21,95 @@ func newRemoteStorage(node *remoteNode) *remoteStorage {
 
 // Get attempts to get value associated with given key.
 //
-// Acquiring a value of `nil` is not considered an error.
+// data.ErrNotFound is returned if no value is associated with the key.
 func (storage *remoteStorage) Get(key *data.ID) ([]byte, error) {
-	node := storage.node
+	return storage.GetContext(context.Background(), key)
+}
 
-	url := fmt.Sprintf("http://%s/storage/%s", node.TCPAddr().String(), key.String())
-	res, err := http.Get(url)
+func (storage *remoteStorage) GetContext(ctx context.Context, key *data.ID) ([]byte, error) {
+	entry, err := storage.GetEntryContext(ctx, key)
 	if err != nil {
-		node.disconnect(err)
 		return nil, err
 	}
-	if res.Body == nil {
-		return nil, nil
-	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	return entry.Value, nil
+}
+
+// GetEntry attempts to get value and metadata associated with given key.
+//
+// data.ErrNotFound is returned if no entry is associated with the key.
+func (storage *remoteStorage) GetEntry(key *data.ID) (*data.Entry, error) {
+	return storage.GetEntryContext(context.Background(), key)
+}
+
+func (storage *remoteStorage) GetEntryContext(ctx context.Context, key *data.ID) (*data.Entry, error) {
+	node := storage.node
+
+	url := node.httpURL("storage/" + key.String())
+	res, err := node.httpGet(ctx, url)
 	if err != nil {
-		node.disconnect(err)
 		return nil, err
 	}
-
-	return body, nil
+	if res.StatusCode == http.StatusNotFound {
+		return nil, data.ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusMultipleChoices {
+		return nil, fmt.Errorf("HTTP storage Get %s -> %d %s", url, res.StatusCode, res.Status)
+	}
+	return httpDecodeEntry(res.Header, bytes.NewReader(res.Body))
 }
 
 // GetKeyRange gets all keys that lexically located within [fromKey, toKey).
 func (storage *remoteStorage) GetKeyRange(fromKey, toKey *data.ID) ([]*data.ID, error) {
+	return storage.GetKeyRangeContext(context.Background(), fromKey, toKey)
+}
+
+func (storage *remoteStorage) GetKeyRangeContext(ctx context.Context, fromKey, toKey *data.ID) ([]*data.ID, error) {
 	node := storage.node
 
-	// http://<IP:PORT>/storage/keys?from=x00&to=x11
-	url, err := url.Parse(fmt.Sprintf("http://%s/storage/keys", node.TCPAddr().String()))
+	// http://<IP:PORT>/node/<VNODE>/storage/keys?from=x00&to=x11
+	url, err := url.Parse(node.httpURL("storage/keys"))
 	if err != nil {
-		node.disconnect(err)
 		return nil, err
 	}
 	q := url.Query()
 	q.Set("from", fromKey.String())
 	q.Set("to", toKey.String())
+	url.RawQuery = q.Encode()
 
-	res, err := http.Get(url.String())
+	return storage.httpGetKeys(ctx, url.String())
+}
+
+// GetAllKeys gets all keys held by storage.
+func (storage *remoteStorage) GetAllKeys() ([]*data.ID, error) {
+	return storage.GetAllKeysContext(context.Background())
+}
+
+func (storage *remoteStorage) GetAllKeysContext(ctx context.Context) ([]*data.ID, error) {
+	node := storage.node
+
+	url := node.httpURL("storage/keys")
+	return storage.httpGetKeys(ctx, url)
+}
+
+func (storage *remoteStorage) httpGetKeys(ctx context.Context, url string) ([]*data.ID, error) {
+	node := storage.node
+
+	res, err := node.httpGet(ctx, url)
 	if err != nil {
-		node.disconnect(err)
 		return nil, err
 	}
-	if res.Body == nil {
-		return nil, nil
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP storage Get %s -> %d %s", url, res.StatusCode, res.Status)
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		node.disconnect(err)
-		return nil, err
-	}
-	slice := bytes.Split(body, []byte{'\n'})
+	slice := bytes.Split(res.Body, []byte{'\n'})
 	keys := make([]*data.ID, 0, len(slice))
 	for _, v := range slice {
-		if len(slice) == 0 {
-			return nil, nil
+		if len(v) == 0 {
+			continue
 		}
-		key, ok1 := parseID(string(v))
+		key, ok1 := node.peers.IDSpace().parseID(string(v))
 		if !ok1 {
-			err = errors.New("Something went wrong")
+			err = fmt.Errorf("Invalid key `%s` received from %s.", v, node)
 			return nil, err
 		}
 		keys = append(keys, key)
@@ -92,32 +120,70 @@ func (storage *remoteStorage) GetKeyRange(fromKey, toKey *data.ID) ([]*data.ID,
 // Set stores provided key/value pair, potentially replacing an existing
 // such.
 func (storage *remoteStorage) Set(key *data.ID, value []byte) error {
+	return storage.SetContext(context.Background(), key, value)
+}
+
+func (storage *remoteStorage) SetContext(ctx context.Context, key *data.ID, value []byte) error {
+	return storage.SetEntryContext(ctx, key, &data.Entry{Value: value})
+}
+
+// SetEntry stores provided key/entry pair, potentially replacing an existing
+// such.
+func (storage *remoteStorage) SetEntry(key *data.ID, entry *data.Entry) error {
+	return storage.SetEntryContext(context.Background(), key, entry)
+}
+
+func (storage *remoteStorage) SetEntryContext(ctx context.Context, key *data.ID, entry *data.Entry) error {
+	return storage.httpPutEntry(ctx, key, http.Header{}, entry)
+}
+
+// CompareAndSetEntry stores provided key/entry pair only if the entry
+// currently associated with the key satisfies given precondition, in which
+// case the stored entry is given a version one larger than that of the
+// current entry.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *remoteStorage) CompareAndSetEntry(key *data.ID, pre *data.Precondition, entry *data.Entry) error {
+	return storage.CompareAndSetEntryContext(context.Background(), key, pre, entry)
+}
+
+func (storage *remoteStorage) CompareAndSetEntryContext(ctx context.Context, key *data.ID, pre *data.Precondition, entry *data.Entry) error {
+	header := http.Header{}
+	header.Set(httpHeaderWriteMode, httpWriteModeCompare)
+	httpWritePrecondition(header, pre)
+	return storage.httpPutEntry(ctx, key, header, entry)
+}
+
+// ReplicateEntryContext stores provided key/entry pair as is, unless the
+// entry associated with the key is the same or a later version.
+func (storage *remoteStorage) ReplicateEntryContext(ctx context.Context, key *data.ID, entry *data.Entry) error {
+	header := http.Header{}
+	header.Set(httpHeaderWriteMode, httpWriteModeReplicate)
+	return storage.httpPutEntry(ctx, key, header, entry)
+}
+
+// Sends given entry to be stored by key, along with given request headers.
+func (storage *remoteStorage) httpPutEntry(ctx context.Context, key *data.ID, header http.Header, entry *data.Entry) error {
 	node := storage.node
 
-	url := fmt.Sprintf("http://%s/storage/%s", node.TCPAddr().String(), key.String())
+	url := node.httpURL("storage/" + key.String())
 
 	// Base64 encoding, RFC 4648.
 	// str := base64.StdEncoding.EncodeToString(value)
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(value))
-	if req.Body != nil {
-		defer req.Body.Close()
-	}
+	body, err := httpEncodeEntry(header, entry)
 	if err != nil {
-		node.disconnect(err)
 		return err
 	}
-	res, err := http.DefaultClient.Do(req)
+
+	res, err := node.httpDo(ctx, http.MethodPut, url, header, body)
 	if err != nil {
-		node.disconnect(err)
 		return err
 	}
-	if res.Body != nil {
-		defer res.Body.Close()
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return data.ErrPreconditionFailed
 	}
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		err := fmt.Errorf("HTTP storage Put %s -> %d %s", url, res.StatusCode, res.Status)
-		node.disconnect(err)
-		return err
+		return fmt.Errorf("HTTP storage Put %s -> %d %s", url, res.StatusCode, res.Status)
 	}
 	return nil
 }
@@ -125,29 +191,37 @@ func (storage *remoteStorage) Set(key *data.ID, value []byte) error {
 // Remove attempts to remove one key/value pair from store with a key
 // matching given.
 func (storage *remoteStorage) Remove(key *data.ID) error {
+	return storage.RemoveContext(context.Background(), key)
+}
+
+func (storage *remoteStorage) RemoveContext(ctx context.Context, key *data.ID) error {
+	return storage.CompareAndRemoveContext(ctx, key, nil)
+}
+
+// CompareAndRemove removes the entry associated with given key only if it
+// satisfies given precondition.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *remoteStorage) CompareAndRemove(key *data.ID, pre *data.Precondition) error {
+	return storage.CompareAndRemoveContext(context.Background(), key, pre)
+}
+
+func (storage *remoteStorage) CompareAndRemoveContext(ctx context.Context, key *data.ID, pre *data.Precondition) error {
 	node := storage.node
 
-	url := fmt.Sprintf("http://%s/storage/%s", node.TCPAddr().String(), key.String())
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
-	if req.Body != nil {
-		defer req.Body.Close()
-	}
-	if err != nil {
-		node.disconnect(err)
-		return err
-	}
-	res, err := http.DefaultClient.Do(req)
+	url := node.httpURL("storage/" + key.String())
+	header := http.Header{}
+	httpWritePrecondition(header, pre)
+
+	res, err := node.httpDo(ctx, http.MethodDelete, url, header, nil)
 	if err != nil {
-		node.disconnect(err)
 		return err
 	}
-	if res.Body != nil {
-		defer res.Body.Close()
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return data.ErrPreconditionFailed
 	}
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		err := fmt.Errorf("HTTP storage Delete %s -> %d %s", url, res.StatusCode, res.Status)
-		node.disconnect(err)
-		return err
+		return fmt.Errorf("HTTP storage Delete %s -> %d %s", url, res.StatusCode, res.Status)
 	}
 	return nil
 }
@@ -0,0 +1,392 @@
+package chord
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+	"github.com/ltu-tmmoa/chord-sky/log"
+)
+
+// Storage of some local node owning the keys it is given, coordinating reads
+// and writes with the replicas of that node.
+//
+// Reads are first made locally, and are then sent concurrently to all other
+// replicas unless the local node alone makes a quorum. They succeed once at
+// least R replicas, including the local node, respond.
+//
+// Writes are first applied locally, which is where any preconditions are
+// checked. They are then sent concurrently to all other replicas, and succeed
+// once at least W replicas, including the local node, acknowledge. Replicas
+// yet to acknowledge when a write succeeds are still written to, until the
+// deadline of the write passes. Replicas only apply entries superseding those
+// they hold, which prevents delayed writes from undoing later ones.
+//
+// If the node is versioned, the versions read from replicas are merged, and
+// written entries are given new clocks descending from the causal context they
+// are provided with. Otherwise, the entry of the latest version is read.
+//
+// Removed keys are replaced by tombstones, which are replicated like any other
+// entries, and expire once the configured grace period has passed.
+//
+// Operations given a context stop waiting for replicas once the context is
+// done, failing with a quorum error caused by that of the context.
+type replicatingStorage struct {
+	node        *localNode
+	readQuorum  int
+	writeQuorum int
+}
+
+func newReplicatingStorage(node *localNode, readQuorum, writeQuorum int) *replicatingStorage {
+	return &replicatingStorage{
+		node:        node,
+		readQuorum:  readQuorum,
+		writeQuorum: writeQuorum,
+	}
+}
+
+// Returned when fewer replicas than required respond to a storage operation,
+// either as all replicas have been called or as the operation was given up on
+// due to `cause`.
+type quorumError struct {
+	op     string
+	acks   int
+	quorum int
+	cause  error
+}
+
+func (err *quorumError) Error() string {
+	msg := fmt.Sprintf("Storage %s quorum not reached; %d of %d required replicas responded.", err.op, err.acks, err.quorum)
+	if err.cause != nil {
+		msg += " " + err.cause.Error()
+	}
+	return msg
+}
+
+// Unwrap provides the error causing the quorum not to be reached, if any.
+func (err *quorumError) Unwrap() error {
+	return err.cause
+}
+
+// Outcome of calling some replica.
+type replicaResult struct {
+	entry *data.Entry
+	err   error
+}
+
+// Calls `op` concurrently for each given replica, delivering the outcomes to
+// the returned channel, which is able to hold all of them.
+//
+// Failures other than data.ErrNotFound are logged, as the outcomes of some
+// replicas may arrive after they are no longer waited for.
+func (storage *replicatingStorage) fanOut(replicas []Node, opName string, op func(replica Node) (*data.Entry, error)) <-chan replicaResult {
+	results := make(chan replicaResult, len(replicas))
+	for _, replica := range replicas {
+		replica := replica
+		storage.node.config.spawn(func() {
+			entry, err := op(replica)
+			if err != nil && err != data.ErrNotFound {
+				log.Logger.Println("Failed to", opName, "replica", replica, err.Error())
+			}
+			results <- replicaResult{entry, err}
+		})
+	}
+	return results
+}
+
+// Get attempts to get value associated with given key.
+//
+// data.ErrNotFound is returned if no value is associated with the key.
+func (storage *replicatingStorage) Get(key *data.ID) ([]byte, error) {
+	return storage.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but fails if `ctx` is done before a read quorum is
+// reached.
+func (storage *replicatingStorage) GetContext(ctx context.Context, key *data.ID) ([]byte, error) {
+	entry, err := storage.GetEntryContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry attempts to get value and metadata associated with given key.
+//
+// data.ErrNotFound is returned if no entry is associated with the key.
+func (storage *replicatingStorage) GetEntry(key *data.ID) (*data.Entry, error) {
+	return storage.GetEntryContext(context.Background(), key)
+}
+
+// GetEntryContext is like GetEntry, but fails if `ctx` is done before a read
+// quorum is reached.
+func (storage *replicatingStorage) GetEntryContext(ctx context.Context, key *data.ID) (*data.Entry, error) {
+	var result *data.Entry
+	acks := 0
+	merge := func(entry *data.Entry) bool {
+		if storage.node.config.Versioned {
+			result = data.MergeEntries(result, entry)
+		} else if entry != nil && entry.Supersedes(result) {
+			result = entry
+		}
+		acks++
+		return acks >= storage.readQuorum
+	}
+	found := func() (*data.Entry, error) {
+		if result == nil || result.Tombstone() {
+			return nil, data.ErrNotFound
+		}
+		return result, nil
+	}
+
+	entry, err := storage.node.storage.GetEntryContext(ctx, key)
+	if err != nil && err != data.ErrNotFound {
+		log.Logger.Println("Failed to read replica", storage.node, err.Error())
+	} else if merge(entry) {
+		return found()
+	}
+	replicas := storage.node.replicaNodes()
+	results := storage.fanOut(replicas, "read", func(replica Node) (*data.Entry, error) {
+		return replica.Storage().GetEntryContext(ctx, key)
+	})
+	for range replicas {
+		select {
+		case <-ctx.Done():
+			return nil, &quorumError{"read", acks, storage.readQuorum, ctx.Err()}
+		case res := <-results:
+			if res.err != nil && res.err != data.ErrNotFound {
+				continue
+			}
+			if merge(res.entry) {
+				return found()
+			}
+		}
+	}
+	return nil, &quorumError{"read", acks, storage.readQuorum, nil}
+}
+
+// GetKeyRange gets all keys that lexically located within [fromKey, toKey).
+func (storage *replicatingStorage) GetKeyRange(fromKey, toKey *data.ID) ([]*data.ID, error) {
+	return storage.GetKeyRangeContext(context.Background(), fromKey, toKey)
+}
+
+// GetKeyRangeContext is like GetKeyRange, but fails if `ctx` is done before
+// the keys are got.
+func (storage *replicatingStorage) GetKeyRangeContext(ctx context.Context, fromKey, toKey *data.ID) ([]*data.ID, error) {
+	return storage.node.storage.GetKeyRangeContext(ctx, fromKey, toKey)
+}
+
+// GetAllKeys gets all keys held by storage.
+func (storage *replicatingStorage) GetAllKeys() ([]*data.ID, error) {
+	return storage.GetAllKeysContext(context.Background())
+}
+
+// GetAllKeysContext is like GetAllKeys, but fails if `ctx` is done before the
+// keys are got.
+func (storage *replicatingStorage) GetAllKeysContext(ctx context.Context) ([]*data.ID, error) {
+	return storage.node.storage.GetAllKeysContext(ctx)
+}
+
+// Set stores provided key/value pair, potentially replacing an existing
+// such.
+func (storage *replicatingStorage) Set(key *data.ID, value []byte) error {
+	return storage.SetContext(context.Background(), key, value)
+}
+
+// SetContext is like Set, but fails if `ctx` is done before a write quorum is
+// reached.
+func (storage *replicatingStorage) SetContext(ctx context.Context, key *data.ID, value []byte) error {
+	return storage.SetEntryContext(ctx, key, &data.Entry{Value: value})
+}
+
+// SetEntry stores provided key/entry pair, potentially replacing an existing
+// such.
+func (storage *replicatingStorage) SetEntry(key *data.ID, entry *data.Entry) error {
+	return storage.SetEntryContext(context.Background(), key, entry)
+}
+
+// SetEntryContext is like SetEntry, but fails if `ctx` is done before a write
+// quorum is reached.
+func (storage *replicatingStorage) SetEntryContext(ctx context.Context, key *data.ID, entry *data.Entry) error {
+	return storage.CompareAndSetEntryContext(ctx, key, nil, entry)
+}
+
+// CompareAndSetEntry stores provided key/entry pair only if the entry
+// currently associated with the key satisfies given precondition, in which
+// case the stored entry is given a version one larger than that of the
+// current entry.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *replicatingStorage) CompareAndSetEntry(key *data.ID, pre *data.Precondition, entry *data.Entry) error {
+	return storage.CompareAndSetEntryContext(context.Background(), key, pre, entry)
+}
+
+// CompareAndSetEntryContext is like CompareAndSetEntry, but fails if `ctx` is
+// done before a write quorum is reached.
+func (storage *replicatingStorage) CompareAndSetEntryContext(ctx context.Context, key *data.ID, pre *data.Precondition, entry *data.Entry) error {
+	stored, err := storage.setLocal(ctx, key, pre, entry)
+	if err != nil {
+		return err
+	}
+	return storage.writeReplicas(ctx, func(ctx context.Context, replica data.Storage) error {
+		return replicateEntry(ctx, replica, key, stored)
+	})
+}
+
+// Writes given entry to the storage of the local node, if it satisfies given
+// precondition, returning the entry stored as a result.
+//
+// If versioning, a new version of the entry is created and written while
+// holding the versioning mutex of the key, as the version must descend from
+// any version stored concurrently.
+func (storage *replicatingStorage) setLocal(ctx context.Context, key *data.ID, pre *data.Precondition, entry *data.Entry) (*data.Entry, error) {
+	if storage.node.config.Versioned {
+		mutex := storage.node.versioning.of(key)
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var err error
+		if entry, err = storage.newVersion(ctx, key, entry); err != nil {
+			return nil, err
+		}
+	}
+	local := storage.node.storage
+	if err := local.CompareAndSetEntryContext(ctx, key, pre, entry); err != nil {
+		return nil, err
+	}
+	return local.GetEntryContext(ctx, key)
+}
+
+// Creates new version of given entry, discarding its siblings but keeping its
+// expiry and removal times.
+//
+// The clock of the new version descends from the causal context of the entry.
+// It also descends from any versions previously coordinated by the local node,
+// which prevents writes made without context from being superseded by earlier
+// such writes.
+func (storage *replicatingStorage) newVersion(ctx context.Context, key *data.ID, entry *data.Entry) (*data.Entry, error) {
+	self := storage.node.ID().String()
+	clock := entry.Context()
+
+	stored, err := storage.node.storage.GetEntryContext(ctx, key)
+	if err != nil && err != data.ErrNotFound {
+		return nil, err
+	}
+	if counter := stored.Context()[self]; counter > clock[self] {
+		clock[self] = counter
+	}
+	return &data.Entry{
+		Name:    entry.Name,
+		Value:   entry.Value,
+		Clock:   clock.Increment(self),
+		Expires: entry.Expires,
+		Deleted: entry.Deleted,
+	}, nil
+}
+
+// Remove attempts to remove one key/value pair from store with a key
+// matching given.
+func (storage *replicatingStorage) Remove(key *data.ID) error {
+	return storage.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext is like Remove, but fails if `ctx` is done before a write
+// quorum is reached.
+func (storage *replicatingStorage) RemoveContext(ctx context.Context, key *data.ID) error {
+	return storage.CompareAndRemoveContext(ctx, key, nil)
+}
+
+// CompareAndRemove replaces the entry associated with given key by a
+// tombstone only if it satisfies given precondition.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *replicatingStorage) CompareAndRemove(key *data.ID, pre *data.Precondition) error {
+	return storage.CompareAndRemoveContext(context.Background(), key, pre)
+}
+
+// CompareAndRemoveContext is like CompareAndRemove, but fails if `ctx` is
+// done before a write quorum is reached.
+func (storage *replicatingStorage) CompareAndRemoveContext(ctx context.Context, key *data.ID, pre *data.Precondition) error {
+	now := time.Now()
+	tombstone := &data.Entry{
+		Expires: now.Add(storage.node.config.TombstoneGrace),
+		Deleted: now,
+	}
+	if storage.node.config.Versioned {
+		// Supersedes all versions known to the local node.
+		stored, err := storage.node.storage.GetEntryContext(ctx, key)
+		if err != nil && err != data.ErrNotFound {
+			return err
+		}
+		tombstone.Clock = stored.Context()
+	}
+	return storage.CompareAndSetEntryContext(ctx, key, pre, tombstone)
+}
+
+// Applies given write operation concurrently to all replicas but the local
+// node, which is assumed to already have acknowledged the operation, returning
+// once a write quorum is reached.
+//
+// Failing to write to a replica is logged, but does not stop the operation
+// from being applied to remaining replicas. As replicas may still be written
+// to after this returns, they are given a context sharing only the deadline
+// of `ctx`.
+func (storage *replicatingStorage) writeReplicas(ctx context.Context, op func(ctx context.Context, replica data.Storage) error) error {
+	acks := 1
+	replicas := storage.node.replicaNodes()
+	if len(replicas) == 0 {
+		if acks < storage.writeQuorum {
+			return &quorumError{"write", acks, storage.writeQuorum, nil}
+		}
+		return nil
+	}
+	writeCtx, cancel := detachContext(ctx)
+	remaining := int32(len(replicas))
+	results := storage.fanOut(replicas, "write", func(replica Node) (*data.Entry, error) {
+		err := op(writeCtx, replica.Storage())
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			cancel()
+		}
+		return nil, err
+	})
+	for range replicas {
+		if acks >= storage.writeQuorum {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return &quorumError{"write", acks, storage.writeQuorum, ctx.Err()}
+		case res := <-results:
+			if res.err == nil {
+				acks++
+			}
+		}
+	}
+	if acks < storage.writeQuorum {
+		return &quorumError{"write", acks, storage.writeQuorum, nil}
+	}
+	return nil
+}
+
+// Writes given entry to replica, unless the entry held by the replica is the
+// same or a later version.
+//
+// data.ErrNotSupported is returned if the replica is not a data.ReplicaStorage,
+// as it would be unable to compare and replace its entry atomically.
+func replicateEntry(ctx context.Context, replica data.Storage, key *data.ID, entry *data.Entry) error {
+	if replica, ok := replica.(data.ReplicaStorage); ok {
+		return replica.ReplicateEntryContext(ctx, key, entry)
+	}
+	return data.ErrNotSupported
+}
+
+// Derives context sharing only the deadline of `ctx`, which is not done when
+// `ctx` is cancelled.
+func detachContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
@@ -0,0 +1,411 @@
+package chord
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+	"github.com/ltu-tmmoa/chord-sky/simnet"
+)
+
+// Reaches remote nodes hosted in-process by the node pools listening on a
+// simulated network, on behalf of the pool at some local address.
+type simTransport struct {
+	network *simnet.Network
+	laddr   string
+}
+
+func newSimTransport(network *simnet.Network, laddr *net.TCPAddr) *simTransport {
+	return &simTransport{
+		network: network,
+		laddr:   laddr.String(),
+	}
+}
+
+// Creates a clock reporting the virtual time of given network.
+func simClock(network *simnet.Network) func() time.Time {
+	epoch := time.Unix(0, 0)
+	return func() time.Time {
+		return epoch.Add(network.Now())
+	}
+}
+
+// Runs given function before returning, as calls over a simulated network
+// must be made one at a time to keep simulations deterministic.
+func simGo(fn func()) {
+	fn()
+}
+
+// Makes given pool reachable by simulated transports at its address.
+func listenSim(network *simnet.Network, pool *nodePool) {
+	network.Listen(pool.lnodes[0].TCPAddr().String(), pool)
+}
+
+func (transport *simTransport) Dial(id *data.ID, addr *net.TCPAddr, vnode int, peers Peers) RemoteNode {
+	node := &simNode{
+		addr:      *addr,
+		host:      addr.String(),
+		vnode:     vnode,
+		id:        *id,
+		peers:     peers,
+		transport: transport,
+	}
+	node.storage = &simStorage{node: node}
+	return node
+}
+
+// Represents some Chord node hosted by a node pool reached via a simulated
+// network.
+type simNode struct {
+	addr      net.TCPAddr
+	host      string
+	vnode     int
+	id        data.ID
+	peers     Peers
+	transport *simTransport
+	storage   data.Storage
+}
+
+// Calls `op` with the remote node and its pool, after sending a request to it
+// over the simulated network, unless `ctx` is done.
+//
+// The peers of the node are notified of whether the node responded or not,
+// the node failing to respond if the request or its response is lost, or if
+// it has left its ring.
+func (node *simNode) call(ctx context.Context, op func(pool *nodePool, lnode *localNode) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	transport := node.transport
+	err := transport.network.Call(transport.laddr, node.host, func(handler interface{}) error {
+		pool := handler.(*nodePool)
+		if node.vnode >= len(pool.lnodes) {
+			return fmt.Errorf("Virtual node %d does not exist.", node.vnode)
+		}
+		lnode := pool.lnodes[node.vnode]
+		if lnode.hasLeft() {
+			return errNodeLeft
+		}
+		return op(pool, lnode)
+	})
+	if err == simnet.ErrTimeout || err == errNodeLeft {
+		node.peers.NodeFailed(node, err)
+	} else {
+		node.peers.NodeResponded(node)
+	}
+	return err
+}
+
+// Like call, but resolves the node yielded by `op` among the peers of this
+// node.
+func (node *simNode) callNode(ctx context.Context, op func(pool *nodePool, lnode *localNode) (Node, error)) (Node, error) {
+	var n Node
+	err := node.call(ctx, func(pool *nodePool, lnode *localNode) (err error) {
+		n, err = op(pool, lnode)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node.resolve(n), nil
+}
+
+// Resolves given node, received from the remote node, among the peers of this
+// node.
+func (node *simNode) resolve(n Node) Node {
+	if n == nil {
+		return nil
+	}
+	return node.peers.ResolveNode(n.ID(), n.TCPAddr(), n.VNode())
+}
+
+// Resolves given node, sent to the remote node, among the nodes of its pool.
+func simResolve(pool *nodePool, n Node) Node {
+	return pool.getOrCreateNode(n.ID(), n.TCPAddr(), n.VNode())
+}
+
+func (node *simNode) ID() *data.ID {
+	return &node.id
+}
+
+func (node *simNode) TCPAddr() *net.TCPAddr {
+	return &node.addr
+}
+
+func (node *simNode) VNode() int {
+	return node.vnode
+}
+
+func (node *simNode) IDSpace() (IDSpace, error) {
+	return node.IDSpaceContext(context.Background())
+}
+
+func (node *simNode) IDSpaceContext(ctx context.Context) (IDSpace, error) {
+	var space IDSpace
+	err := node.call(ctx, func(pool *nodePool, lnode *localNode) (err error) {
+		space, err = lnode.IDSpaceContext(ctx)
+		return err
+	})
+	return space, err
+}
+
+func (node *simNode) FingerStart(i int) *data.ID {
+	m := node.ID().Bits()
+	verifyIndexOrPanic(m, i)
+	return calcfingerStart(node.ID(), i-1)
+}
+
+func (node *simNode) FingerNode(i int) (Node, error) {
+	return node.FingerNodeContext(context.Background(), i)
+}
+
+func (node *simNode) FingerNodeContext(ctx context.Context, i int) (Node, error) {
+	return node.callNode(ctx, func(pool *nodePool, lnode *localNode) (Node, error) {
+		return lnode.FingerNodeContext(ctx, i)
+	})
+}
+
+func (node *simNode) SetFingerNode(i int, fing Node) error {
+	return node.SetFingerNodeContext(context.Background(), i, fing)
+}
+
+func (node *simNode) SetFingerNodeContext(ctx context.Context, i int, fing Node) error {
+	return node.call(ctx, func(pool *nodePool, lnode *localNode) error {
+		return lnode.SetFingerNodeContext(ctx, i, simResolve(pool, fing))
+	})
+}
+
+func (node *simNode) Heartbeat() {
+	node.call(context.Background(), func(pool *nodePool, lnode *localNode) error {
+		return nil
+	})
+}
+
+func (node *simNode) Successor() (Node, error) {
+	return node.SuccessorContext(context.Background())
+}
+
+func (node *simNode) SuccessorContext(ctx context.Context) (Node, error) {
+	return node.callNode(ctx, func(pool *nodePool, lnode *localNode) (Node, error) {
+		return lnode.SuccessorContext(ctx)
+	})
+}
+
+func (node *simNode) SuccessorList() ([]Node, error) {
+	return node.SuccessorListContext(context.Background())
+}
+
+func (node *simNode) SuccessorListContext(ctx context.Context) ([]Node, error) {
+	var succs []Node
+	err := node.call(ctx, func(pool *nodePool, lnode *localNode) (err error) {
+		succs, err = lnode.SuccessorListContext(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(succs))
+	for _, succ := range succs {
+		nodes = append(nodes, node.resolve(succ))
+	}
+	return nodes, nil
+}
+
+func (node *simNode) Predecessor() (Node, error) {
+	return node.PredecessorContext(context.Background())
+}
+
+func (node *simNode) PredecessorContext(ctx context.Context) (Node, error) {
+	return node.callNode(ctx, func(pool *nodePool, lnode *localNode) (Node, error) {
+		return lnode.PredecessorContext(ctx)
+	})
+}
+
+func (node *simNode) FindSuccessor(id *data.ID) (Node, error) {
+	return node.FindSuccessorContext(context.Background(), id)
+}
+
+func (node *simNode) FindSuccessorContext(ctx context.Context, id *data.ID) (Node, error) {
+	return node.callNode(ctx, func(pool *nodePool, lnode *localNode) (Node, error) {
+		return lnode.FindSuccessorContext(ctx, id)
+	})
+}
+
+func (node *simNode) LookupSuccessor(ctx context.Context, id *data.ID, mode LookupMode) (Node, error) {
+	return node.callNode(ctx, func(pool *nodePool, lnode *localNode) (Node, error) {
+		return lnode.LookupSuccessor(ctx, id, mode)
+	})
+}
+
+func (node *simNode) FindPredecessor(id *data.ID) (Node, error) {
+	return node.FindPredecessorContext(context.Background(), id)
+}
+
+func (node *simNode) FindPredecessorContext(ctx context.Context, id *data.ID) (Node, error) {
+	return node.callNode(ctx, func(pool *nodePool, lnode *localNode) (Node, error) {
+		return lnode.FindPredecessorContext(ctx, id)
+	})
+}
+
+func (node *simNode) SetSuccessor(succ Node) error {
+	return node.SetSuccessorContext(context.Background(), succ)
+}
+
+func (node *simNode) SetSuccessorContext(ctx context.Context, succ Node) error {
+	return node.call(ctx, func(pool *nodePool, lnode *localNode) error {
+		return lnode.SetSuccessorContext(ctx, simResolve(pool, succ))
+	})
+}
+
+func (node *simNode) SetPredecessor(pred Node) error {
+	return node.SetPredecessorContext(context.Background(), pred)
+}
+
+func (node *simNode) SetPredecessorContext(ctx context.Context, pred Node) error {
+	return node.call(ctx, func(pool *nodePool, lnode *localNode) error {
+		return lnode.SetPredecessorContext(ctx, simResolve(pool, pred))
+	})
+}
+
+func (node *simNode) Storage() data.Storage {
+	return node.storage
+}
+
+func (node *simNode) String() string {
+	return nodeRef(node)
+}
+
+// Provides access to the storage of a node reached via a simulated network.
+//
+// Entries are copied when sent and received, as they would be if serialized.
+type simStorage struct {
+	node *simNode
+}
+
+func (storage *simStorage) call(ctx context.Context, op func(storage data.Storage) error) error {
+	return storage.node.call(ctx, func(pool *nodePool, lnode *localNode) error {
+		return op(lnode.Storage())
+	})
+}
+
+func (storage *simStorage) Get(key *data.ID) ([]byte, error) {
+	return storage.GetContext(context.Background(), key)
+}
+
+func (storage *simStorage) GetContext(ctx context.Context, key *data.ID) ([]byte, error) {
+	entry, err := storage.GetEntryContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+func (storage *simStorage) GetEntry(key *data.ID) (*data.Entry, error) {
+	return storage.GetEntryContext(context.Background(), key)
+}
+
+func (storage *simStorage) GetEntryContext(ctx context.Context, key *data.ID) (*data.Entry, error) {
+	var entry *data.Entry
+	err := storage.call(ctx, func(s data.Storage) (err error) {
+		entry, err = s.GetEntryContext(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyEntry(entry), nil
+}
+
+func (storage *simStorage) GetKeyRange(fromKey, toKey *data.ID) ([]*data.ID, error) {
+	return storage.GetKeyRangeContext(context.Background(), fromKey, toKey)
+}
+
+func (storage *simStorage) GetKeyRangeContext(ctx context.Context, fromKey, toKey *data.ID) ([]*data.ID, error) {
+	var keys []*data.ID
+	err := storage.call(ctx, func(s data.Storage) (err error) {
+		keys, err = s.GetKeyRangeContext(ctx, fromKey, toKey)
+		return err
+	})
+	return keys, err
+}
+
+func (storage *simStorage) GetAllKeys() ([]*data.ID, error) {
+	return storage.GetAllKeysContext(context.Background())
+}
+
+func (storage *simStorage) GetAllKeysContext(ctx context.Context) ([]*data.ID, error) {
+	var keys []*data.ID
+	err := storage.call(ctx, func(s data.Storage) (err error) {
+		keys, err = s.GetAllKeysContext(ctx)
+		return err
+	})
+	return keys, err
+}
+
+func (storage *simStorage) Set(key *data.ID, value []byte) error {
+	return storage.SetContext(context.Background(), key, value)
+}
+
+func (storage *simStorage) SetContext(ctx context.Context, key *data.ID, value []byte) error {
+	return storage.SetEntryContext(ctx, key, &data.Entry{Value: value})
+}
+
+func (storage *simStorage) SetEntry(key *data.ID, entry *data.Entry) error {
+	return storage.SetEntryContext(context.Background(), key, entry)
+}
+
+func (storage *simStorage) SetEntryContext(ctx context.Context, key *data.ID, entry *data.Entry) error {
+	return storage.CompareAndSetEntryContext(ctx, key, nil, entry)
+}
+
+func (storage *simStorage) CompareAndSetEntry(key *data.ID, pre *data.Precondition, entry *data.Entry) error {
+	return storage.CompareAndSetEntryContext(context.Background(), key, pre, entry)
+}
+
+func (storage *simStorage) CompareAndSetEntryContext(ctx context.Context, key *data.ID, pre *data.Precondition, entry *data.Entry) error {
+	entry = copyEntry(entry)
+	return storage.call(ctx, func(s data.Storage) error {
+		return s.CompareAndSetEntryContext(ctx, key, pre, entry)
+	})
+}
+
+func (storage *simStorage) ReplicateEntryContext(ctx context.Context, key *data.ID, entry *data.Entry) error {
+	entry = copyEntry(entry)
+	return storage.call(ctx, func(s data.Storage) error {
+		return replicateEntry(ctx, s, key, entry)
+	})
+}
+
+func (storage *simStorage) Remove(key *data.ID) error {
+	return storage.RemoveContext(context.Background(), key)
+}
+
+func (storage *simStorage) RemoveContext(ctx context.Context, key *data.ID) error {
+	return storage.CompareAndRemoveContext(ctx, key, nil)
+}
+
+func (storage *simStorage) CompareAndRemove(key *data.ID, pre *data.Precondition) error {
+	return storage.CompareAndRemoveContext(context.Background(), key, pre)
+}
+
+func (storage *simStorage) CompareAndRemoveContext(ctx context.Context, key *data.ID, pre *data.Precondition) error {
+	return storage.call(ctx, func(s data.Storage) error {
+		return s.CompareAndRemoveContext(ctx, key, pre)
+	})
+}
+
+// Creates a deep copy of given entry.
+func copyEntry(entry *data.Entry) *data.Entry {
+	c := *entry
+	c.Value = append([]byte(nil), entry.Value...)
+	if entry.Clock != nil {
+		c.Clock = entry.Clock.Copy()
+	}
+	c.Siblings = nil
+	for _, sibling := range entry.Siblings {
+		c.Siblings = append(c.Siblings, copyEntry(sibling))
+	}
+	return &c
+}
@@ -0,0 +1,366 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+	"github.com/ltu-tmmoa/chord-sky/simnet"
+)
+
+const (
+	simBits            = 32
+	simRefreshInterval = 1 * time.Second
+)
+
+// A ring of node pools reaching each other via a simulated network, each of
+// which is refreshed periodically.
+type simRing struct {
+	t       *testing.T
+	network *simnet.Network
+	pools   []*nodePool
+	byAddr  map[string]*nodePool
+
+	// Pools cut off from the ring, which are not expected to be part of it.
+	isolated map[*nodePool]bool
+}
+
+func newSimRing(t *testing.T, seed int64) *simRing {
+	silenceLog(t)
+	network := simnet.New(seed)
+	network.SetLink(simnet.Link{
+		Latency: 1 * time.Millisecond,
+		Jitter:  4 * time.Millisecond,
+	})
+	return &simRing{
+		t:        t,
+		network:  network,
+		byAddr:   map[string]*nodePool{},
+		isolated: map[*nodePool]bool{},
+	}
+}
+
+func simAddr(i int) *net.TCPAddr {
+	return &net.TCPAddr{
+		IP:   []byte{10, 0, byte(i / 256), byte(i % 256)},
+		Port: 8080,
+	}
+}
+
+// Adds a new node pool to the ring, which joins it via a random live pool.
+func (ring *simRing) add() *nodePool {
+	addr := simAddr(len(ring.pools))
+	config := NewConfig()
+	config.IDSpace.Bits = simBits
+	config.Transport = newSimTransport(ring.network, addr)
+	config.Rand = rand.New(rand.NewSource(ring.network.Rand().Int63()))
+	config.Clock = simClock(ring.network)
+	config.Go = simGo
+	config.FailureDetector.AcceptablePause = 3 * simRefreshInterval
+	config.FailureDetector.FirstInterval = simRefreshInterval
+	pool, err := newNodePool(addr, config)
+	if err != nil {
+		ring.t.Fatal(err)
+	}
+	listenSim(ring.network, pool)
+	ring.join(pool)
+	ring.pools = append(ring.pools, pool)
+	ring.byAddr[addr.String()] = pool
+	ring.scheduleRefresh(pool)
+	return pool
+}
+
+// Makes given pool join the ring via a random live pool, or form its own ring
+// if there are no live pools.
+func (ring *simRing) join(pool *nodePool) {
+	live := ring.live()
+
+	// Joining is retried, as messages may be lost.
+	for attempt := 0; ; attempt++ {
+		var peer Node
+		if len(live) > 0 {
+			via := live[ring.network.Rand().Intn(len(live))].lnodes[0]
+			peer = pool.transport.Dial(via.ID(), via.TCPAddr(), 0, pool)
+		}
+		err := pool.join(peer)
+		if err == nil {
+			return
+		}
+		if attempt == 10 {
+			ring.t.Fatal(err)
+		}
+	}
+}
+
+func (ring *simRing) scheduleRefresh(pool *nodePool) {
+	jitter := time.Duration(ring.network.Rand().Int63n(int64(simRefreshInterval)))
+	ring.network.Schedule(simRefreshInterval/2+jitter, func() {
+		if ring.network.Crashed(pool.lnodes[0].TCPAddr().String()) {
+			return
+		}
+		pool.refresh()
+		ring.scheduleRefresh(pool)
+	})
+}
+
+// Adds `n` node pools to the ring, one every `interval`.
+func (ring *simRing) grow(n int, interval time.Duration) {
+	for i := 0; i < n; i++ {
+		ring.add()
+		ring.network.Run(interval)
+	}
+}
+
+// Resolves all pools neither crashed nor isolated.
+func (ring *simRing) live() []*nodePool {
+	live := []*nodePool{}
+	for _, pool := range ring.pools {
+		if !ring.isolated[pool] && !ring.network.Crashed(pool.lnodes[0].TCPAddr().String()) {
+			live = append(live, pool)
+		}
+	}
+	return live
+}
+
+// Resolves the local nodes of all live pools, ordered by ID.
+func (ring *simRing) ring() []*localNode {
+	lnodes := []*localNode{}
+	for _, pool := range ring.live() {
+		lnodes = append(lnodes, pool.lnodes...)
+	}
+	sort.Slice(lnodes, func(i, j int) bool {
+		return lnodes[i].ID().Cmp(lnodes[j].ID()) < 0
+	})
+	return lnodes
+}
+
+// Resolves the local node hosting given node.
+func (ring *simRing) localNode(node Node) *localNode {
+	pool := ring.byAddr[node.TCPAddr().String()]
+	return pool.lnodes[node.VNode()]
+}
+
+// Checks that the successors, predecessors, successor lists and fingers of all
+// live nodes refer to the live nodes they should, returning an error
+// describing the first violation found, if any.
+func (ring *simRing) check() error {
+	lnodes := ring.ring()
+	n := len(lnodes)
+	successorOf := func(id *data.ID) *localNode {
+		i := sort.Search(n, func(i int) bool {
+			return lnodes[i].ID().Cmp(id) >= 0
+		})
+		return lnodes[i%n]
+	}
+	for i, lnode := range lnodes {
+		succ, pred := lnodes[(i+1)%n], lnodes[(i+n-1)%n]
+		if s := lnode.successor(); s == nil || !s.ID().Eq(succ.ID()) {
+			return fmt.Errorf("{%v}.successor expected to be %v, was %v", lnode, succ, s)
+		}
+		if p := lnode.predecessor; p == nil || !p.ID().Eq(pred.ID()) {
+			return fmt.Errorf("{%v}.predecessor expected to be %v, was %v", lnode, pred, p)
+		}
+		if len(lnode.succlist) != lnode.successorListLen() {
+			return fmt.Errorf("len({%v}.succlist) expected to be %d, was %d", lnode, lnode.successorListLen(), len(lnode.succlist))
+		}
+		for j, s := range lnode.succlist {
+			if expected := lnodes[(i+1+j)%n]; !s.ID().Eq(expected.ID()) {
+				return fmt.Errorf("{%v}.succlist[%d] expected to be %v, was %v", lnode, j, expected, s)
+			}
+		}
+		for k := 1; k <= simBits; k++ {
+			expected := successorOf(lnode.FingerStart(k))
+			if f := lnode.fingerNode(k); !f.ID().Eq(expected.ID()) {
+				return fmt.Errorf("{%v}.finger(%d) expected to be %v, was %v", lnode, k, expected, f)
+			}
+		}
+	}
+	return nil
+}
+
+// Runs the simulation until the ring is correct, failing if it does not
+// become so within given limit of virtual time.
+func (ring *simRing) converge(limit time.Duration) {
+	start := ring.network.Now()
+	var err error
+	converged := ring.network.RunUntil(simRefreshInterval, limit, func() bool {
+		err = ring.check()
+		return err == nil
+	})
+	if !converged {
+		ring.t.Fatalf("Ring of %d nodes did not converge within %v: %v", len(ring.ring()), limit, err)
+	}
+	ring.t.Logf("Ring of %d nodes converged after %v", len(ring.ring()), ring.network.Now()-start)
+}
+
+// Stores `n` keys, each via a random live node, returning the keys stored.
+func (ring *simRing) store(n int) []*data.ID {
+	lnodes := ring.ring()
+	keys := make([]*data.ID, 0, n)
+	for i := 0; i < n; i++ {
+		key := newID64(ring.network.Rand().Int63(), simBits)
+		lnode := lnodes[ring.network.Rand().Intn(len(lnodes))]
+		owner, err := lnode.FindSuccessor(key)
+		if err != nil {
+			ring.t.Fatal(err)
+		}
+		storage := ring.localNode(owner).primaryStorage(1, 1)
+		if err = storage.Set(key, []byte(key.String())); err != nil {
+			ring.t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Fails unless each given key is held by its owner.
+func (ring *simRing) expectKeys(keys []*data.ID) {
+	lnodes := ring.ring()
+	for _, key := range keys {
+		owner := ring.localNode(lnodes[0])
+		if o, err := owner.FindSuccessor(key); err != nil {
+			ring.t.Fatal(err)
+		} else {
+			owner = ring.localNode(o)
+		}
+		value, err := owner.storage.Get(key)
+		if err != nil || string(value) != key.String() {
+			ring.t.Errorf("Key %v expected to be held by %v, got %q (%v)", key, owner, value, err)
+		}
+	}
+}
+
+// Crashes every `nth` live node in ring order, returning the amount crashed.
+func (ring *simRing) crashEvery(nth int) int {
+	lnodes := ring.ring()
+	crashed := 0
+	for i := 0; i < len(lnodes); i += nth {
+		ring.network.Crash(lnodes[i].TCPAddr().String())
+		crashed++
+	}
+	return crashed
+}
+
+func TestSimJoinAndFail(t *testing.T) {
+	n := 200
+	if testing.Short() {
+		n = 50
+	}
+	ring := newSimRing(t, 1)
+	ring.grow(n, 100*time.Millisecond)
+	ring.converge(5 * time.Minute)
+
+	keys := ring.store(500)
+	ring.expectKeys(keys)
+
+	// No two adjacent nodes are crashed, leaving at least one replica of
+	// each key.
+	crashed := ring.crashEvery(10)
+	t.Logf("Crashed %d nodes", crashed)
+	ring.converge(10 * time.Minute)
+	ring.expectKeys(keys)
+}
+
+func TestSimPartition(t *testing.T) {
+	ring := newSimRing(t, 3)
+	ring.grow(100, 100*time.Millisecond)
+	ring.converge(5 * time.Minute)
+
+	// The minority is cut off long enough for the majority to consider it
+	// failed, after which it rejoins the ring.
+	addrs := []string{}
+	for _, pool := range ring.pools[:10] {
+		addrs = append(addrs, pool.lnodes[0].TCPAddr().String())
+		ring.isolated[pool] = true
+	}
+	ring.network.Partition(addrs)
+	ring.converge(10 * time.Minute)
+
+	ring.network.Heal()
+	for _, pool := range ring.pools[:10] {
+		delete(ring.isolated, pool)
+		ring.join(pool)
+	}
+	ring.converge(10 * time.Minute)
+}
+
+func TestSimLossyLinks(t *testing.T) {
+	ring := newSimRing(t, 5)
+	ring.network.SetLink(simnet.Link{
+		Latency: 1 * time.Millisecond,
+		Jitter:  4 * time.Millisecond,
+		Drop:    0.01,
+	})
+	ring.grow(50, 100*time.Millisecond)
+	ring.converge(10 * time.Minute)
+
+	// Lost messages delay refreshes, but cause no nodes to be disconnected,
+	// which would leave the ring incorrect until refreshed again.
+	ring.network.Run(1 * time.Minute)
+	if err := ring.check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSimDeterministic(t *testing.T) {
+	run := func() (string, time.Duration) {
+		ring := newSimRing(t, 4)
+		ring.network.SetLink(simnet.Link{
+			Latency: 1 * time.Millisecond,
+			Jitter:  10 * time.Millisecond,
+			Drop:    0.02,
+		})
+		ring.grow(30, 100*time.Millisecond)
+		ring.network.Run(30 * time.Second)
+
+		buf := &bytes.Buffer{}
+		for _, lnode := range ring.ring() {
+			fmt.Fprintf(buf, "%v %v %v\n%v", lnode, lnode.predecessor, lnode.succlist, lnode.ftable)
+		}
+		return buf.String(), ring.network.Now()
+	}
+	state0, now0 := run()
+	state1, now1 := run()
+	if state0 != state1 || now0 != now1 {
+		t.Errorf("Simulations with the same seed expected to be equal, ended at %v and %v", now0, now1)
+	}
+}
+
+func TestSimRecursiveLookup(t *testing.T) {
+	ring := newSimRing(t, 6)
+	ring.grow(50, 100*time.Millisecond)
+	ring.converge(5 * time.Minute)
+
+	lnodes := ring.ring()
+	elapsed := map[LookupMode]time.Duration{}
+	for i := 0; i < 100; i++ {
+		id := newID64(ring.network.Rand().Int63(), simBits)
+		lnode := lnodes[ring.network.Rand().Intn(len(lnodes))]
+		j := sort.Search(len(lnodes), func(j int) bool {
+			return lnodes[j].ID().Cmp(id) >= 0
+		})
+		expected := lnodes[j%len(lnodes)]
+
+		for _, mode := range []LookupMode{LookupIterative, LookupRecursive} {
+			start := ring.network.Now()
+			succ, err := lnode.LookupSuccessor(context.Background(), id, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			elapsed[mode] += ring.network.Now() - start
+			if !succ.ID().Eq(expected.ID()) {
+				t.Errorf("%s lookup of %v via %v expected to yield %v, got %v", mode, id, lnode, expected, succ)
+			}
+		}
+	}
+	t.Logf("Lookups took %v iteratively and %v recursively", elapsed[LookupIterative], elapsed[LookupRecursive])
+	if elapsed[LookupRecursive]*2 > elapsed[LookupIterative] {
+		t.Errorf("Recursive lookups expected to take less than half the time of iterative ones")
+	}
+}
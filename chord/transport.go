@@ -0,0 +1,47 @@
+package chord
+
+import (
+	"net"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
+
+// Transport carries the operations of remote nodes over some wire protocol,
+// leaving local nodes unaware of how the other nodes of their rings are
+// reached.
+type Transport interface {
+	// Dial creates a handle of identified remote node, through which its
+	// operations are carried out.
+	//
+	// Nodes yielded by the handle are resolved through `peers`, which is also
+	// notified whenever the remote node responds or fails to respond.
+	Dial(id *data.ID, addr *net.TCPAddr, vnode int, peers Peers) RemoteNode
+}
+
+// RemoteNode represents some Chord node reached through a Transport.
+type RemoteNode interface {
+	Node
+
+	// Heartbeat checks whether the node is still reachable, notifying its
+	// peers of the outcome.
+	Heartbeat()
+}
+
+// Peers keeps track of the remote nodes known to the local nodes of some
+// process, on behalf of the remote nodes created by its Transport.
+type Peers interface {
+	// IDSpace provides the ID space of the ring of the local nodes.
+	IDSpace() IDSpace
+
+	// ResolveNode resolves identified node, dialing it if not already known.
+	ResolveNode(id *data.ID, addr *net.TCPAddr, vnode int) Node
+
+	// NodeResponded records that given remote node responded to a request,
+	// even if with an error.
+	NodeResponded(node Node)
+
+	// NodeFailed records that given remote node failed to respond to a
+	// request due to given error. The node is forgotten, being removed from
+	// all finger tables and successor lists, if suspected to have failed.
+	NodeFailed(node Node, err error)
+}
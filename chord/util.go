@@ -1,9 +1,29 @@
 package chord
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ltu-tmmoa/chord-sky/data"
+)
 
 func verifyIndexOrPanic(len, i int) {
 	if 1 > i || i > len {
 		panic(fmt.Sprintf("%d not in [1,%d]", i, len))
 	}
 }
+
+// Set of mutexes, each of which guards the keys sharing its index in the set.
+//
+// Keys sharing a mutex can't be locked concurrently, which limits concurrency
+// somewhat but avoids keeping a mutex per key.
+type keyMutex [64]sync.Mutex
+
+// Returns the mutex guarding given key.
+func (mutex *keyMutex) of(key *data.ID) *sync.Mutex {
+	words := key.BigInt().Bits()
+	if len(words) == 0 {
+		return &mutex[0]
+	}
+	return &mutex[uint(words[0])%uint(len(mutex))]
+}
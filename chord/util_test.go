@@ -1,10 +1,14 @@
 package chord
 
 import (
+	"io/ioutil"
 	"math/big"
 	"net"
+	"os"
+	"testing"
 
 	"github.com/ltu-tmmoa/chord-sky/data"
+	"github.com/ltu-tmmoa/chord-sky/log"
 )
 
 func fakeAddr(id byte) *net.TCPAddr {
@@ -17,3 +21,11 @@ func fakeAddr(id byte) *net.TCPAddr {
 func newID64(value int64, bits int) *data.ID {
 	return data.NewID(big.NewInt(value), bits)
 }
+
+// Discards log output until the end of given test.
+func silenceLog(t *testing.T) {
+	log.Logger.SetOutput(ioutil.Discard)
+	t.Cleanup(func() {
+		log.Logger.SetOutput(os.Stdout)
+	})
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// Entry holds a stored value along with any metadata kept about it.
+type Entry struct {
+	// Name is the human-readable key name the entry was stored by, if any.
+	Name string
+
+	// Value holds the actual data of the entry.
+	Value []byte
+
+	// Clock identifies the version of the entry, if versioned.
+	Clock VectorClock
+
+	// Siblings holds any versions of the entry that are concurrent with it.
+	Siblings []*Entry
+
+	// Version is incremented each time the entry is conditionally written,
+	// and is used to detect concurrent modifications.
+	Version uint64
+
+	// Expires is the time at which the entry expires, or zero if it never
+	// does. Expired entries are treated as if not stored.
+	Expires time.Time
+
+	// Deleted is the time at which the entry was removed, or zero if it was
+	// not. Removed entries are kept as tombstones, preventing their keys from
+	// being restored from replicas that missed the removal.
+	Deleted time.Time
+}
+
+// Tombstone determines whether entry marks its key as removed, which is the
+// case if all its versions are deleted.
+func (entry *Entry) Tombstone() bool {
+	for _, version := range entry.Versions() {
+		if version.Deleted.IsZero() {
+			return false
+		}
+	}
+	return entry != nil
+}
+
+// Supersedes determines whether entry is to replace given other entry, which
+// may be `nil`, when both are associated with the same key.
+//
+// Versioned entries supersede others unless their clocks are equal to or
+// precede the clocks of the others, while other entries supersede entries of
+// lower versions. Tombstones supersede live entries of equal versions.
+func (entry *Entry) Supersedes(other *Entry) bool {
+	if other == nil {
+		return true
+	}
+	clock, otherClock := entry.Context(), other.Context()
+	if len(clock) > 0 || len(otherClock) > 0 {
+		ordering := clock.Compare(otherClock)
+		return ordering == After || ordering == Concurrent
+	}
+	if entry.Version != other.Version {
+		return entry.Version > other.Version
+	}
+	return entry.Tombstone() && !other.Tombstone()
+}
+
+// Expired determines whether entry has expired at given time.
+func (entry *Entry) Expired(now time.Time) bool {
+	return !entry.Expires.IsZero() && !now.Before(entry.Expires)
+}
+
+// ETag produces a quoted entity tag identifying the version of entry.
+func (entry *Entry) ETag() string {
+	return fmt.Sprintf("\"%d\"", entry.Version)
+}
+
+// Versions lists entry and its siblings, without any nested siblings.
+func (entry *Entry) Versions() []*Entry {
+	if entry == nil {
+		return nil
+	}
+	versions := []*Entry{{
+		Name:    entry.Name,
+		Value:   entry.Value,
+		Clock:   entry.Clock,
+		Deleted: entry.Deleted,
+	}}
+	for _, sibling := range entry.Siblings {
+		versions = append(versions, sibling.Versions()...)
+	}
+	return versions
+}
+
+// Context produces a clock descending from all versions of entry.
+//
+// A version written using this context as its clock supersedes all siblings.
+func (entry *Entry) Context() VectorClock {
+	clock := VectorClock{}
+	for _, version := range entry.Versions() {
+		clock = clock.Merge(version.Clock)
+	}
+	return clock
+}
+
+// MergeEntries combines the versions of two entries, discarding any version
+// descending from some other version. Either entry may be `nil`.
+//
+// If two versions have equal clocks, the one in `b` is kept. The version of the
+// result is the largest of those of the merged entries, while its expiry time
+// is that of `b`, if not `nil`.
+func MergeEntries(a, b *Entry) *Entry {
+	versions := append(a.Versions(), b.Versions()...)
+	kept := make([]*Entry, 0, len(versions))
+	for i, version := range versions {
+		superseded := false
+		for j, other := range versions {
+			if i == j {
+				continue
+			}
+			switch version.Clock.Compare(other.Clock) {
+			case Before:
+				superseded = true
+			case Equal:
+				superseded = superseded || i < j
+			}
+		}
+		if !superseded {
+			kept = append(kept, version)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	merged := kept[0]
+	merged.Siblings = kept[1:]
+	if len(merged.Siblings) == 0 {
+		merged.Siblings = nil
+	}
+	for _, entry := range []*Entry{a, b} {
+		if entry == nil {
+			continue
+		}
+		if entry.Version > merged.Version {
+			merged.Version = entry.Version
+		}
+		merged.Expires = entry.Expires
+	}
+	return merged
+}
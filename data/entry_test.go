@@ -0,0 +1,50 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEntrySupersedes(t *testing.T) {
+	live := &Entry{Value: []byte("1"), Version: 1}
+	newer := &Entry{Value: []byte("2"), Version: 2}
+	tombstone := &Entry{Version: 1, Deleted: time.Now()}
+
+	expectSupersedes := func(a, b *Entry, expected bool) {
+		if actual := a.Supersedes(b); actual != expected {
+			t.Errorf("%v.Supersedes(%v) %v != %v", a, b, actual, expected)
+		}
+	}
+	expectSupersedes(live, nil, true)
+	expectSupersedes(newer, live, true)
+	expectSupersedes(live, newer, false)
+	expectSupersedes(live, live, false)
+	expectSupersedes(tombstone, live, true)
+	expectSupersedes(live, tombstone, false)
+	expectSupersedes(newer, tombstone, true)
+
+	// Clocks take precedence over versions.
+	a := VectorClock{}.Increment("a")
+	versioned := &Entry{Clock: a, Version: 2}
+	expectSupersedes(&Entry{Clock: a.Increment("a"), Deleted: time.Now()}, versioned, true)
+	expectSupersedes(&Entry{Clock: a.Increment("b")}, &Entry{Clock: a.Increment("c")}, true)
+	expectSupersedes(versioned, &Entry{Clock: a.Increment("a")}, false)
+}
+
+func TestEntryTombstone(t *testing.T) {
+	var none *Entry
+	if none.Tombstone() {
+		t.Error("nil entry expected not to be a tombstone.")
+	}
+	deleted := &Entry{Deleted: time.Now()}
+	if !deleted.Tombstone() {
+		t.Error("Deleted entry expected to be a tombstone.")
+	}
+	sibling := &Entry{Deleted: time.Now(), Siblings: []*Entry{{Value: []byte("1")}}}
+	if sibling.Tombstone() {
+		t.Error("Deleted entry with live sibling expected not to be a tombstone.")
+	}
+	if !(&Precondition{IfNoneMatch: "*"}).Check(deleted) {
+		t.Error("Tombstone expected not to match `If-None-Match: *`.")
+	}
+}
@@ -0,0 +1,759 @@
+package data
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncPolicy determines when writes to a FileStorage are flushed to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every write to disk before it is acknowledged.
+	SyncAlways SyncPolicy = iota
+
+	// SyncPeriodically flushes writes to disk once every SyncInterval, which
+	// may cause writes acknowledged during the last interval to be lost if
+	// the host crashes.
+	SyncPeriodically
+
+	// SyncNever leaves flushing writes to disk to the operating system.
+	SyncNever
+)
+
+// SyncInterval is the interval at which writes are flushed to disk when using
+// SyncPeriodically.
+const SyncInterval = 1 * time.Second
+
+var syncPolicyNames = []string{"always", "periodically", "never"}
+
+func (policy SyncPolicy) String() string {
+	if policy < 0 || int(policy) >= len(syncPolicyNames) {
+		return fmt.Sprintf("SyncPolicy(%d)", int(policy))
+	}
+	return syncPolicyNames[policy]
+}
+
+// Set assigns sync policy from its name, which is either `always`,
+// `periodically` or `never`, making it usable as a command line flag.
+func (policy *SyncPolicy) Set(name string) error {
+	for i, n := range syncPolicyNames {
+		if n == name {
+			*policy = SyncPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Sync policy `%s` is not valid; must be always, periodically or never.", name)
+}
+
+var errFileStorageClosed = errors.New("File storage is closed.")
+
+// Locates the latest record of some key in the log of a FileStorage.
+//
+// The version, expiry time and removal time of the record are kept along with
+// its location, allowing preconditions and expiry to be checked without reading
+// the record. The removal time is only set for tombstones.
+type recordRef struct {
+	offset  int64
+	size    int64
+	version uint64
+	expires time.Time
+	deleted time.Time
+}
+
+func (ref *recordRef) expired(now time.Time) bool {
+	return !ref.expires.IsZero() && !now.Before(ref.expires)
+}
+
+// FileStorage provides durable storage, backed by an append-only log file.
+//
+// Every write is appended to the log as a record, while an in-memory index
+// maps each key to the location of its latest record. Opening a FileStorage
+// replays its log, rebuilding the index.
+//
+// As with MemoryStorage, expired entries are hidden from all operations until
+// removed using RemoveExpired. Records of replaced, removed and expired entries
+// remain in the log until it is compacted using Compact.
+type FileStorage struct {
+	mutex  sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	index  map[string]*recordRef
+	bits   int
+	policy SyncPolicy
+	dirty  bool
+	stop   chan struct{}
+
+	// Held while the log file must not be replaced, as it is when compacted.
+	compaction sync.Mutex
+}
+
+// OpenFileStorage opens the FileStorage logged to the file at given path,
+// creating the file if it does not exist. The storage holds keys of given
+// amount of bits.
+//
+// A partially written record at the end of the log, as left by a crash, is
+// discarded. A corrupt record followed by further records is not, however, as
+// that would discard the further records. Opening the storage fails instead,
+// leaving the log to be repaired.
+func OpenFileStorage(path string, bits int, policy SyncPolicy) (*FileStorage, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	storage := &FileStorage{
+		path:   path,
+		file:   file,
+		index:  map[string]*recordRef{},
+		bits:   bits,
+		policy: policy,
+		stop:   make(chan struct{}),
+	}
+	if err = storage.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if policy == SyncPeriodically {
+		go storage.syncPeriodically()
+	}
+	return storage, nil
+}
+
+// Reads all records of the log into the index, truncating the log after the
+// last valid record if it is followed only by a torn record.
+func (storage *FileStorage) replay() error {
+	info, err := storage.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(storage.file)
+	offset := int64(0)
+	for {
+		rec, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if end := offset + size; err != io.ErrUnexpectedEOF && end < info.Size() {
+				return fmt.Errorf("Log %s holds corrupt record at offset %d, followed by %d bytes of records: %v",
+					storage.path, offset, info.Size()-end, err)
+			}
+			if err = storage.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		indexRecord(storage.index, rec, offset, size)
+		offset += size
+	}
+	storage.size = offset
+	_, err = storage.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Adds record, located at given offset of the log and of given size, to index.
+func indexRecord(index map[string]*recordRef, rec *record, offset, size int64) {
+	if rec.Entry == nil {
+		delete(index, rec.Key)
+		return
+	}
+	ref := &recordRef{
+		offset:  offset,
+		size:    size,
+		version: rec.Entry.Version,
+		expires: rec.Entry.Expires,
+	}
+	if rec.Entry.Tombstone() {
+		ref.deleted = rec.Entry.Deleted
+	}
+	index[rec.Key] = ref
+}
+
+// Appends record to the log, and then adds it to the index.
+//
+// The storage mutex must be held by the caller.
+func (storage *FileStorage) append(rec *record) error {
+	if storage.file == nil {
+		return errFileStorageClosed
+	}
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = storage.file.WriteAt(buf, storage.size); err != nil {
+		return err
+	}
+	if storage.policy == SyncAlways {
+		if err = storage.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		storage.dirty = true
+	}
+	indexRecord(storage.index, rec, storage.size, int64(len(buf)))
+	storage.size += int64(len(buf))
+	return nil
+}
+
+// Resolves index reference of given key, unless expired.
+//
+// The storage mutex must be held by the caller.
+func (storage *FileStorage) live(skey string) *recordRef {
+	ref := storage.index[skey]
+	if ref == nil || ref.expired(time.Now()) {
+		return nil
+	}
+	return ref
+}
+
+// Reads entry associated with given key, unless expired.
+//
+// The storage mutex must be held by the caller.
+func (storage *FileStorage) read(skey string) (*Entry, error) {
+	ref := storage.live(skey)
+	if ref == nil {
+		return nil, ErrNotFound
+	}
+	if storage.file == nil {
+		return nil, errFileStorageClosed
+	}
+	reader := io.NewSectionReader(storage.file, ref.offset, ref.size)
+	rec, _, err := readRecord(reader)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Entry, nil
+}
+
+// Get attempts to get value associated with given key, if any.
+//
+// ErrNotFound is returned if no value is associated with the key.
+func (storage *FileStorage) Get(key *ID) ([]byte, error) {
+	entry, err := storage.GetEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry attempts to get value and metadata associated with given key.
+//
+// ErrNotFound is returned if no entry is associated with the key.
+func (storage *FileStorage) GetEntry(key *ID) (*Entry, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.read(key.String())
+}
+
+// GetKeyRange gets all keys that lexically located within [fromKey, toKey).
+func (storage *FileStorage) GetKeyRange(fromKey, toKey *ID) ([]*ID, error) {
+	return storage.keyRange(fromKey, toKey, false)
+}
+
+// Lists keys within [fromKey, toKey) in ring order, leaving out those of
+// expired entries and, if `live`, those of tombstones.
+func (storage *FileStorage) keyRange(fromKey, toKey *ID, live bool) ([]*ID, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
+	keys := []*ID{}
+	for skey, ref := range storage.index {
+		if ref.expired(now) || live && !ref.deleted.IsZero() {
+			continue
+		}
+		key, ok := ParseID(skey, fromKey.Bits())
+		if !ok {
+			return nil, fmt.Errorf("Illegal key in file storage: %s", skey)
+		}
+		if IDIntervalContainsIE(fromKey, toKey, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Diff(fromKey).Cmp(keys[j].Diff(fromKey)) < 0
+	})
+	return keys, nil
+}
+
+// GetAllKeys gets all keys held by storage.
+func (storage *FileStorage) GetAllKeys() ([]*ID, error) {
+	return storage.allKeys(false)
+}
+
+// Lists all keys in ascending order, leaving out those of expired entries
+// and, if `live`, those of tombstones.
+func (storage *FileStorage) allKeys(live bool) ([]*ID, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
+	keys := []*ID{}
+	for skey, ref := range storage.index {
+		if ref.expired(now) || live && !ref.deleted.IsZero() {
+			continue
+		}
+		key, ok := ParseID(skey, storage.bits)
+		if !ok {
+			return nil, fmt.Errorf("Illegal key in file storage: %s", skey)
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Cmp(keys[j]) < 0
+	})
+	return keys, nil
+}
+
+// Set stores provided key/value pair, potentially replacing an existing
+// such.
+func (storage *FileStorage) Set(key *ID, value []byte) error {
+	return storage.SetEntry(key, &Entry{Value: value})
+}
+
+// SetEntry stores provided key/entry pair, potentially replacing an existing
+// such.
+func (storage *FileStorage) SetEntry(key *ID, entry *Entry) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.append(&record{Key: key.String(), Entry: entry})
+}
+
+// CompareAndSetEntry stores provided key/entry pair only if the entry
+// currently associated with the key satisfies given precondition, in which
+// case the stored entry is given a version one larger than that of the
+// current entry.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *FileStorage) CompareAndSetEntry(key *ID, pre *Precondition, entry *Entry) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	skey := key.String()
+	current := storage.current(skey)
+	if !pre.Check(current) {
+		return ErrPreconditionFailed
+	}
+	stored := *entry
+	stored.Version = 1
+	if current != nil {
+		stored.Version = current.Version + 1
+	}
+	return storage.append(&record{Key: skey, Entry: &stored})
+}
+
+// ReplicateEntryContext stores provided key/entry pair as is, unless the
+// entry associated with the key is the same or a later version. Fails without
+// storing the pair if `ctx` is done.
+func (storage *FileStorage) ReplicateEntryContext(ctx context.Context, key *ID, entry *Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	skey := key.String()
+	existing, err := storage.read(skey)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if !entry.Supersedes(existing) {
+		return nil
+	}
+	return storage.append(&record{Key: skey, Entry: entry})
+}
+
+// Remove attempts to remove one key/value pair from store with a key
+// matching given.
+func (storage *FileStorage) Remove(key *ID) error {
+	return storage.CompareAndRemove(key, nil)
+}
+
+// CompareAndRemove removes the entry associated with given key only if it
+// satisfies given precondition.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *FileStorage) CompareAndRemove(key *ID, pre *Precondition) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	skey := key.String()
+	current := storage.current(skey)
+	if !pre.Check(current) {
+		return ErrPreconditionFailed
+	}
+	if _, ok := storage.index[skey]; !ok {
+		return nil
+	}
+	return storage.append(&record{Key: skey})
+}
+
+// GetContext is like Get, but fails without getting the value if `ctx` is
+// done.
+func (storage *FileStorage) GetContext(ctx context.Context, key *ID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.Get(key)
+}
+
+// GetEntryContext is like GetEntry, but fails without getting the entry if
+// `ctx` is done.
+func (storage *FileStorage) GetEntryContext(ctx context.Context, key *ID) (*Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.GetEntry(key)
+}
+
+// GetKeyRangeContext is like GetKeyRange, but fails without getting any keys
+// if `ctx` is done.
+func (storage *FileStorage) GetKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.GetKeyRange(fromKey, toKey)
+}
+
+// GetAllKeysContext is like GetAllKeys, but fails without getting any keys if
+// `ctx` is done.
+func (storage *FileStorage) GetAllKeysContext(ctx context.Context) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.GetAllKeys()
+}
+
+// GetLiveKeyRangeContext is like GetKeyRangeContext, but leaves out keys
+// associated with tombstones.
+func (storage *FileStorage) GetLiveKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.keyRange(fromKey, toKey, true)
+}
+
+// GetAllLiveKeysContext is like GetAllKeysContext, but leaves out keys
+// associated with tombstones.
+func (storage *FileStorage) GetAllLiveKeysContext(ctx context.Context) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.allKeys(true)
+}
+
+// SetContext is like Set, but fails without storing the pair if `ctx` is
+// done.
+func (storage *FileStorage) SetContext(ctx context.Context, key *ID, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.Set(key, value)
+}
+
+// SetEntryContext is like SetEntry, but fails without storing the pair if
+// `ctx` is done.
+func (storage *FileStorage) SetEntryContext(ctx context.Context, key *ID, entry *Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.SetEntry(key, entry)
+}
+
+// CompareAndSetEntryContext is like CompareAndSetEntry, but fails without
+// storing the pair if `ctx` is done.
+func (storage *FileStorage) CompareAndSetEntryContext(ctx context.Context, key *ID, pre *Precondition, entry *Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.CompareAndSetEntry(key, pre, entry)
+}
+
+// RemoveContext is like Remove, but fails without removing the pair if `ctx`
+// is done.
+func (storage *FileStorage) RemoveContext(ctx context.Context, key *ID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.Remove(key)
+}
+
+// CompareAndRemoveContext is like CompareAndRemove, but fails without
+// removing the entry if `ctx` is done.
+func (storage *FileStorage) CompareAndRemoveContext(ctx context.Context, key *ID, pre *Precondition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.CompareAndRemove(key, pre)
+}
+
+// Produces an entry holding only the version and removal time of the entry
+// associated with given key, which is all preconditions are checked against.
+//
+// The storage mutex must be held by the caller.
+func (storage *FileStorage) current(skey string) *Entry {
+	if ref := storage.live(skey); ref != nil {
+		return &Entry{Version: ref.version, Deleted: ref.deleted}
+	}
+	return nil
+}
+
+// RemoveExpired removes all entries expired at given time, returning the
+// amount of entries removed.
+//
+// Expired entries are only removed from the index, as they remain expired
+// when the log is replayed.
+func (storage *FileStorage) RemoveExpired(now time.Time) int {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	removed := 0
+	for skey, ref := range storage.index {
+		if ref.expired(now) {
+			delete(storage.index, skey)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Sync flushes all writes to disk.
+func (storage *FileStorage) Sync() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.sync()
+}
+
+func (storage *FileStorage) sync() error {
+	if storage.file == nil || !storage.dirty {
+		return nil
+	}
+	storage.dirty = false
+	return storage.file.Sync()
+}
+
+func (storage *FileStorage) syncPeriodically() {
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			storage.Sync()
+		case <-storage.stop:
+			return
+		}
+	}
+}
+
+// Close flushes all writes to disk and closes the log file. The storage may
+// not be used after being closed.
+func (storage *FileStorage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.file == nil {
+		return nil
+	}
+	close(storage.stop)
+	err := storage.sync()
+	if closeErr := storage.file.Close(); err == nil {
+		err = closeErr
+	}
+	storage.file = nil
+	return err
+}
+
+// Collects the keys of all entries not expired at given time, in order, along
+// with their index references.
+//
+// The storage mutex must be held by the caller.
+func (storage *FileStorage) liveRefs(now time.Time) ([]string, map[string]*recordRef) {
+	keys := make([]string, 0, len(storage.index))
+	refs := make(map[string]*recordRef, len(storage.index))
+	for skey, ref := range storage.index {
+		if ref.expired(now) {
+			continue
+		}
+		keys = append(keys, skey)
+		refs[skey] = ref
+	}
+	sort.Strings(keys)
+	return keys, refs
+}
+
+// Compact rewrites the log of storage into a new log holding only the records
+// of entries neither replaced, removed nor expired, which then atomically
+// replaces the old log.
+//
+// The storage remains usable while being compacted, as the records of the old
+// log are copied without holding the storage lock. Only records appended
+// while copying are copied while holding the lock, right before the new log
+// is swapped in.
+func (storage *FileStorage) Compact() error {
+	storage.compaction.Lock()
+	defer storage.compaction.Unlock()
+
+	storage.mutex.Lock()
+	file, size := storage.file, storage.size
+	keys, refs := storage.liveRefs(time.Now())
+	storage.mutex.Unlock()
+
+	if file == nil {
+		return errFileStorageClosed
+	}
+	path := storage.path + ".compact"
+	compacted, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			compacted.Close()
+			os.Remove(path)
+		}
+	}()
+
+	index := make(map[string]*recordRef, len(keys))
+	offset := int64(0)
+	for _, skey := range keys {
+		ref := refs[skey]
+		buf := make([]byte, ref.size)
+		if _, err = file.ReadAt(buf, ref.offset); err != nil {
+			return err
+		}
+		if _, err = compacted.WriteAt(buf, offset); err != nil {
+			return err
+		}
+		index[skey] = &recordRef{
+			offset:  offset,
+			size:    ref.size,
+			version: ref.version,
+			expires: ref.expires,
+			deleted: ref.deleted,
+		}
+		offset += ref.size
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.file != file {
+		return errFileStorageClosed
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, size, storage.size-size))
+	for {
+		rec, _, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		if _, err = compacted.WriteAt(buf, offset); err != nil {
+			return err
+		}
+		indexRecord(index, rec, offset, int64(len(buf)))
+		offset += int64(len(buf))
+	}
+	if err = compacted.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(path, storage.path); err != nil {
+		return err
+	}
+	swapped = true
+	file.Close()
+	storage.file = compacted
+	storage.size = offset
+	storage.index = index
+	storage.dirty = false
+	return syncDir(filepath.Dir(storage.path))
+}
+
+// Flushes directory entries of the identified directory to disk, making any
+// files renamed within it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// WriteSnapshot writes all entries of storage to `w`, as they are when
+// called.
+//
+// The snapshot consists of records in the same format as the log of the
+// storage, and can be read back using ReadSnapshot. Writes made while the
+// snapshot is being written are not part of it.
+func (storage *FileStorage) WriteSnapshot(w io.Writer) error {
+	storage.compaction.Lock()
+	defer storage.compaction.Unlock()
+
+	storage.mutex.Lock()
+	file := storage.file
+	keys, refs := storage.liveRefs(time.Now())
+	storage.mutex.Unlock()
+
+	if file == nil {
+		return errFileStorageClosed
+	}
+	for _, skey := range keys {
+		ref := refs[skey]
+		if _, err := io.Copy(w, io.NewSectionReader(file, ref.offset, ref.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSnapshot replaces all entries of storage with those of a snapshot
+// written by WriteSnapshot.
+//
+// Nothing is replaced if the snapshot is not valid.
+func (storage *FileStorage) ReadSnapshot(r io.Reader) error {
+	recs, err := readSnapshotRecords(r, storage.bits)
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	restored := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		restored[rec.Key] = true
+	}
+	for skey := range storage.index {
+		if restored[skey] {
+			continue
+		}
+		if err = storage.append(&record{Key: skey}); err != nil {
+			return err
+		}
+	}
+	for _, rec := range recs {
+		if err = storage.append(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
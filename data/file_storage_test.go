@@ -0,0 +1,303 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorageReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.log")
+
+	storage, err := OpenFileStorage(path, bits, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Set(newID64(1, 3), []byte("1"))
+	storage.Set(newID64(2, 3), []byte("2"))
+	storage.SetEntry(newID64(3, 3), &Entry{Value: []byte("3"), Expires: time.Now().Add(-time.Second)})
+	storage.CompareAndSetEntry(newID64(2, 3), &Precondition{IfMatch: "*"}, &Entry{Name: "two", Value: []byte("4")})
+	storage.Remove(newID64(1, 3))
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulates a crash while a record was being appended.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	file.Close()
+
+	storage, err = OpenFileStorage(path, bits, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if keys, _ := storage.GetAllKeys(); len(keys) != 1 {
+		t.Errorf("storage expected to hold 1 key, held %v.", keys)
+	}
+	if value, _ := storage.Get(newID64(1, 3)); value != nil {
+		t.Errorf("storage[1] expected to be removed, was %s.", value)
+	}
+	entry, err := storage.GetEntry(newID64(2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || string(entry.Value) != "4" || entry.Name != "two" || entry.Version != 1 {
+		t.Errorf("storage[2] expected to be two:4 at version 1, was %v.", entry)
+	}
+
+	// Records appended after the discarded one are readable once replayed.
+	storage.Set(newID64(5, 3), []byte("5"))
+	storage.Close()
+	if storage, err = OpenFileStorage(path, bits, SyncPeriodically); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if value, _ := storage.Get(newID64(5, 3)); string(value) != "5" {
+		t.Errorf("storage[5] expected to be 5, was %s.", value)
+	}
+}
+
+func TestFileStorageReplayCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.log")
+
+	storage, err := OpenFileStorage(path, bits, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Set(newID64(1, 3), []byte("1"))
+	storage.Set(newID64(2, 3), []byte("2"))
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupts the payload of the first of the two records.
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0}, recordHeaderSize+1)
+	info, _ := file.Stat()
+	file.Close()
+
+	// The storage fails to open rather than discarding the second record.
+	if storage, err = OpenFileStorage(path, bits, SyncNever); err == nil {
+		storage.Close()
+		t.Fatal("storage expected to fail to open.")
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("log expected to keep its size %d, was %d.", info.Size(), after.Size())
+	}
+
+	// Once the corrupt record is the last one, it is discarded as if torn.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, size, _ := readRecord(bytes.NewReader(buf))
+	if err = os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+	if storage, err = OpenFileStorage(path, bits, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if keys, _ := storage.GetAllKeys(); len(keys) != 0 {
+		t.Errorf("storage expected to hold no keys, held %v.", keys)
+	}
+}
+
+func TestFileStorageCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.log")
+
+	storage, err := OpenFileStorage(path, bits, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	for i := 0; i < 10; i++ {
+		storage.Set(newID64(1, 3), []byte{byte('0' + i)})
+		storage.Set(newID64(2, 3), []byte{byte('0' + i)})
+	}
+	storage.Remove(newID64(2, 3))
+	storage.SetEntry(newID64(3, 3), &Entry{Value: []byte("3"), Expires: time.Now().Add(-time.Second)})
+
+	before, _ := os.Stat(path)
+	if err = storage.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("log expected to shrink from %d bytes, was %d bytes.", before.Size(), after.Size())
+	}
+
+	storage.Set(newID64(4, 3), []byte("4"))
+	storage.Close()
+	if storage, err = OpenFileStorage(path, bits, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if keys, _ := storage.GetAllKeys(); len(keys) != 2 {
+		t.Errorf("storage expected to hold 2 keys, held %v.", keys)
+	}
+	if value, _ := storage.Get(newID64(1, 3)); string(value) != "9" {
+		t.Errorf("storage[1] expected to be 9, was %s.", value)
+	}
+	if value, _ := storage.Get(newID64(4, 3)); string(value) != "4" {
+		t.Errorf("storage[4] expected to be 4, was %s.", value)
+	}
+}
+
+func TestFileStorageSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenFileStorage(filepath.Join(dir, "storage.log"), bits, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	storage.Set(newID64(1, 3), []byte("1"))
+	storage.SetEntry(newID64(2, 3), &Entry{Name: "two", Value: []byte("2"), Clock: VectorClock{"a": 1}})
+
+	snapshot := &bytes.Buffer{}
+	if err = storage.WriteSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	storage.Set(newID64(1, 3), []byte("3"))
+	storage.Set(newID64(4, 3), []byte("4"))
+
+	memory := NewMemoryStorage(bits)
+	memory.Set(newID64(5, 3), []byte("5"))
+	for _, restored := range []SnapshottingStorage{storage, memory} {
+		if err = restored.ReadSnapshot(bytes.NewReader(snapshot.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		s := restored.(Storage)
+		if keys, _ := s.GetAllKeys(); len(keys) != 2 {
+			t.Errorf("%T expected to hold 2 keys, held %v.", s, keys)
+		}
+		if value, _ := s.Get(newID64(1, 3)); string(value) != "1" {
+			t.Errorf("%T[1] expected to be 1, was %s.", s, value)
+		}
+		entry, _ := s.GetEntry(newID64(2, 3))
+		if entry == nil || entry.Name != "two" || entry.Clock.Compare(VectorClock{"a": 1}) != Equal {
+			t.Errorf("%T[2] expected to be two:2 at a:1, was %v.", s, entry)
+		}
+	}
+
+	if err = memory.ReadSnapshot(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-1])); err == nil {
+		t.Error("Truncated snapshot expected to be rejected.")
+	}
+}
+
+func TestFileStorageRingOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenFileStorage(filepath.Join(dir, "storage.log"), bits, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	for _, i := range []int64{5, 1, 7, 3, 0} {
+		storage.Set(newID64(i, 3), []byte{byte('0' + i)})
+	}
+
+	expectKeys := func(keys []*ID, expected ...int64) {
+		if len(keys) != len(expected) {
+			t.Errorf("Keys %v expected to be %v.", keys, expected)
+			return
+		}
+		for i, key := range keys {
+			if !key.Eq(newID64(expected[i], 3)) {
+				t.Errorf("Keys %v expected to be %v.", keys, expected)
+				return
+			}
+		}
+	}
+	keys, _ := storage.GetAllKeys()
+	expectKeys(keys, 0, 1, 3, 5, 7)
+	keys, _ = storage.GetKeyRange(newID64(1, 3), newID64(5, 3))
+	expectKeys(keys, 1, 3)
+	keys, _ = storage.GetKeyRange(newID64(4, 3), newID64(2, 3))
+	expectKeys(keys, 5, 7, 0, 1)
+	keys, _ = storage.GetKeyRange(newID64(3, 3), newID64(3, 3))
+	expectKeys(keys, 3, 5, 7, 0, 1)
+}
+
+func TestFileStorageLiveKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenFileStorage(filepath.Join(dir, "storage.log"), bits, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	testLiveKeys(t, storage)
+}
+
+func TestFileStorageReplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-sky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenFileStorage(filepath.Join(dir, "storage.log"), bits, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	key := newID64(2, 3)
+	ctx := context.Background()
+
+	expectValue := func(expected string) {
+		if value, err := storage.Get(key); string(value) != expected {
+			t.Errorf("storage[2] expected to be %s, was %s (%v)", expected, value, err)
+		}
+	}
+	storage.ReplicateEntryContext(ctx, key, &Entry{Value: []byte("5"), Version: 5})
+	expectValue("5")
+	storage.ReplicateEntryContext(ctx, key, &Entry{Value: []byte("4"), Version: 4})
+	expectValue("5")
+	storage.ReplicateEntryContext(ctx, key, &Entry{Value: []byte("6"), Version: 6})
+	expectValue("6")
+	storage.ReplicateEntryContext(ctx, key, &Entry{Version: 6, Deleted: time.Now()})
+	if entry, err := storage.GetEntry(key); err != nil || !entry.Tombstone() {
+		t.Errorf("storage[2] expected to be replaced by tombstone of equal version, was %v (%v)", entry, err)
+	}
+}
@@ -11,7 +11,7 @@ type ID struct {
 // NewID creates from big integer and an amount of significant bits.
 func NewID(value *big.Int, bits int) *ID {
 	id := new(ID)
-	id.value = *value
+	id.value.Set(value)
 	id.bits = bits
 	id.truncate()
 	return id
@@ -1,77 +1,344 @@
 package data
 
 import (
-	"crypto/sha1"
-	"fmt"
+	"context"
+	"io"
+	"sync"
+	"time"
 )
 
 // MemoryStorage provides in-memory storage.
+//
+// Entries are kept ordered by key, making range queries take logarithmic time
+// and causing keys to be listed in ring order.
+//
+// Expired entries are hidden from all operations, but remain in memory until
+// removed using RemoveExpired.
 type MemoryStorage struct {
-	data map[string][]byte
+	mutex sync.Mutex
+	data  *skipList
+	bits  int
 }
 
-// NewMemoryStorage creates a new MemoryStorage instance.
-func NewMemoryStorage() *MemoryStorage {
+// NewMemoryStorage creates a new MemoryStorage instance, holding keys of given
+// amount of bits.
+func NewMemoryStorage(bits int) *MemoryStorage {
 	return &MemoryStorage{
-		data: map[string][]byte{},
+		data: newSkipList(),
+		bits: bits,
 	}
 }
 
 // Get attempts to get value associated with given key, if any.
 //
-// Acquiring a value of `nil` is not considered an error.
+// ErrNotFound is returned if no value is associated with the key.
 func (storage *MemoryStorage) Get(key *ID) ([]byte, error) {
-	return storage.data[key.String()], nil
+	entry, err := storage.GetEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry attempts to get value and metadata associated with given key.
+//
+// ErrNotFound is returned if no entry is associated with the key.
+func (storage *MemoryStorage) GetEntry(key *ID) (*Entry, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if entry := storage.live(key); entry != nil {
+		return entry, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Resolves entry associated with given key, unless expired.
+//
+// The storage mutex must be held by the caller.
+func (storage *MemoryStorage) live(key *ID) *Entry {
+	entry := storage.data.get(key)
+	if entry == nil || entry.Expired(time.Now()) {
+		return nil
+	}
+	return entry
 }
 
 // GetKeyRange gets all keys that lexically located within [fromKey, toKey).
+//
+// Keys are listed in ring order, starting at `fromKey`.
 func (storage *MemoryStorage) GetKeyRange(fromKey, toKey *ID) ([]*ID, error) {
+	return storage.keyRange(fromKey, toKey, false), nil
+}
+
+// Lists keys within [fromKey, toKey) in ring order, leaving out those of
+// expired entries and, if `live`, those of tombstones.
+func (storage *MemoryStorage) keyRange(fromKey, toKey *ID, live bool) []*ID {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
 	keys := []*ID{}
-	for skey := range storage.data {
-		key, ok := ParseID(skey, fromKey.Bits())
-		if !ok {
-			panic(fmt.Sprint("Illegal key in memory storage:", skey))
-		}
-		if IDIntervalContainsIE(fromKey, toKey, key) {
-			keys = append(keys, key)
+	storage.data.visitRange(fromKey, toKey, func(node *skipListNode) bool {
+		if !node.entry.Expired(now) && !(live && node.entry.Tombstone()) {
+			keys = append(keys, node.key)
 		}
-	}
-
-	return keys, nil
+		return true
+	})
+	return keys
 }
 
 // Set stores provided key/value pair, potentially replacing an existing
 // such.
 func (storage *MemoryStorage) Set(key *ID, value []byte) error {
-	storage.data[key.String()] = value
+	return storage.SetEntry(key, &Entry{Value: value})
+}
+
+// SetEntry stores provided key/entry pair, potentially replacing an existing
+// such.
+func (storage *MemoryStorage) SetEntry(key *ID, entry *Entry) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.data.set(key, entry)
+	return nil
+}
+
+// CompareAndSetEntry stores provided key/entry pair only if the entry
+// currently associated with the key satisfies given precondition, in which
+// case the stored entry is given a version one larger than that of the
+// current entry.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *MemoryStorage) CompareAndSetEntry(key *ID, pre *Precondition, entry *Entry) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	current := storage.live(key)
+	if !pre.Check(current) {
+		return ErrPreconditionFailed
+	}
+	stored := *entry
+	stored.Version = 1
+	if current != nil {
+		stored.Version = current.Version + 1
+	}
+	storage.data.set(key, &stored)
+	return nil
+}
+
+// ReplicateEntryContext stores provided key/entry pair as is, unless the
+// entry associated with the key is the same or a later version. Fails without
+// storing the pair if `ctx` is done.
+func (storage *MemoryStorage) ReplicateEntryContext(ctx context.Context, key *ID, entry *Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if entry.Supersedes(storage.live(key)) {
+		storage.data.set(key, entry)
+	}
 	return nil
 }
 
 // Remove attempts to remove one key/value pair from store with a key
 // matching given.
 func (storage *MemoryStorage) Remove(key *ID) error {
-	delete(storage.data, key.String())
+	return storage.CompareAndRemove(key, nil)
+}
+
+// CompareAndRemove removes the entry associated with given key only if it
+// satisfies given precondition.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *MemoryStorage) CompareAndRemove(key *ID, pre *Precondition) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if !pre.Check(storage.live(key)) {
+		return ErrPreconditionFailed
+	}
+	storage.data.remove(key)
 	return nil
 }
 
-// GetKeys gets all keys that are located on this storage node.
+// GetAllKeys gets all keys held by storage, in ascending order.
 func (storage *MemoryStorage) GetAllKeys() ([]*ID, error) {
-	keys := []*ID{}
-	for skey := range storage.data {
-		key, ok := parseID(skey)
-		if !ok {
-			panic(fmt.Sprint("Illegal key in memory storage:", skey))
+	return storage.allKeys(false), nil
+}
+
+// Lists all keys in ascending order, leaving out those of expired entries
+// and, if `live`, those of tombstones.
+func (storage *MemoryStorage) allKeys(live bool) []*ID {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
+	keys := make([]*ID, 0, storage.data.length)
+	for node := storage.data.first(); node != nil; node = node.following() {
+		if !node.entry.Expired(now) && !(live && node.entry.Tombstone()) {
+			keys = append(keys, node.key)
 		}
-		keys = append(keys, key)
 	}
-	return keys, nil
+	return keys
 }
 
-// Haidar's fix ;)
-const (
-	idBits = sha1.Size * 8
-)
+// GetContext is like Get, but fails without getting the value if `ctx` is
+// done.
+func (storage *MemoryStorage) GetContext(ctx context.Context, key *ID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.Get(key)
+}
 
-func parseID(s string) (*ID, bool) {
-	return ParseID(s, idBits)
+// GetEntryContext is like GetEntry, but fails without getting the entry if
+// `ctx` is done.
+func (storage *MemoryStorage) GetEntryContext(ctx context.Context, key *ID) (*Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.GetEntry(key)
+}
+
+// GetKeyRangeContext is like GetKeyRange, but fails without getting any keys
+// if `ctx` is done.
+func (storage *MemoryStorage) GetKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.GetKeyRange(fromKey, toKey)
+}
+
+// GetAllKeysContext is like GetAllKeys, but fails without getting any keys if
+// `ctx` is done.
+func (storage *MemoryStorage) GetAllKeysContext(ctx context.Context) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.GetAllKeys()
+}
+
+// GetLiveKeyRangeContext is like GetKeyRangeContext, but leaves out keys
+// associated with tombstones.
+func (storage *MemoryStorage) GetLiveKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.keyRange(fromKey, toKey, true), nil
+}
+
+// GetAllLiveKeysContext is like GetAllKeysContext, but leaves out keys
+// associated with tombstones.
+func (storage *MemoryStorage) GetAllLiveKeysContext(ctx context.Context) ([]*ID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return storage.allKeys(true), nil
+}
+
+// SetContext is like Set, but fails without storing the pair if `ctx` is
+// done.
+func (storage *MemoryStorage) SetContext(ctx context.Context, key *ID, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.Set(key, value)
+}
+
+// SetEntryContext is like SetEntry, but fails without storing the pair if
+// `ctx` is done.
+func (storage *MemoryStorage) SetEntryContext(ctx context.Context, key *ID, entry *Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.SetEntry(key, entry)
+}
+
+// CompareAndSetEntryContext is like CompareAndSetEntry, but fails without
+// storing the pair if `ctx` is done.
+func (storage *MemoryStorage) CompareAndSetEntryContext(ctx context.Context, key *ID, pre *Precondition, entry *Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.CompareAndSetEntry(key, pre, entry)
+}
+
+// RemoveContext is like Remove, but fails without removing the pair if `ctx`
+// is done.
+func (storage *MemoryStorage) RemoveContext(ctx context.Context, key *ID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.Remove(key)
+}
+
+// CompareAndRemoveContext is like CompareAndRemove, but fails without
+// removing the entry if `ctx` is done.
+func (storage *MemoryStorage) CompareAndRemoveContext(ctx context.Context, key *ID, pre *Precondition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.CompareAndRemove(key, pre)
+}
+
+// RemoveExpired removes all entries expired at given time, returning the
+// amount of entries removed.
+func (storage *MemoryStorage) RemoveExpired(now time.Time) int {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	expired := []*ID{}
+	for node := storage.data.first(); node != nil; node = node.following() {
+		if node.entry.Expired(now) {
+			expired = append(expired, node.key)
+		}
+	}
+	for _, key := range expired {
+		storage.data.remove(key)
+	}
+	return len(expired)
+}
+
+// WriteSnapshot writes all entries of storage to `w`, as they are when
+// called.
+//
+// The snapshot is written in the same format as those of FileStorage, and can
+// be read back using ReadSnapshot.
+func (storage *MemoryStorage) WriteSnapshot(w io.Writer) error {
+	storage.mutex.Lock()
+	now := time.Now()
+	recs := make([]*record, 0, storage.data.length)
+	for node := storage.data.first(); node != nil; node = node.following() {
+		if !node.entry.Expired(now) {
+			recs = append(recs, &record{Key: node.key.String(), Entry: node.entry})
+		}
+	}
+	storage.mutex.Unlock()
+
+	return writeSnapshotRecords(w, recs)
+}
+
+// ReadSnapshot replaces all entries of storage with those of a snapshot
+// written by WriteSnapshot.
+//
+// Nothing is replaced if the snapshot is not valid.
+func (storage *MemoryStorage) ReadSnapshot(r io.Reader) error {
+	recs, err := readSnapshotRecords(r, storage.bits)
+	if err != nil {
+		return err
+	}
+	data := newSkipList()
+	for _, rec := range recs {
+		key, _ := ParseID(rec.Key, storage.bits)
+		data.set(key, rec.Entry)
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.data = data
+	return nil
 }
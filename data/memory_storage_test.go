@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"sort"
 	"testing"
+	"time"
 )
 
 type keyList []*ID
@@ -20,7 +22,7 @@ func (lst keyList) Swap(i, j int) {
 }
 
 func TestMemoryStorage(t *testing.T) {
-	storage := NewMemoryStorage()
+	storage := NewMemoryStorage(bits)
 
 	id := func(i int64) *ID {
 		return newID64(i, 3)
@@ -94,3 +96,220 @@ func TestMemoryStorage(t *testing.T) {
 		}
 	}
 }
+
+func TestMemoryStorageEntry(t *testing.T) {
+	storage := NewMemoryStorage(bits)
+
+	key := newID64(5, 3)
+	storage.SetEntry(key, &Entry{
+		Name:  "five",
+		Value: []byte("5"),
+	})
+
+	entry, _ := storage.GetEntry(key)
+	if entry == nil {
+		t.Fatalf("storage[%s] expected to hold an entry.", key)
+	}
+	if entry.Name != "five" {
+		t.Errorf("storage[%s].Name expected to be five, was %s.", key, entry.Name)
+	}
+	if value, _ := storage.Get(key); string(value) != "5" {
+		t.Errorf("storage[%s] expected to be 5, was %s.", key, string(value))
+	}
+	if entry, _ := storage.GetEntry(newID64(6, 3)); entry != nil {
+		t.Errorf("storage[6] expected to be nil, was %v.", entry)
+	}
+}
+
+func TestMemoryStorageNotFound(t *testing.T) {
+	storage := NewMemoryStorage(bits)
+	key := newID64(1, 3)
+
+	if value, err := storage.Get(key); err != ErrNotFound {
+		t.Errorf("storage[1] expected to be not found, was %q %v.", value, err)
+	}
+	if entry, err := storage.GetEntry(key); err != ErrNotFound || entry != nil {
+		t.Errorf("storage[1] expected to be not found, was %v %v.", entry, err)
+	}
+
+	// An empty value is found, unlike a missing one.
+	storage.Set(key, []byte{})
+	if value, err := storage.Get(key); err != nil || len(value) != 0 {
+		t.Errorf("storage[1] expected to be empty, was %q %v.", value, err)
+	}
+
+	storage.Remove(key)
+	if value, err := storage.Get(key); err != ErrNotFound {
+		t.Errorf("storage[1] expected to be removed, was %q %v.", value, err)
+	}
+	if err := storage.CompareAndSetEntry(key, &Precondition{IfMatch: "*"}, &Entry{Value: []byte("1")}); err != ErrPreconditionFailed {
+		t.Errorf("CompareAndSetEntry expected to fail with %v for missing key, got %v.", ErrPreconditionFailed, err)
+	}
+
+	// Operations failing otherwise don't claim keys to be missing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := storage.GetEntryContext(ctx, key); err != context.Canceled {
+		t.Errorf("GetEntryContext expected to fail with %v once cancelled, got %v.", context.Canceled, err)
+	}
+}
+
+func TestMemoryStorageCompareAndSet(t *testing.T) {
+	storage := NewMemoryStorage(bits)
+	key := newID64(1, 3)
+
+	expectErr := func(err, expected error) {
+		if err != expected {
+			t.Errorf("Expected error %v, got %v.", expected, err)
+		}
+	}
+
+	expectErr(storage.CompareAndSetEntry(key, &Precondition{IfMatch: "*"}, &Entry{Value: []byte("0")}), ErrPreconditionFailed)
+	expectErr(storage.CompareAndSetEntry(key, &Precondition{IfNoneMatch: "*"}, &Entry{Value: []byte("1")}), nil)
+	expectErr(storage.CompareAndSetEntry(key, &Precondition{IfNoneMatch: "*"}, &Entry{Value: []byte("2")}), ErrPreconditionFailed)
+
+	entry, _ := storage.GetEntry(key)
+	if entry.Version != 1 || entry.ETag() != `"1"` {
+		t.Errorf("storage[%s] expected to have version 1, had %d.", key, entry.Version)
+	}
+
+	expectErr(storage.CompareAndSetEntry(key, &Precondition{IfMatch: `"0", "2"`}, &Entry{Value: []byte("3")}), ErrPreconditionFailed)
+	expectErr(storage.CompareAndSetEntry(key, &Precondition{IfMatch: `"0", "1"`}, &Entry{Value: []byte("4")}), nil)
+	if value, _ := storage.Get(key); string(value) != "4" {
+		t.Errorf("storage[%s] expected to be 4, was %s.", key, value)
+	}
+
+	expectErr(storage.CompareAndRemove(key, &Precondition{IfMatch: `"1"`}), ErrPreconditionFailed)
+	expectErr(storage.CompareAndRemove(key, &Precondition{IfMatch: `"2"`}), nil)
+	if entry, _ := storage.GetEntry(key); entry != nil {
+		t.Errorf("storage[%s] expected to be removed, was %v.", key, entry)
+	}
+}
+
+func TestMemoryStorageExpiry(t *testing.T) {
+	storage := NewMemoryStorage(bits)
+	now := time.Now()
+
+	storage.SetEntry(newID64(1, 3), &Entry{Value: []byte("1"), Expires: now.Add(-time.Second)})
+	storage.SetEntry(newID64(2, 3), &Entry{Value: []byte("2"), Expires: now.Add(time.Hour)})
+	storage.SetEntry(newID64(3, 3), &Entry{Value: []byte("3")})
+
+	if value, err := storage.Get(newID64(1, 3)); err != ErrNotFound {
+		t.Errorf("storage[1] expected to be expired, was %s %v.", value, err)
+	}
+	if value, _ := storage.Get(newID64(2, 3)); string(value) != "2" {
+		t.Errorf("storage[2] expected to be 2, was %s.", value)
+	}
+	if keys, _ := storage.GetKeyRange(newID64(0, 3), newID64(4, 3)); len(keys) != 2 {
+		t.Errorf("storage expected to hold 2 keys in [0, 4), held %v.", keys)
+	}
+	if err := storage.CompareAndSetEntry(newID64(1, 3), &Precondition{IfNoneMatch: "*"}, &Entry{Value: []byte("4")}); err != nil {
+		t.Errorf("storage[1] expected to be writable as absent, got %v.", err)
+	}
+
+	if removed := storage.RemoveExpired(now); removed != 0 {
+		t.Errorf("storage expected to remove 0 expired entries, removed %d.", removed)
+	}
+	storage.SetEntry(newID64(1, 3), &Entry{Value: []byte("1"), Expires: now.Add(-time.Second)})
+	if removed := storage.RemoveExpired(now.Add(2 * time.Hour)); removed != 2 {
+		t.Errorf("storage expected to remove 2 expired entries, removed %d.", removed)
+	}
+	if keys, _ := storage.GetAllKeys(); len(keys) != 1 {
+		t.Errorf("storage expected to hold 1 key, held %v.", keys)
+	}
+}
+
+func TestMemoryStorageRingOrder(t *testing.T) {
+	storage := NewMemoryStorage(bits)
+	for _, i := range []int64{5, 1, 7, 3, 0} {
+		storage.Set(newID64(i, 3), []byte{byte('0' + i)})
+	}
+
+	expectKeys := func(keys []*ID, expected ...int64) {
+		if len(keys) != len(expected) {
+			t.Errorf("Keys %v expected to be %v.", keys, expected)
+			return
+		}
+		for i, key := range keys {
+			if !key.Eq(newID64(expected[i], 3)) {
+				t.Errorf("Keys %v expected to be %v.", keys, expected)
+				return
+			}
+		}
+	}
+	keys, _ := storage.GetAllKeys()
+	expectKeys(keys, 0, 1, 3, 5, 7)
+	keys, _ = storage.GetKeyRange(newID64(1, 3), newID64(5, 3))
+	expectKeys(keys, 1, 3)
+	keys, _ = storage.GetKeyRange(newID64(4, 3), newID64(2, 3))
+	expectKeys(keys, 5, 7, 0, 1)
+	keys, _ = storage.GetKeyRange(newID64(3, 3), newID64(3, 3))
+	expectKeys(keys, 3, 5, 7, 0, 1)
+	keys, _ = storage.GetKeyRange(newID64(6, 3), newID64(7, 3))
+	expectKeys(keys)
+}
+
+func TestMemoryStorageLiveKeys(t *testing.T) {
+	testLiveKeys(t, NewMemoryStorage(bits))
+	testLiveKeys(t, NewVersionedStorage(NewMemoryStorage(bits)))
+}
+
+// Lists keys of given storage, expecting only the listings of live keys to
+// leave out tombstones.
+func testLiveKeys(t *testing.T, storage interface {
+	Storage
+	LiveKeyStorage
+}) {
+	ctx := context.Background()
+	storage.SetEntry(newID64(1, 3), &Entry{Value: []byte("1")})
+	storage.SetEntry(newID64(3, 3), &Entry{Deleted: time.Now()})
+	storage.SetEntry(newID64(5, 3), &Entry{Value: []byte("5")})
+
+	expectKeys := func(name string, keys []*ID, err error, expected ...int64) {
+		if err != nil {
+			t.Errorf("%T.%s failed: %v.", storage, name, err)
+			return
+		}
+		if len(keys) != len(expected) {
+			t.Errorf("%T.%s keys %v expected to be %v.", storage, name, keys, expected)
+			return
+		}
+		for i, key := range keys {
+			if !key.Eq(newID64(expected[i], 3)) {
+				t.Errorf("%T.%s keys %v expected to be %v.", storage, name, keys, expected)
+				return
+			}
+		}
+	}
+	keys, err := storage.GetAllKeysContext(ctx)
+	expectKeys("GetAllKeysContext", keys, err, 1, 3, 5)
+	keys, err = storage.GetAllLiveKeysContext(ctx)
+	expectKeys("GetAllLiveKeysContext", keys, err, 1, 5)
+	keys, err = storage.GetKeyRangeContext(ctx, newID64(3, 3), newID64(2, 3))
+	expectKeys("GetKeyRangeContext", keys, err, 3, 5, 1)
+	keys, err = storage.GetLiveKeyRangeContext(ctx, newID64(3, 3), newID64(2, 3))
+	expectKeys("GetLiveKeyRangeContext", keys, err, 5, 1)
+}
+
+func TestMemoryStorageContext(t *testing.T) {
+	storage := NewMemoryStorage(bits)
+	key := newID64(1, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := storage.SetContext(ctx, key, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := storage.SetContext(ctx, key, []byte("2")); err != context.Canceled {
+		t.Errorf("SetContext expected to fail with %v once cancelled, got %v", context.Canceled, err)
+	}
+	if _, err := storage.GetContext(ctx, key); err != context.Canceled {
+		t.Errorf("GetContext expected to fail with %v once cancelled, got %v", context.Canceled, err)
+	}
+	if err := storage.CompareAndRemoveContext(ctx, key, nil); err != context.Canceled {
+		t.Errorf("CompareAndRemoveContext expected to fail with %v once cancelled, got %v", context.Canceled, err)
+	}
+	if value, err := storage.Get(key); err != nil || string(value) != "1" {
+		t.Errorf("storage[%s] expected to be 1 after cancelled operations, was %s (%v)", key, value, err)
+	}
+}
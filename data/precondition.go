@@ -0,0 +1,58 @@
+package data
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrPreconditionFailed is returned by conditional storage operations whose
+// preconditions are not satisfied.
+var ErrPreconditionFailed = errors.New("Precondition failed.")
+
+// Precondition that must be satisfied by the entry currently associated with
+// some key for a conditional write to take place.
+//
+// Conditions are expressed like the HTTP `If-Match` and `If-None-Match`
+// headers, as either `*` or a comma-separated list of entity tags produced by
+// Entry.ETag. Empty conditions are always satisfied.
+type Precondition struct {
+	// IfMatch requires an entry to exist, having any of the listed tags.
+	IfMatch string
+
+	// IfNoneMatch requires that no entry exists with any of the listed tags.
+	IfNoneMatch string
+}
+
+// Check determines whether given current entry, which may be `nil`,
+// satisfies precondition. A `nil` precondition is always satisfied.
+//
+// Tombstones are considered not to exist.
+func (pre *Precondition) Check(current *Entry) bool {
+	if pre == nil {
+		return true
+	}
+	if current.Tombstone() {
+		current = nil
+	}
+	if len(pre.IfMatch) > 0 && !matchesETag(pre.IfMatch, current) {
+		return false
+	}
+	if len(pre.IfNoneMatch) > 0 && matchesETag(pre.IfNoneMatch, current) {
+		return false
+	}
+	return true
+}
+
+func matchesETag(condition string, current *Entry) bool {
+	if current == nil {
+		return false
+	}
+	etag := current.ETag()
+	for _, token := range strings.Split(condition, ",") {
+		token = strings.TrimPrefix(strings.TrimSpace(token), "W/")
+		if token == "*" || token == etag {
+			return true
+		}
+	}
+	return false
+}
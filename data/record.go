@@ -0,0 +1,96 @@
+package data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A single write of some entry, as kept in the log of a FileStorage and in
+// snapshots.
+type record struct {
+	Key string
+
+	// Entry holds the written entry, or `nil` if the key was removed.
+	Entry *Entry
+}
+
+// Size of the header preceding each encoded record, holding the length and the
+// CRC-32 checksum of the record.
+const recordHeaderSize = 8
+
+var errRecordChecksum = errors.New("Record checksum mismatch.")
+
+// Encodes record, prefixed by its header.
+func encodeRecord(rec *record) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...), nil
+}
+
+// Reads the next record encoded by encodeRecord, returning it along with its
+// encoded size.
+//
+// io.EOF is returned only if there are no more records to read, while
+// io.ErrUnexpectedEOF is returned if a record is cut short. The encoded size
+// is also returned along with errors of records that are not cut short.
+func readRecord(reader io.Reader) (*record, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	size := int64(len(header) + len(payload))
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, size, errRecordChecksum
+	}
+	rec := &record{}
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, size, err
+	}
+	return rec, size, nil
+}
+
+// Reads all records of a snapshot, failing if any record is cut short,
+// corrupt or does not hold an entry with a valid key of given amount of bits.
+func readSnapshotRecords(reader io.Reader, bits int) ([]*record, error) {
+	recs := []*record{}
+	for {
+		rec, _, err := readRecord(reader)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := ParseID(rec.Key, bits); !ok || rec.Entry == nil || key.String() != rec.Key {
+			return nil, fmt.Errorf("Illegal record in snapshot: %s", rec.Key)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// Writes given records to `w`, in order.
+func writeSnapshotRecords(w io.Writer, recs []*record) error {
+	for _, rec := range recs {
+		buf, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
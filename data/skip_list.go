@@ -0,0 +1,150 @@
+package data
+
+import "math/rand"
+
+const (
+	// Maximum amount of levels of a skip list, allowing some 4^16 entries to
+	// be held while retaining logarithmic lookups.
+	skipListMaxLevel = 16
+
+	// Probability of a skip list node being promoted to the next level.
+	skipListP = 0.25
+)
+
+// An ordered map of IDs to entries, implemented as a skip list.
+//
+// Lookups, insertions and removals take O(log n) time, while ordered iteration
+// from any key takes O(log n) time to begin and then constant time per key.
+type skipList struct {
+	head   skipListNode
+	level  int
+	length int
+}
+
+type skipListNode struct {
+	key   *ID
+	entry *Entry
+	next  []*skipListNode
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head: skipListNode{
+			next: make([]*skipListNode, skipListMaxLevel),
+		},
+		level: 1,
+	}
+}
+
+// Finds the last node of each level with a key less than given, which are the
+// nodes preceding the location of the key in each level.
+func (list *skipList) predecessors(key *ID) []*skipListNode {
+	preds := make([]*skipListNode, skipListMaxLevel)
+	node := &list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key.Cmp(key) < 0 {
+			node = node.next[i]
+		}
+		preds[i] = node
+	}
+	return preds
+}
+
+// Resolves the first node with a key equal to or larger than given, or `nil`
+// if no such node exists.
+func (list *skipList) seek(key *ID) *skipListNode {
+	node := &list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key.Cmp(key) < 0 {
+			node = node.next[i]
+		}
+	}
+	return node.next[0]
+}
+
+// Resolves the node with the smallest key, or `nil` if the list is empty.
+func (list *skipList) first() *skipListNode {
+	return list.head.next[0]
+}
+
+// Resolves the node following this one, in key order.
+func (node *skipListNode) following() *skipListNode {
+	return node.next[0]
+}
+
+func (list *skipList) get(key *ID) *Entry {
+	if node := list.seek(key); node != nil && node.key.Eq(key) {
+		return node.entry
+	}
+	return nil
+}
+
+func (list *skipList) set(key *ID, entry *Entry) {
+	preds := list.predecessors(key)
+	if node := preds[0].next[0]; node != nil && node.key.Eq(key) {
+		node.entry = entry
+		return
+	}
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	if level > list.level {
+		for i := list.level; i < level; i++ {
+			preds[i] = &list.head
+		}
+		list.level = level
+	}
+	node := &skipListNode{
+		key:   NewID(key.BigInt(), key.Bits()),
+		entry: entry,
+		next:  make([]*skipListNode, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = preds[i].next[i]
+		preds[i].next[i] = node
+	}
+	list.length++
+}
+
+// Removes node with given key, returning whether any such node existed.
+func (list *skipList) remove(key *ID) bool {
+	preds := list.predecessors(key)
+	node := preds[0].next[0]
+	if node == nil || !node.key.Eq(key) {
+		return false
+	}
+	for i := 0; i < len(node.next); i++ {
+		preds[i].next[i] = node.next[i]
+	}
+	for list.level > 1 && list.head.next[list.level-1] == nil {
+		list.level--
+	}
+	list.length--
+	return true
+}
+
+// Calls `f` with each node with a key within [fromKey, toKey), in ring order
+// starting at `fromKey`. If `fromKey` equals `toKey` all nodes are visited.
+//
+// Iteration stops early if `f` returns false.
+func (list *skipList) visitRange(fromKey, toKey *ID, f func(node *skipListNode) bool) {
+	if fromKey.Cmp(toKey) < 0 {
+		for node := list.seek(fromKey); node != nil && node.key.Cmp(toKey) < 0; node = node.following() {
+			if !f(node) {
+				return
+			}
+		}
+		return
+	}
+	for node := list.seek(fromKey); node != nil; node = node.following() {
+		if !f(node) {
+			return
+		}
+	}
+	for node := list.first(); node != nil && node.key.Cmp(toKey) < 0 && node.key.Cmp(fromKey) < 0; node = node.following() {
+		if !f(node) {
+			return
+		}
+	}
+}
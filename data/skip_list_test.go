@@ -0,0 +1,50 @@
+package data
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	list := newSkipList()
+	expected := map[int64]*Entry{}
+
+	for i := 0; i < 2000; i++ {
+		key := rand.Int63n(256)
+		if rand.Intn(3) == 0 {
+			_, existed := expected[key]
+			if removed := list.remove(newID64(key, 8)); removed != existed {
+				t.Fatalf("list.remove(%d) %v != %v", key, removed, existed)
+			}
+			delete(expected, key)
+			continue
+		}
+		entry := &Entry{Version: uint64(i)}
+		list.set(newID64(key, 8), entry)
+		expected[key] = entry
+	}
+
+	if list.length != len(expected) {
+		t.Errorf("list.length %d != %d", list.length, len(expected))
+	}
+	var previous *ID
+	count := 0
+	for node := list.first(); node != nil; node = node.following() {
+		if previous != nil && previous.Cmp(node.key) >= 0 {
+			t.Fatalf("list keys %v and %v out of order", previous, node.key)
+		}
+		if node.entry != expected[node.key.BigInt().Int64()] {
+			t.Errorf("list[%v] holds unexpected entry", node.key)
+		}
+		previous = node.key
+		count++
+	}
+	if count != len(expected) {
+		t.Errorf("list holds %d nodes, expected %d", count, len(expected))
+	}
+	for key, entry := range expected {
+		if list.get(newID64(key, 8)) != entry {
+			t.Errorf("list.get(%d) holds unexpected entry", key)
+		}
+	}
+}
@@ -1,20 +1,152 @@
 package data
 
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
 // Storage of ID keys and byte array values.
+//
+// Tombstones, being entries marking removed keys, are held and returned like
+// any other entries. It is up to the users of a storage to create them and to
+// treat them as absent keys.
 type Storage interface {
 	// Get attempts to get value associated with given key.
 	//
-	// Acquiring a value of `nil` is not considered an error.
+	// ErrNotFound is returned if no value is associated with the key.
 	Get(key *ID) ([]byte, error)
 
+	// GetContext is like Get, but fails if `ctx` is done before the value is
+	// got.
+	GetContext(ctx context.Context, key *ID) ([]byte, error)
+
+	// GetEntry attempts to get value and metadata associated with given key.
+	//
+	// ErrNotFound is returned if no entry is associated with the key.
+	GetEntry(key *ID) (*Entry, error)
+
+	// GetEntryContext is like GetEntry, but fails if `ctx` is done before the
+	// entry is got.
+	GetEntryContext(ctx context.Context, key *ID) (*Entry, error)
+
 	// GetKeyRange gets all keys that lexically located within [fromKey, toKey).
 	GetKeyRange(fromKey, toKey *ID) ([]*ID, error)
 
+	// GetKeyRangeContext is like GetKeyRange, but fails if `ctx` is done
+	// before the keys are got.
+	GetKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error)
+
+	// GetAllKeys gets all keys held by storage.
+	GetAllKeys() ([]*ID, error)
+
+	// GetAllKeysContext is like GetAllKeys, but fails if `ctx` is done before
+	// the keys are got.
+	GetAllKeysContext(ctx context.Context) ([]*ID, error)
+
 	// Set stores provided key/value pair, potentially replacing an existing
 	// such.
 	Set(key *ID, value []byte) error
 
+	// SetContext is like Set, but fails if `ctx` is done before the pair is
+	// stored.
+	SetContext(ctx context.Context, key *ID, value []byte) error
+
+	// SetEntry stores provided key/entry pair, potentially replacing an
+	// existing such.
+	SetEntry(key *ID, entry *Entry) error
+
+	// SetEntryContext is like SetEntry, but fails if `ctx` is done before the
+	// pair is stored.
+	SetEntryContext(ctx context.Context, key *ID, entry *Entry) error
+
+	// CompareAndSetEntry stores provided key/entry pair only if the entry
+	// currently associated with the key satisfies given precondition, in
+	// which case the stored entry is given a version one larger than that of
+	// the current entry.
+	//
+	// ErrPreconditionFailed is returned if the precondition is not satisfied.
+	CompareAndSetEntry(key *ID, pre *Precondition, entry *Entry) error
+
+	// CompareAndSetEntryContext is like CompareAndSetEntry, but fails if
+	// `ctx` is done before the pair is stored.
+	CompareAndSetEntryContext(ctx context.Context, key *ID, pre *Precondition, entry *Entry) error
+
 	// Remove attempts to remove one key/value pair from store with a key
 	// matching given.
 	Remove(key *ID) error
+
+	// RemoveContext is like Remove, but fails if `ctx` is done before the
+	// pair is removed.
+	RemoveContext(ctx context.Context, key *ID) error
+
+	// CompareAndRemove removes the entry associated with given key only if it
+	// satisfies given precondition.
+	//
+	// ErrPreconditionFailed is returned if the precondition is not satisfied.
+	CompareAndRemove(key *ID, pre *Precondition) error
+
+	// CompareAndRemoveContext is like CompareAndRemove, but fails if `ctx` is
+	// done before the entry is removed.
+	CompareAndRemoveContext(ctx context.Context, key *ID, pre *Precondition) error
+}
+
+// ExpiringStorage is implemented by storages holding entries that may expire,
+// which are able to remove such entries once expired.
+type ExpiringStorage interface {
+	// RemoveExpired removes all entries expired at given time, returning the
+	// amount of entries removed.
+	RemoveExpired(now time.Time) int
+}
+
+// ReplicaStorage is implemented by storages holding replicas of entries
+// written elsewhere, which are able to store such entries only if superseding
+// those already held.
+type ReplicaStorage interface {
+	// ReplicateEntryContext stores provided key/entry pair as is, unless the
+	// entry associated with the key is the same or a later version, as
+	// determined by Entry.Supersedes. The entries are compared and replaced
+	// atomically. Fails if `ctx` is done before the pair is stored.
+	ReplicateEntryContext(ctx context.Context, key *ID, entry *Entry) error
+}
+
+// LiveKeyStorage is implemented by storages able to list their keys leaving
+// out those of tombstones, without reading the entries of the keys.
+type LiveKeyStorage interface {
+	// GetLiveKeyRangeContext is like Storage.GetKeyRangeContext, but leaves
+	// out keys associated with tombstones.
+	GetLiveKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error)
+
+	// GetAllLiveKeysContext is like Storage.GetAllKeysContext, but leaves out
+	// keys associated with tombstones.
+	GetAllLiveKeysContext(ctx context.Context) ([]*ID, error)
+}
+
+// ErrNotFound is returned when attempting to get a key not held by some
+// storage.
+var ErrNotFound = errors.New("Key not found.")
+
+// ErrNotSupported is returned when attempting an operation not supported by
+// some storage.
+var ErrNotSupported = errors.New("Operation not supported by storage.")
+
+// CompactingStorage is implemented by storages able to reclaim the space
+// occupied by replaced, removed and expired entries.
+type CompactingStorage interface {
+	// Compact reclaims the space occupied by replaced, removed and expired
+	// entries.
+	Compact() error
+}
+
+// SnapshottingStorage is implemented by storages able to write and read back
+// point-in-time snapshots of their entries.
+type SnapshottingStorage interface {
+	// WriteSnapshot writes all entries of storage to `w`, as they are when
+	// called.
+	WriteSnapshot(w io.Writer) error
+
+	// ReadSnapshot replaces all entries of storage with those of a snapshot
+	// written by WriteSnapshot.
+	ReadSnapshot(r io.Reader) error
 }
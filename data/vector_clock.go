@@ -0,0 +1,124 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VectorClock tracks causality between versions of some value by counting
+// the writes coordinated by each node, identified by its canonical ID string.
+//
+// A `nil` clock is valid and considered empty.
+type VectorClock map[string]uint64
+
+// Ordering describes how two vector clocks relate to each other.
+type Ordering int
+
+const (
+	// Equal clocks describe the same version.
+	Equal Ordering = iota
+
+	// Before means that a clock describes an ancestor of another.
+	Before
+
+	// After means that a clock describes a descendant of another.
+	After
+
+	// Concurrent clocks describe versions neither descending from the other.
+	Concurrent
+)
+
+// ParseVectorClock parses string produced by VectorClock.String.
+func ParseVectorClock(s string) (VectorClock, error) {
+	clock := VectorClock{}
+	if len(s) == 0 {
+		return clock, nil
+	}
+	for _, token := range strings.Split(s, ",") {
+		pair := strings.SplitN(token, ":", 2)
+		if len(pair) != 2 || len(pair[0]) == 0 {
+			return nil, fmt.Errorf("Invalid vector clock entry `%s`.", token)
+		}
+		counter, err := strconv.ParseUint(pair[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid vector clock entry `%s`.", token)
+		}
+		clock[pair[0]] = counter
+	}
+	return clock, nil
+}
+
+// Copy creates a copy of clock.
+func (clock VectorClock) Copy() VectorClock {
+	c := make(VectorClock, len(clock))
+	for node, counter := range clock {
+		c[node] = counter
+	}
+	return c
+}
+
+// Increment creates a copy of clock with the counter of given node increased
+// by one.
+func (clock VectorClock) Increment(node string) VectorClock {
+	c := clock.Copy()
+	c[node]++
+	return c
+}
+
+// Merge creates a clock holding the largest counters of clock and other,
+// which describes a version descending from both.
+func (clock VectorClock) Merge(other VectorClock) VectorClock {
+	c := clock.Copy()
+	for node, counter := range other {
+		if counter > c[node] {
+			c[node] = counter
+		}
+	}
+	return c
+}
+
+// Compare determines how clock relates to other.
+func (clock VectorClock) Compare(other VectorClock) Ordering {
+	before, after := false, false
+	for node, counter := range clock {
+		if counter > other[node] {
+			after = true
+		}
+	}
+	for node, counter := range other {
+		if counter > clock[node] {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return Concurrent
+	case before:
+		return Before
+	case after:
+		return After
+	}
+	return Equal
+}
+
+// String produces a canonical string representation of clock, listing its
+// counters as comma-separated `node:counter` pairs ordered by node.
+func (clock VectorClock) String() string {
+	nodes := make([]string, 0, len(clock))
+	for node := range clock {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	buf := &bytes.Buffer{}
+	for i, node := range nodes {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s:%d", node, clock[node])
+	}
+	return buf.String()
+}
@@ -0,0 +1,73 @@
+package data
+
+import "testing"
+
+func TestVectorClockCompare(t *testing.T) {
+	a := VectorClock{}.Increment("a")
+	ab := a.Increment("b")
+	aa := a.Increment("a")
+
+	expectOrdering := func(x, y VectorClock, expected Ordering) {
+		if actual := x.Compare(y); actual != expected {
+			t.Errorf("%v.Compare(%v) %v != %v", x, y, actual, expected)
+		}
+	}
+	expectOrdering(a, a, Equal)
+	expectOrdering(nil, VectorClock{}, Equal)
+	expectOrdering(nil, a, Before)
+	expectOrdering(a, ab, Before)
+	expectOrdering(ab, a, After)
+	expectOrdering(aa, ab, Concurrent)
+	expectOrdering(aa.Merge(ab), ab, After)
+}
+
+func TestVectorClockString(t *testing.T) {
+	clock := VectorClock{"b": 2, "a": 10}
+	if s := clock.String(); s != "a:10,b:2" {
+		t.Errorf("%v.String() %s != a:10,b:2", clock, s)
+	}
+	parsed, err := ParseVectorClock(clock.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Compare(clock) != Equal {
+		t.Errorf("ParseVectorClock(%v) %v != %v", clock, parsed, clock)
+	}
+	if _, err := ParseVectorClock("a:1,b"); err == nil {
+		t.Error("ParseVectorClock(a:1,b) expected to fail.")
+	}
+}
+
+func TestVersionedStorage(t *testing.T) {
+	storage := NewVersionedStorage(NewMemoryStorage(bits))
+	key := newID64(1, 3)
+
+	a := VectorClock{}.Increment("a")
+	storage.SetEntry(key, &Entry{Value: []byte("1"), Clock: a})
+	storage.SetEntry(key, &Entry{Value: []byte("2"), Clock: a.Increment("a")})
+
+	entry, _ := storage.GetEntry(key)
+	if string(entry.Value) != "2" || len(entry.Siblings) != 0 {
+		t.Errorf("storage[%s] expected to be 2 without siblings, was %s with %d.", key, entry.Value, len(entry.Siblings))
+	}
+
+	// Stale version is discarded.
+	storage.SetEntry(key, &Entry{Value: []byte("0"), Clock: a})
+	if entry, _ = storage.GetEntry(key); string(entry.Value) != "2" {
+		t.Errorf("storage[%s] expected to be 2, was %s.", key, entry.Value)
+	}
+
+	// Concurrent version is kept as sibling.
+	storage.SetEntry(key, &Entry{Value: []byte("3"), Clock: a.Increment("b")})
+	entry, _ = storage.GetEntry(key)
+	if versions := entry.Versions(); len(versions) != 2 {
+		t.Fatalf("storage[%s] expected to hold 2 versions, held %d.", key, len(versions))
+	}
+
+	// Version written with context of both siblings resolves them.
+	storage.SetEntry(key, &Entry{Value: []byte("4"), Clock: entry.Context().Increment("a")})
+	entry, _ = storage.GetEntry(key)
+	if string(entry.Value) != "4" || len(entry.Siblings) != 0 {
+		t.Errorf("storage[%s] expected to be 4 without siblings, was %s with %d.", key, entry.Value, len(entry.Siblings))
+	}
+}
@@ -0,0 +1,241 @@
+package data
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// VersionedStorage wraps some other storage, merging entries written to it
+// with any versions already stored rather than replacing them.
+//
+// Versions descending from other versions replace those, while concurrent
+// versions are kept as siblings. See MergeEntries.
+type VersionedStorage struct {
+	storage Storage
+}
+
+// NewVersionedStorage creates a new VersionedStorage, keeping its entries in
+// given storage.
+func NewVersionedStorage(storage Storage) *VersionedStorage {
+	return &VersionedStorage{
+		storage: storage,
+	}
+}
+
+// Get attempts to get value associated with given key.
+//
+// Only the value of the first version is returned if there are siblings.
+// ErrNotFound is returned if no value is associated with the key.
+func (storage *VersionedStorage) Get(key *ID) ([]byte, error) {
+	return storage.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but fails if `ctx` is done before the value is got.
+func (storage *VersionedStorage) GetContext(ctx context.Context, key *ID) ([]byte, error) {
+	return storage.storage.GetContext(ctx, key)
+}
+
+// GetEntry attempts to get value and metadata associated with given key.
+//
+// ErrNotFound is returned if no entry is associated with the key.
+func (storage *VersionedStorage) GetEntry(key *ID) (*Entry, error) {
+	return storage.GetEntryContext(context.Background(), key)
+}
+
+// GetEntryContext is like GetEntry, but fails if `ctx` is done before the
+// entry is got.
+func (storage *VersionedStorage) GetEntryContext(ctx context.Context, key *ID) (*Entry, error) {
+	return storage.storage.GetEntryContext(ctx, key)
+}
+
+// GetKeyRange gets all keys that lexically located within [fromKey, toKey).
+func (storage *VersionedStorage) GetKeyRange(fromKey, toKey *ID) ([]*ID, error) {
+	return storage.GetKeyRangeContext(context.Background(), fromKey, toKey)
+}
+
+// GetKeyRangeContext is like GetKeyRange, but fails if `ctx` is done before
+// the keys are got.
+func (storage *VersionedStorage) GetKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error) {
+	return storage.storage.GetKeyRangeContext(ctx, fromKey, toKey)
+}
+
+// GetAllKeys gets all keys held by storage.
+func (storage *VersionedStorage) GetAllKeys() ([]*ID, error) {
+	return storage.GetAllKeysContext(context.Background())
+}
+
+// GetAllKeysContext is like GetAllKeys, but fails if `ctx` is done before the
+// keys are got.
+func (storage *VersionedStorage) GetAllKeysContext(ctx context.Context) ([]*ID, error) {
+	return storage.storage.GetAllKeysContext(ctx)
+}
+
+// GetLiveKeyRangeContext gets the keys of the wrapped storage within
+// [fromKey, toKey), leaving out keys associated with tombstones.
+//
+// ErrNotSupported is returned if the wrapped storage is not a LiveKeyStorage.
+func (storage *VersionedStorage) GetLiveKeyRangeContext(ctx context.Context, fromKey, toKey *ID) ([]*ID, error) {
+	if live, ok := storage.storage.(LiveKeyStorage); ok {
+		return live.GetLiveKeyRangeContext(ctx, fromKey, toKey)
+	}
+	return nil, ErrNotSupported
+}
+
+// GetAllLiveKeysContext gets all keys of the wrapped storage, leaving out keys
+// associated with tombstones.
+//
+// ErrNotSupported is returned if the wrapped storage is not a LiveKeyStorage.
+func (storage *VersionedStorage) GetAllLiveKeysContext(ctx context.Context) ([]*ID, error) {
+	if live, ok := storage.storage.(LiveKeyStorage); ok {
+		return live.GetAllLiveKeysContext(ctx)
+	}
+	return nil, ErrNotSupported
+}
+
+// Set stores provided key/value pair as an unversioned entry, which is
+// merged with any existing versions.
+func (storage *VersionedStorage) Set(key *ID, value []byte) error {
+	return storage.SetContext(context.Background(), key, value)
+}
+
+// SetContext is like Set, but fails if `ctx` is done before the pair is
+// stored.
+func (storage *VersionedStorage) SetContext(ctx context.Context, key *ID, value []byte) error {
+	return storage.SetEntryContext(ctx, key, &Entry{Value: value})
+}
+
+// SetEntry merges provided entry with any existing versions associated with
+// given key.
+//
+// The merge is retried if the existing entry is replaced while being merged,
+// which prevents concurrently written versions from being lost.
+func (storage *VersionedStorage) SetEntry(key *ID, entry *Entry) error {
+	return storage.SetEntryContext(context.Background(), key, entry)
+}
+
+// SetEntryContext is like SetEntry, but stops retrying the merge once `ctx` is
+// done.
+func (storage *VersionedStorage) SetEntryContext(ctx context.Context, key *ID, entry *Entry) error {
+	for {
+		err := storage.CompareAndSetEntryContext(ctx, key, nil, entry)
+		if err != ErrPreconditionFailed {
+			return err
+		}
+	}
+}
+
+// CompareAndSetEntry merges provided entry with any existing versions
+// associated with given key, but only if the existing entry satisfies given
+// precondition.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied, or
+// if the existing entry is replaced while being merged.
+func (storage *VersionedStorage) CompareAndSetEntry(key *ID, pre *Precondition, entry *Entry) error {
+	return storage.CompareAndSetEntryContext(context.Background(), key, pre, entry)
+}
+
+// CompareAndSetEntryContext is like CompareAndSetEntry, but fails if `ctx` is
+// done before the merged entry is stored.
+func (storage *VersionedStorage) CompareAndSetEntryContext(ctx context.Context, key *ID, pre *Precondition, entry *Entry) error {
+	existing, err := storage.storage.GetEntryContext(ctx, key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if !pre.Check(existing) {
+		return ErrPreconditionFailed
+	}
+	// Makes sure the existing entry is still there when replaced. Tombstones
+	// cannot be matched, as preconditions consider them not to exist.
+	exact := &Precondition{IfNoneMatch: "*"}
+	if existing != nil && !existing.Tombstone() {
+		exact = &Precondition{IfMatch: existing.ETag()}
+	}
+	return storage.storage.CompareAndSetEntryContext(ctx, key, exact, MergeEntries(existing, entry))
+}
+
+// ReplicateEntryContext merges provided entry with any existing versions
+// associated with given key, as by SetEntryContext. As merging never discards
+// later versions, the entry is only stored if superseding those already held.
+func (storage *VersionedStorage) ReplicateEntryContext(ctx context.Context, key *ID, entry *Entry) error {
+	return storage.SetEntryContext(ctx, key, entry)
+}
+
+// Remove attempts to remove one key/value pair from store with a key
+// matching given.
+func (storage *VersionedStorage) Remove(key *ID) error {
+	return storage.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext is like Remove, but fails if `ctx` is done before the pair is
+// removed.
+func (storage *VersionedStorage) RemoveContext(ctx context.Context, key *ID) error {
+	return storage.storage.RemoveContext(ctx, key)
+}
+
+// CompareAndRemove removes the entry associated with given key only if it
+// satisfies given precondition.
+//
+// ErrPreconditionFailed is returned if the precondition is not satisfied.
+func (storage *VersionedStorage) CompareAndRemove(key *ID, pre *Precondition) error {
+	return storage.CompareAndRemoveContext(context.Background(), key, pre)
+}
+
+// CompareAndRemoveContext is like CompareAndRemove, but fails if `ctx` is done
+// before the entry is removed.
+func (storage *VersionedStorage) CompareAndRemoveContext(ctx context.Context, key *ID, pre *Precondition) error {
+	return storage.storage.CompareAndRemoveContext(ctx, key, pre)
+}
+
+// RemoveExpired removes all entries expired at given time, returning the
+// amount of entries removed.
+//
+// Nothing is removed if the wrapped storage is not an ExpiringStorage.
+func (storage *VersionedStorage) RemoveExpired(now time.Time) int {
+	if expiring, ok := storage.storage.(ExpiringStorage); ok {
+		return expiring.RemoveExpired(now)
+	}
+	return 0
+}
+
+// Close closes the wrapped storage, if it is an io.Closer.
+func (storage *VersionedStorage) Close() error {
+	if closer, ok := storage.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Compact compacts the wrapped storage.
+//
+// ErrNotSupported is returned if the wrapped storage is not a
+// CompactingStorage.
+func (storage *VersionedStorage) Compact() error {
+	if compacting, ok := storage.storage.(CompactingStorage); ok {
+		return compacting.Compact()
+	}
+	return ErrNotSupported
+}
+
+// WriteSnapshot writes a snapshot of the wrapped storage to `w`.
+//
+// ErrNotSupported is returned if the wrapped storage is not a
+// SnapshottingStorage.
+func (storage *VersionedStorage) WriteSnapshot(w io.Writer) error {
+	if snapshotting, ok := storage.storage.(SnapshottingStorage); ok {
+		return snapshotting.WriteSnapshot(w)
+	}
+	return ErrNotSupported
+}
+
+// ReadSnapshot replaces all entries of the wrapped storage with those of
+// given snapshot.
+//
+// ErrNotSupported is returned if the wrapped storage is not a
+// SnapshottingStorage.
+func (storage *VersionedStorage) ReadSnapshot(r io.Reader) error {
+	if snapshotting, ok := storage.storage.(SnapshottingStorage); ok {
+		return snapshotting.ReadSnapshot(r)
+	}
+	return ErrNotSupported
+}
@@ -4,43 +4,126 @@ import (
 	"flag"
 	"net"
 	"net/http"
-	"runtime"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/ltu-tmmoa/chord-sky/chord"
+	"github.com/ltu-tmmoa/chord-sky/data"
 	"github.com/ltu-tmmoa/chord-sky/log"
 	cnet "github.com/ltu-tmmoa/chord-sky/net"
 )
 
 var peer string
 var port int
+var ids string
+var config = chord.NewConfig()
+var transport = chord.NewHTTPTransport()
 
 func init() {
+	config.Transport = transport
 	flag.StringVar(&peer, "peer", "", "<IP:PORT> of Chord Sky Node to join. If not given a new ring is created.")
 	flag.IntVar(&port, "port", 8080, "Network port number to use for receiving incoming connections.")
+	flag.IntVar(&config.Replicas, "replicas", config.Replicas, "Number of nodes holding a copy of each key, including its owner.")
+	flag.IntVar(&config.ReadQuorum, "read-quorum", config.ReadQuorum, "Default number of replicas required to answer a read.")
+	flag.IntVar(&config.WriteQuorum, "write-quorum", config.WriteQuorum, "Default number of replicas required to acknowledge a write.")
+	flag.BoolVar(&config.Versioned, "versioned", config.Versioned, "Version values using vector clocks, keeping concurrent writes as siblings.")
+	flag.StringVar(&config.DataDir, "data-dir", config.DataDir, "Directory in which to persist stored keys. If not given keys are only held in memory.")
+	flag.Var(&config.Sync, "fsync", "When to flush persisted keys to disk; always, periodically or never.")
+	flag.DurationVar(&config.TombstoneGrace, "tombstone-grace", config.TombstoneGrace, "Duration for which removed keys are remembered, preventing them from being restored by stale replicas.")
+	flag.IntVar(&config.IDSpace.Bits, "id-bits", config.IDSpace.Bits, "Number of bits of ring IDs, which must be the same for all nodes of a ring.")
+	flag.Var(&config.IDSpace.Hash, "id-hash", "Hash used to derive ring IDs; sha1 or sha256. Must be the same for all nodes of a ring.")
+	flag.StringVar(&ids, "id", "", "Comma-separated hexadecimal ring IDs of the virtual nodes of this process, in order. Nodes without IDs have theirs derived from their addresses.")
+	flag.BoolVar(&config.Balance, "balance", config.Balance, "Give virtual nodes without IDs ones splitting the most loaded key range near them when joining a ring.")
+	flag.IntVar(&config.VirtualNodes, "vnodes", config.VirtualNodes, "Number of virtual nodes hosted by this process, each owning its own part of the ring.")
+	flag.DurationVar(&transport.Timeout, "call-timeout", transport.Timeout, "Time allowed for calls to other nodes made without a deadline of their own, including retries.")
+	flag.IntVar(&transport.Retries, "call-retries", transport.Retries, "Number of times lookups and other reads failing to reach a node are retried.")
+	flag.Var(&config.Lookup, "lookup", "How successors of IDs are found by default; iterative, with lookups made by the asking node, or recursive, with lookups forwarded from node to node.")
+	flag.Float64Var(&config.FailureDetector.Threshold, "phi-threshold", config.FailureDetector.Threshold, "Suspicion level (phi) at which unresponsive nodes are disconnected. If 0, nodes are disconnected as soon as they fail to respond.")
 }
 
 func main() {
-	// Force goroutine scheduling to be confined to one thread to avoid having
-	// to lock anything.
-	runtime.GOMAXPROCS(1)
-
 	flag.Parse()
 
 	log.Logger.Println("Chord Sky")
-	http.DefaultClient.Timeout = 5 * time.Second
+	if config.Replicas < 1 {
+		log.Logger.Fatalln("At least 1 replica required, got", config.Replicas)
+	}
+	if config.ReadQuorum < 1 || config.ReadQuorum > config.Replicas {
+		log.Logger.Fatalln("Read quorum must be within [1, replicas], got", config.ReadQuorum)
+	}
+	if config.WriteQuorum < 1 || config.WriteQuorum > config.Replicas {
+		log.Logger.Fatalln("Write quorum must be within [1, replicas], got", config.WriteQuorum)
+	}
+	if err := config.IDSpace.Validate(); err != nil {
+		log.Logger.Fatalln(err)
+	}
+	if config.VirtualNodes < 1 {
+		log.Logger.Fatalln("At least 1 virtual node required, got", config.VirtualNodes)
+	}
+	if len(strings.TrimSpace(ids)) > 0 {
+		for _, str := range strings.Split(ids, ",") {
+			id, ok := data.ParseID(strings.TrimSpace(str), config.IDSpace.Bits)
+			if !ok {
+				log.Logger.Fatalln("Node ID is not valid, got", str)
+			}
+			config.IDs = append(config.IDs, id)
+		}
+	}
+	if len(config.IDs) > config.VirtualNodes {
+		log.Logger.Fatalln("At most one ID per virtual node allowed, got", len(config.IDs))
+	}
+	if transport.Timeout <= 0 {
+		log.Logger.Fatalln("Call timeout must be positive, got", transport.Timeout)
+	}
 
 	laddr, err := cnet.GetLocalTCPAddr(port)
 	if err != nil {
 		log.Logger.Fatalln(err)
 	}
-	chordService := chord.NewHTTPService(laddr)
+	chordService, err := chord.NewHTTPService(laddr, config)
+	if err != nil {
+		log.Logger.Fatalln(err)
+	}
+	storageService := chord.NewHTTPStorageService(chordService)
+	kvService := chord.NewHTTPKVService(chordService)
+	homepage := chord.NewHTTPHomepage()
+
+	// Request paths are not cleaned, as key names given below /kv/ may hold
+	// `.` and `..` segments or repeated slashes.
+	router := mux.NewRouter().SkipClean(true)
+	router.PathPrefix("/node/").Handler(http.StripPrefix("/node", chordService))
+	router.PathPrefix("/storage/").Handler(http.StripPrefix("/storage", storageService))
+	router.PathPrefix("/kv/").Handler(http.StripPrefix("/kv", kvService))
+	router.PathPrefix("/").Handler(homepage)
+	httpServer := http.Server{
+		Addr:         laddr.String(),
+		Handler:      router,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	httpServer.SetKeepAlivesEnabled(false)
+
+	// Connections are accepted before joining, allowing any keys loaded from
+	// disk to be served while the ring is joined.
+	listener, err := net.Listen("tcp", laddr.String())
+	if err != nil {
+		log.Logger.Fatalln(err)
+	}
+	log.Logger.Println("Accepting incoming connections on", laddr, "...")
+	go func() {
+		log.Logger.Fatalln(httpServer.Serve(listener))
+	}()
 
 	trimmedPeer := strings.TrimSpace(peer)
 	if len(trimmedPeer) == 0 {
 		log.Logger.Println("No peer specified. Forming new ring ...")
-		chordService.Join(nil)
+		if err = chordService.Join(nil); err != nil {
+			log.Logger.Fatalln(err)
+		}
 
 	} else {
 		addr, err := net.ResolveTCPAddr("tcp", trimmedPeer)
@@ -48,32 +131,36 @@ func main() {
 			log.Logger.Fatalln(err)
 		}
 		log.Logger.Println("Joining ring via", trimmedPeer, "...")
-		chordService.Join(addr)
+		if err = chordService.Join(addr); err != nil {
+			log.Logger.Fatalln("Failed to join ring.", err)
+		}
 	}
 
 	go func() {
 		for {
-			time.Sleep(10 * time.Second)
-			log.Logger.Println("Refreshing ...")
-			if err := chordService.Refresh(); err != nil {
-				log.Logger.Printf("Refresh error: %s", err.Error())
-			}
+			time.Sleep(1 * time.Second)
+			chordService.RemoveExpired()
 		}
 	}()
 
-	storageService := chord.NewHTTPStorageService()
-	homepage := chord.NewHTTPHomepage()
-
-	log.Logger.Println("Accepting incoming connections on", laddr, "...")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Logger.Println("Received", <-signals, "signal. Leaving ring ...")
+		if err := chordService.Leave(); err != nil {
+			log.Logger.Println("Failed to leave ring.", err.Error())
+		}
+		if err := chordService.Close(); err != nil {
+			log.Logger.Println("Failed to close storage.", err.Error())
+		}
+		os.Exit(0)
+	}()
 
-	http.Handle("/", homepage)
-	http.Handle("/node/", http.StripPrefix("/node", chordService))
-	http.Handle("/storage/", http.StripPrefix("/storage", storageService))
-	httpServer := http.Server{
-		Addr:         laddr.String(),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
+	for {
+		time.Sleep(10 * time.Second)
+		log.Logger.Println("Refreshing ...")
+		if err := chordService.Refresh(); err != nil {
+			log.Logger.Printf("Refresh error: %s", err.Error())
+		}
 	}
-	httpServer.SetKeepAlivesEnabled(false)
-	log.Logger.Fatalln(httpServer.ListenAndServe())
 }
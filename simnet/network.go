@@ -0,0 +1,252 @@
+// Package simnet simulates a network connecting hosts within a single
+// process, allowing distributed algorithms to be tested deterministically.
+//
+// Time is virtual, advancing only as simulated messages are delivered and as
+// scheduled events are run, while all randomness is derived from one seed.
+// Events are run one at a time, but as if concurrently, each starting at its
+// scheduled time no matter how much time earlier events spent on calls.
+// Networks are not safe for concurrent use.
+package simnet
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned by calls that fail to complete, as when their
+	// request or response is lost, or when their destination is unknown,
+	// crashed or partitioned away.
+	ErrTimeout = errors.New("Simulated call timed out.")
+)
+
+// Link determines how messages are delivered between two hosts.
+type Link struct {
+	// Latency is the minimum one-way delay of each message.
+	Latency time.Duration
+
+	// Jitter is the maximum random delay added to Latency.
+	Jitter time.Duration
+
+	// Drop is the probability of any one message being lost, within [0, 1].
+	Drop float64
+}
+
+// Network connects a set of simulated hosts, each identified by an address.
+type Network struct {
+	// Timeout is the duration after which a call whose request or response is
+	// lost fails.
+	Timeout time.Duration
+
+	now    time.Duration
+	rand   *rand.Rand
+	link   Link
+	links  map[[2]string]Link
+	hosts  map[string]*host
+	groups map[string]int
+	events eventQueue
+	seq    uint64
+}
+
+type host struct {
+	handler interface{}
+	crashed bool
+}
+
+// New creates an empty network, whose randomness is derived from given seed.
+func New(seed int64) *Network {
+	return &Network{
+		Timeout: 1 * time.Second,
+		rand:    rand.New(rand.NewSource(seed)),
+		links:   map[[2]string]Link{},
+		hosts:   map[string]*host{},
+		groups:  map[string]int{},
+	}
+}
+
+// Now provides the virtual time elapsed since network creation.
+func (network *Network) Now() time.Duration {
+	return network.now
+}
+
+// Rand provides the seeded source of randomness of the network.
+func (network *Network) Rand() *rand.Rand {
+	return network.rand
+}
+
+// SetLink sets the link used between hosts without one of their own.
+func (network *Network) SetLink(link Link) {
+	network.link = link
+}
+
+// SetLinkBetween sets the link used between the two identified hosts, in both
+// directions.
+func (network *Network) SetLinkBetween(a, b string, link Link) {
+	network.links[[2]string{a, b}] = link
+	network.links[[2]string{b, a}] = link
+}
+
+func (network *Network) linkBetween(from, to string) Link {
+	if link, ok := network.links[[2]string{from, to}]; ok {
+		return link
+	}
+	return network.link
+}
+
+// Listen makes given handler reachable at given address, replacing any host
+// previously listening at it.
+func (network *Network) Listen(addr string, handler interface{}) {
+	network.hosts[addr] = &host{handler: handler}
+}
+
+// Crash makes the host at given address stop responding to calls.
+func (network *Network) Crash(addr string) {
+	if h, ok := network.hosts[addr]; ok {
+		h.crashed = true
+	}
+}
+
+// Crashed determines whether the host at given address is crashed or not
+// known.
+func (network *Network) Crashed(addr string) bool {
+	h, ok := network.hosts[addr]
+	return !ok || h.crashed
+}
+
+// Partition splits the network into given groups of hosts, preventing hosts
+// of different groups from reaching each other. Hosts not part of any group
+// form a group of their own.
+func (network *Network) Partition(groups ...[]string) {
+	network.groups = map[string]int{}
+	for i, group := range groups {
+		for _, addr := range group {
+			network.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes any partitions, allowing all hosts to reach each other again.
+func (network *Network) Heal() {
+	network.groups = map[string]int{}
+}
+
+func (network *Network) reachable(from, to string) bool {
+	return network.groups[from] == network.groups[to] && !network.Crashed(to)
+}
+
+// Call sends a request from one host to another, which handles it by calling
+// `fn` with its handler, and waits for the response.
+//
+// Virtual time advances by the latency of the link between the hosts, both
+// for the request and the response. ErrTimeout is returned if either is lost,
+// in which case time advances by the timeout of the network instead. Note that
+// `fn` is called even if only the response is lost.
+func (network *Network) Call(from, to string, fn func(handler interface{}) error) error {
+	sent := network.now
+	link := network.linkBetween(from, to)
+	if !network.reachable(from, to) || network.dropped(link) {
+		network.now += network.Timeout
+		return ErrTimeout
+	}
+	network.now += network.delay(link)
+	err := fn(network.hosts[to].handler)
+	if !network.reachable(to, from) || network.dropped(link) {
+		if deadline := sent + network.Timeout; network.now < deadline {
+			network.now = deadline
+		}
+		return ErrTimeout
+	}
+	network.now += network.delay(link)
+	return err
+}
+
+func (network *Network) dropped(link Link) bool {
+	return link.Drop > 0 && network.rand.Float64() < link.Drop
+}
+
+func (network *Network) delay(link Link) time.Duration {
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(network.rand.Int63n(int64(link.Jitter) + 1))
+	}
+	return delay
+}
+
+// Schedule arranges for `fn` to be called once given delay has passed.
+//
+// Events scheduled for the same time are run in the order scheduled.
+func (network *Network) Schedule(delay time.Duration, fn func()) {
+	network.seq++
+	heap.Push(&network.events, &event{
+		at:  network.now + delay,
+		seq: network.seq,
+		fn:  fn,
+	})
+}
+
+// Run runs all events scheduled to take place within given duration, after
+// which virtual time is set to the end of the duration.
+//
+// Virtual time is set to the scheduled time of each event before it is run,
+// which makes the time spent on calls by an event only delay the events it
+// schedules itself.
+func (network *Network) Run(d time.Duration) {
+	end := network.now + d
+	for len(network.events) > 0 && network.events[0].at <= end {
+		e := heap.Pop(&network.events).(*event)
+		network.now = e.at
+		e.fn()
+	}
+	network.now = end
+}
+
+// RunUntil runs scheduled events in steps of given duration until `cond`
+// holds, or until given limit has passed.
+//
+// Returns whether `cond` held before the limit passed.
+func (network *Network) RunUntil(step, limit time.Duration, cond func() bool) bool {
+	end := network.now + limit
+	for network.now < end {
+		network.Run(step)
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+type event struct {
+	at  time.Duration
+	seq uint64
+	fn  func()
+}
+
+type eventQueue []*event
+
+func (queue eventQueue) Len() int {
+	return len(queue)
+}
+
+func (queue eventQueue) Less(i, j int) bool {
+	if queue[i].at != queue[j].at {
+		return queue[i].at < queue[j].at
+	}
+	return queue[i].seq < queue[j].seq
+}
+
+func (queue eventQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+}
+
+func (queue *eventQueue) Push(x interface{}) {
+	*queue = append(*queue, x.(*event))
+}
+
+func (queue *eventQueue) Pop() interface{} {
+	old := *queue
+	e := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return e
+}
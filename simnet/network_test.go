@@ -0,0 +1,101 @@
+package simnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNetworkCall(t *testing.T) {
+	network := New(1)
+	network.SetLink(Link{Latency: 10 * time.Millisecond})
+	network.Listen("a", "A")
+	network.Listen("b", "B")
+
+	var handled interface{}
+	err := network.Call("a", "b", func(handler interface{}) error {
+		handled = handler
+		return nil
+	})
+	if err != nil || handled != "B" {
+		t.Errorf("Call(a, b) expected to be handled by B, was %v (%v)", handled, err)
+	}
+	if now := network.Now(); now != 20*time.Millisecond {
+		t.Errorf("Call(a, b) expected to take 20ms, took %v", now)
+	}
+
+	network.Crash("b")
+	if err = network.Call("a", "b", func(interface{}) error { return nil }); err != ErrTimeout {
+		t.Errorf("Call(a, b) to crashed host expected to time out, got %v", err)
+	}
+	if now := network.Now(); now != 20*time.Millisecond+network.Timeout {
+		t.Errorf("Call(a, b) to crashed host expected to take %v, took %v", network.Timeout, now-20*time.Millisecond)
+	}
+	if err = network.Call("a", "c", func(interface{}) error { return nil }); err != ErrTimeout {
+		t.Errorf("Call(a, c) to unknown host expected to time out, got %v", err)
+	}
+}
+
+func TestNetworkPartition(t *testing.T) {
+	network := New(1)
+	for _, addr := range []string{"a", "b", "c"} {
+		network.Listen(addr, addr)
+	}
+	network.Partition([]string{"a", "b"})
+
+	expectReachable := func(from, to string, expected bool) {
+		err := network.Call(from, to, func(interface{}) error { return nil })
+		if (err == nil) != expected {
+			t.Errorf("Call(%s, %s) expected to succeed: %v, got %v", from, to, expected, err)
+		}
+	}
+	expectReachable("a", "b", true)
+	expectReachable("a", "c", false)
+	expectReachable("c", "b", false)
+
+	network.Heal()
+	expectReachable("a", "c", true)
+}
+
+func TestNetworkDrop(t *testing.T) {
+	count := func(seed int64) (drops int) {
+		network := New(seed)
+		network.Listen("a", nil)
+		network.Listen("b", nil)
+		network.SetLinkBetween("a", "b", Link{Drop: 0.5})
+		for i := 0; i < 1000; i++ {
+			if network.Call("a", "b", func(interface{}) error { return nil }) == ErrTimeout {
+				drops++
+			}
+		}
+		return drops
+	}
+	drops := count(7)
+	if drops < 650 || drops > 850 {
+		t.Errorf("About 750 of 1000 calls expected to be dropped, %d were", drops)
+	}
+	if again := count(7); again != drops {
+		t.Errorf("Calls expected to be dropped deterministically, %d != %d", again, drops)
+	}
+}
+
+func TestNetworkSchedule(t *testing.T) {
+	network := New(1)
+	order := []int{}
+	network.Schedule(2*time.Second, func() { order = append(order, 2) })
+	network.Schedule(1*time.Second, func() {
+		order = append(order, 1)
+		network.Schedule(2*time.Second, func() { order = append(order, 3) })
+	})
+	network.Schedule(1*time.Second, func() { order = append(order, 11) })
+
+	network.Run(2 * time.Second)
+	if len(order) != 3 || order[0] != 1 || order[1] != 11 || order[2] != 2 {
+		t.Errorf("Events expected to run in order [1 11 2], ran %v", order)
+	}
+	if !network.RunUntil(time.Second, 10*time.Second, func() bool { return len(order) == 4 }) {
+		t.Errorf("Event 3 expected to run")
+	}
+	if now := network.Now(); now != 3*time.Second {
+		t.Errorf("Event 3 expected to run at 3s, ran at %v", now)
+	}
+}